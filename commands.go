@@ -0,0 +1,528 @@
+/*************************************************************************
+ * Copyright 2017 John Floren. All rights reserved.
+ * Contact: <john@jfloren.net>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A command is one of zk's subcommands.
+type command struct {
+	name    string
+	aliases []string // short forms, e.g. "s" for show
+	usage   string   // the flags and arguments, as shown after "zk <name>"
+	summary string   // one line for the command list
+	help    string   // the longer description shown by zk help <name>
+
+	// The number of arguments left after the flags; max -1 means
+	// any number.
+	min, max int
+	// What each argument is, for completion; the last kind repeats
+	// if max allows more arguments.
+	args []int
+
+	// flags defines the command's flags on a new flag set. It's
+	// called each time the command runs, which resets the flags'
+	// variables to their defaults.
+	flags func(fs *flag.FlagSet)
+
+	noZK   bool // runs without opening the zk
+	hidden bool // left out of the help and completion
+	run    func(args []string)
+}
+
+// Flags belonging to individual commands
+var (
+	newSuggest   bool
+	grepFiles    bool
+	sedTree      string
+	sedDryRun    bool
+	sedUndo      bool
+	exportFormat string
+	dumpFiles    string
+	uidEnable    bool
+	listenAddr   string
+	watchPoll    time.Duration
+)
+
+// commands are all of zk's commands, in the order zk help lists them.
+// It's filled in by init, since the help command refers back to it.
+var commands []*command
+
+func init() {
+	listen := func(def string) func(fs *flag.FlagSet) {
+		return func(fs *flag.FlagSet) {
+			fs.StringVar(&listenAddr, "addr", def, "`host:port` on which to listen")
+		}
+	}
+
+	commands = []*command{
+		{
+			name: "show", aliases: []string{"s"}, usage: "[note]",
+			summary: "show a note and its sub-notes",
+			help:    "Show the title of the current or given note and the titles of its sub-notes.",
+			max:     1, args: []int{argNote},
+			run: showNote,
+		},
+		{
+			name: "up", aliases: []string{"u"},
+			summary: "go up to the current note's parent",
+			help:    "Make the current note's parent the current note, and show it. If the\nnote is linked in several places, this goes to the note it was created\nunder.",
+			run:     up,
+		},
+		{
+			name: "print", aliases: []string{"p"}, usage: "[note]",
+			summary: "print a note",
+			help:    "Print the body of the current or given note.",
+			max:     1, args: []int{argNote},
+			run: printNote,
+		},
+		{
+			name: "tree", aliases: []string{"t"}, usage: "[note]",
+			summary: "show the note tree",
+			help:    "Show the tree of notes below note 0, or below the given note.",
+			max:     1, args: []int{argNote},
+			run: printTree,
+		},
+		{
+			name: "grep", usage: "[-files] [--] <pattern>",
+			summary: "search all notes",
+			help:    "Print the lines of all notes matching a regular expression. The rest\nof the arguments are joined with spaces to make the pattern, so it\nneedn't be quoted. Put -- before a pattern which starts with a dash.",
+			min:     1, max: -1,
+			flags: func(fs *flag.FlagSet) {
+				fs.BoolVar(&grepFiles, "files", false, "also search text-like attached files")
+			},
+			run: grep,
+		},
+		{
+			name: "tgrep", usage: "[-files] [--] [note] <pattern>",
+			summary: "search a note and its sub-notes",
+			help:    "Like grep, but only search the current or given note and the notes\nbelow it.",
+			min:     1, max: -1, args: []int{argNote, argNone},
+			flags: func(fs *flag.FlagSet) {
+				fs.BoolVar(&grepFiles, "files", false, "also search text-like attached files")
+			},
+			run: tgrep,
+		},
+		{
+			name: "related", usage: "[note] [count]",
+			summary: "list notes related to a note",
+			help:    "List the notes most similar to the current or given note, ranked by\nshared words and shared links. count defaults to 10.",
+			max:     2, args: []int{argNote, argNone},
+			run: related,
+		},
+		{
+			name: "new", aliases: []string{"n"}, usage: "[-suggest] [parent]",
+			summary: "create a note",
+			help:    "Create a note under the current or given note, reading its body from\nstandard input. The first line is the title.",
+			max:     1, args: []int{argNote},
+			flags: func(fs *flag.FlagSet) {
+				fs.BoolVar(&newSuggest, "suggest", false, "list existing notes the new one might be linked under")
+			},
+			run: newNote,
+		},
+		{
+			name: "edit", aliases: []string{"e"}, usage: "[note]",
+			summary: "edit a note in $EDITOR",
+			help:    "Edit the body of the current or given note with $EDITOR, or vim if\nit's unset.",
+			max:     1, args: []int{argNote},
+			run: editNote,
+		},
+		{
+			name: "append", aliases: []string{"a"}, usage: "[note]",
+			summary: "append standard input to a note",
+			help:    "Append standard input to the body of the current or given note.",
+			max:     1, args: []int{argNote},
+			run: appendNote,
+		},
+		{
+			name: "link", usage: "<note> <parent>",
+			summary: "link a note under another",
+			help:    "Make note a sub-note of parent, as well as of wherever it is already.",
+			min:     2, max: 2, args: []int{argNote, argNote},
+			run: linkNote,
+		},
+		{
+			name: "unlink", usage: "<note> [parent]",
+			summary: "unlink a note from another",
+			help:    "Remove note from the sub-notes of the current note, or of parent.",
+			min:     1, max: 2, args: []int{argNote, argNote},
+			run: unlinkNote,
+		},
+		{
+			name: "addfile", usage: "[note] <file>",
+			summary: "attach a file to a note",
+			help:    "Copy a file into the current or given note's attachments.",
+			min:     1, max: 2, args: []int{argNoteOrPath, argPath},
+			run: addFile,
+		},
+		{
+			name: "rmfile", usage: "[note] <name>",
+			summary: "remove a file from a note",
+			help:    "Remove an attached file from the current or given note.",
+			min:     1, max: 2, args: []int{argNoteOrFile, argFile},
+			run: rmFile,
+		},
+		{
+			name: "listfiles", aliases: []string{"ls"}, usage: "[note]",
+			summary: "list a note's files",
+			help:    "List the files attached to the current or given note.",
+			max:     1, args: []int{argNote},
+			run: listFiles,
+		},
+		{
+			name: "sed", usage: "[-tree note] [-dry-run] [--] 's/old/new/' | -undo",
+			summary: "search and replace in notes",
+			help:    "Replace regular expression matches in note bodies, printing each\nchange. The replacement may refer to submatches as $1, $2, etc. The\nflags i (ignore case) and g (the default anyway) may follow the\nexpression. -undo reverts the most recent replacement. Put -- before an\nexpression which starts with a dash.",
+			max:     1,
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&sedTree, "tree", "", "only change this `note` and the notes below it")
+				fs.BoolVar(&sedDryRun, "dry-run", false, "show the changes without making them")
+				fs.BoolVar(&sedDryRun, "n", false, "short for -dry-run")
+				fs.BoolVar(&sedUndo, "undo", false, "revert the last replacement")
+			},
+			run: sed,
+		},
+		{
+			name: "savesearch", usage: "[--] <name> <query>",
+			summary: "create a saved search",
+			help:    "Create a note under the current note whose sub-notes are the results\nof a search, re-run whenever it is shown. The query is a regular\nexpression, optionally preceded by under:<id>, files:, after:YYYY-MM-DD\nand before:YYYY-MM-DD.",
+			min:     2, max: -1,
+			run: saveSearch,
+		},
+		{
+			name: "alias", usage: "<note> <name>",
+			summary: "give a note an alias",
+			help:    "Give a note a name which can be used in place of its id.",
+			min:     2, max: 2, args: []int{argNote, argNone},
+			run: alias,
+		},
+		{
+			name: "unalias", usage: "<name>",
+			summary: "remove an alias",
+			min:     1, max: 1, args: []int{argAlias},
+			run: unalias,
+		},
+		{
+			name:    "aliases",
+			summary: "list aliases",
+			run:     aliases,
+		},
+		{
+			name: "uid", usage: "[-enable] [note]",
+			summary: "show a note's unique id",
+			help:    "Print the unique id of the current or given note. Unique ids are\nULIDs, which don't collide between copies of a zk, and can be used\nwherever a note id can, including in [[references]]. -enable turns\nthem on for the zk, giving one to every existing note and each new\none; references inserted by zk import and zk lsp then use them.",
+			max:     1, args: []int{argNote},
+			flags: func(fs *flag.FlagSet) {
+				fs.BoolVar(&uidEnable, "enable", false, "give every note in the zk a unique id")
+			},
+			run: uid,
+		},
+		{
+			name:    "orphans",
+			summary: "list notes with no parents",
+			run:     orphans,
+		},
+		{
+			name:    "rescan",
+			summary: "rebuild the state from the notes on disk",
+			help:    "Re-read every note's metadata from disk, e.g. after editing the zk's\nfiles by hand.",
+			run:     rescan,
+		},
+		{
+			name: "watch", usage: "[-poll interval]",
+			summary: "keep the state up to date with changes made outside zk",
+			help:    "Run until interrupted, watching the notes for changes made outside\nzk, such as a title changed in an editor or notes brought in by\nSyncthing or git, taking them into the zk's state so there's no need\nfor zk rescan, and printing each one. Changes are noticed with\ninotify on Linux; -poll checks every interval instead, e.g. -poll 5s,\nwhich also sees changes inotify can't, such as on a network file\nsystem. Elsewhere it always polls, every 2s by default.",
+			flags: func(fs *flag.FlagSet) {
+				fs.DurationVar(&watchPoll, "poll", 0, "poll for changes every `interval` instead of using inotify")
+			},
+			run: watch,
+		},
+		{
+			name: "export", usage: "[-format md|html|org] <note> <dest>",
+			summary: "export a tree of notes as Markdown, HTML or org-mode",
+			help:    "Write note and the notes below it to the directory dest, one file\nper note, in directories mirroring the tree, with an index page.\nReferences between the notes become relative links and attachments\nare copied alongside. Notes linked in several places are written once.\ndest must be empty.\n\nWith -format org, the notes are written as the headings of a single\norg-mode file named dest, or to standard output if dest is left out.",
+			min:     1, max: 2, args: []int{argNote, argPath},
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&exportFormat, "format", "md", "md for Markdown files, html for a static web site, or org")
+			},
+			run: export,
+		},
+		{
+			name: "import", usage: "markdown|org <path> [parent]",
+			summary: "import notes from other tools",
+			help:    "Import notes under the current or given note.\n\nimport markdown imports a folder of Markdown files, such as an Obsidian\nvault. Each file becomes a note, titled by its leading heading or its\nname, and each folder becomes a note with the folder's contents below\nit. Wikilinks and relative links become references, and linked images\nand files are attached. Running it again only imports new files.\n\nimport org imports an org-mode file as a note with each heading as a\nnote below it. Tags go on the second line of the note, as \"Tags: :a:b:\",\nand property drawers are kept in the body, so export -format org gives\nthem back.",
+			min:     2, max: 3, args: []int{argImportFormat, argPath, argNote},
+			run: importNotes,
+		},
+		{
+			name: "dump", usage: "[-files dir] [file]",
+			summary: "write the whole zk as JSON lines",
+			help:    "Write the whole zk to file, or standard output, as JSON lines: a\nheader with the aliases and next note id, then one object per note\nwith its metadata, body and attached files. Files are included as\nbase64 unless -files is given, in which case they're copied there and\nthe dump refers to them.",
+			max:     1, args: []int{argPath},
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&dumpFiles, "files", "", "copy attached files to `dir` rather than including them")
+			},
+			run: dump,
+		},
+		{
+			name: "load", usage: "[-files dir] <file> [parent]",
+			summary: "load notes from zk dump",
+			help:    "Read a dump made by zk dump, from file, or standard input if file is\n-. Loaded into a new, empty zk, the notes keep their ids and aliases.\nOtherwise, or if parent is given, they go under the current or given\nnote with new ids, and references between them are updated to match;\naliases already in use are renamed. Files the dump refers to are\nlooked for in the -files directory given to zk dump.",
+			min:     1, max: 2, args: []int{argPath, argNote},
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&dumpFiles, "files", "", "`dir` holding the files the dump refers to")
+			},
+			run: load,
+		},
+		{
+			name: "merge-repo", usage: "<other-root> [under-parent]",
+			summary: "merge another zk into this one",
+			help:    "Copy every note of the zk at other-root into this one with new ids,\nputting its top-level note under the current note or under-parent.\nSub-notes, parents and references between the notes are updated to\nthe new ids. Aliases which are already taken here get a number added,\nand references to them are changed to match. The other zk is left as\nit was.",
+			min:     1, max: 2, args: []int{argDir, argNote},
+			run: mergeRepo,
+		},
+		{
+			name: "sync", usage: "<path-or-url>",
+			summary: "sync with another copy of the zk",
+			help:    "Bring this zk and another into step: the zk at a path, or one being\nserved by zk serve, given as http://host:port. Notes are matched by\ntheir unique ids, so run zk uid -enable before copying the zk with\nbackup or dump, or start the copy empty and sync it; zks with no notes\nin common are refused. Changes made on either side since the last\nsync are copied to the other, and links, files and aliases added or\nremoved on both are combined. If a note's body changed on both sides,\nthe changes are merged line by line; if they touch the same lines,\nthis side's body is kept and the other's goes in a conflict copy\nbeneath it, for zk resolve.",
+			min:     1, max: 1, args: []int{argDir},
+			run: syncZK,
+		},
+		{
+			name:    "conflicts",
+			summary: "list notes with unresolved conflicts",
+			help:    "List the notes with more than one version of their body: conflict\ncopies made by zk sync, body.sync-conflict files left by Syncthing,\nor conflict markers left by git.",
+			run:     conflicts,
+		},
+		{
+			name: "resolve", usage: "<note>",
+			summary: "merge a note's conflicting versions in $EDITOR",
+			help:    "Merge the versions of a conflicting note's body line by line against\nthe last version both copies of the zk agreed on, and open the result\nin $EDITOR, with conflict markers where the versions differ. Once the\nmarkers are gone the result becomes the note's body, its conflict\ncopies are unlinked and Syncthing's versions are removed. If markers\nremain, the result is saved as the body with them in, and zk resolve\ntakes it up from there next time. The note can also be given by one\nof its conflict copies.\n\nThe last agreed version is kept in the note's base file. Without one,\nthe common ancestor git recorded is used if the zk is in the middle\nof a git merge; failing that, every line that differs is a conflict.",
+			min:     1, max: 1, args: []int{argNote},
+			run: resolve,
+		},
+		{
+			name: "backup", usage: "<file>",
+			summary: "save the whole zk to an archive",
+			help:    "Write a snapshot of the whole zk to file, as a gzipped tar archive\nwith a manifest of checksums, and check it by reading it back. A\nfile of - means standard output.",
+			min:     1, max: 1, args: []int{argPath},
+			run: backup,
+		},
+		{
+			name: "restore", usage: "<file> <dir>",
+			summary: "recreate a zk from a backup",
+			help:    "Unpack a backup made by zk backup into dir, which must be new or\nempty. Every file is checked against the backup's manifest first, and\nnothing is written to dir unless they all match. Use zk init to switch\nto the restored zk.",
+			min:     2, max: 2, args: []int{argPath, argDir},
+			noZK: true,
+			run:  restore,
+		},
+		{
+			name: "init", usage: "<path>",
+			summary: "create a zk or switch to another",
+			help:    "Make the zk at path the one zk uses, creating it if need be.",
+			min:     1, max: 1, args: []int{argDir},
+			noZK: true,
+			run:  initZK,
+		},
+		{
+			name: "serve", usage: "[-addr host:port]",
+			summary: "serve the web interface and HTTP API",
+			help:    "Serve a web interface at /, a JSON API at /api/ and WebDAV at /dav/.",
+			flags:   listen("localhost:8080"),
+			run:     serve,
+		},
+		{
+			name: "9p", usage: "[-addr host:port]",
+			summary: "serve the zk over 9P",
+			flags:   listen("localhost:5640"),
+			run:     serve9p,
+		},
+		{
+			name: "dav", usage: "[-addr host:port]",
+			summary: "serve the zk over WebDAV",
+			flags:   listen("localhost:8081"),
+			run:     serveDAV,
+		},
+		{
+			name:    "tui",
+			summary: "browse the zk full-screen",
+			run:     tui,
+		},
+		{
+			name:    "shell",
+			summary: "run commands interactively",
+			help:    "Run zk commands at a prompt, keeping the zk open between them. cd\nand pwd move around the tree like a directory hierarchy. Commands can\nalso be piped in as a script, in which case those which read standard\ninput or start an editor, such as new, append and edit, refuse to run.",
+			run:     shell,
+		},
+		{
+			name:    "lsp",
+			summary: "run the language server",
+			help:    "Speak the Language Server Protocol on standard input and output, for\nediting note bodies in an editor which supports it.",
+			run:     lsp,
+		},
+		{
+			name: "completion", usage: "bash|zsh|fish",
+			summary: "print a shell completion script",
+			min:     1, max: 1, args: []int{argShell},
+			noZK: true,
+			run:  completion,
+		},
+		{
+			name: "help", usage: "[command]",
+			summary: "show help for zk or a command",
+			max:     1, args: []int{argCommand},
+			noZK: true,
+			run:  help,
+		},
+		{
+			name: "__complete", usage: "<word>...",
+			max: -1, noZK: true, hidden: true,
+			run: complete,
+		},
+	}
+}
+
+// findCommand returns the command with the given name or short form,
+// or nil.
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, a := range c.aliases {
+			if a == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// flagSet returns a new flag set holding the command's flags.
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	return fs
+}
+
+// exec parses the command's flags, checks its arguments and runs it.
+func (c *command) exec(args []string) {
+	fs := c.flagSet()
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		c.printHelp(os.Stdout)
+		return
+	} else if err != nil {
+		c.usageError(err.Error())
+	}
+	if fs.NArg() < c.min || (c.max >= 0 && fs.NArg() > c.max) {
+		c.usageError("")
+	}
+	c.run(fs.Args())
+}
+
+// usageError ends the command with its usage, after the problem if
+// there is one.
+func (c *command) usageError(problem string) {
+	if problem != "" {
+		problem = fmt.Sprintf("zk %s: %s\n", c.name, problem)
+	}
+	fatalf("%susage: zk %s\nRun \"zk help %s\" for details.", problem, c.synopsis(), c.name)
+}
+
+func (c *command) synopsis() string {
+	if c.usage == "" {
+		return c.name
+	}
+	return c.name + " " + c.usage
+}
+
+func (c *command) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "usage: zk %s\n", c.synopsis())
+	if len(c.aliases) > 0 {
+		fmt.Fprintf(w, "   or: zk %s %s\n", strings.Join(c.aliases, ", "), c.usage)
+	}
+	help := c.help
+	if help == "" {
+		help = strings.ToUpper(c.summary[:1]) + c.summary[1:] + "."
+	}
+	fmt.Fprintf(w, "\n%s\n", help)
+	fs := c.flagSet()
+	if hasFlags(fs) {
+		fmt.Fprintf(w, "\nFlags:\n")
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+	}
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	return n > 0
+}
+
+// printUsage prints the list of commands.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: zk [-config file] [-json | -jsonl] <command> [arguments]\n")
+	fmt.Fprintf(w, "   or: zk [note]\n\n")
+	fmt.Fprintf(w, "With no command, zk shows the current note. Given a note id or alias,\n")
+	fmt.Fprintf(w, "it makes that note the current note and shows it.\n\n")
+	fmt.Fprintf(w, "Commands:\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		if c.hidden {
+			continue
+		}
+		names := c.name
+		if len(c.aliases) > 0 {
+			names += " (" + strings.Join(c.aliases, ", ") + ")"
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\n", names, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nGlobal flags:\n")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+	fmt.Fprintf(w, "\nRun \"zk help <command>\" for more about a command.\n")
+}
+
+func help(args []string) {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return
+	}
+	c := findCommand(args[0])
+	if c == nil || c.hidden {
+		fatalf("unknown command %q; run \"zk help\" for a list", args[0])
+	}
+	c.printHelp(os.Stdout)
+}
+
+// commandNames returns the names of the visible commands, sorted.
+func commandNames() []string {
+	var names []string
+	for _, c := range commands {
+		if !c.hidden {
+			names = append(names, c.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,284 @@
+/*************************************************************************
+ * Copyright 2017 John Floren. All rights reserved.
+ * Contact: <john@jfloren.net>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+// Kinds of command argument, for completion
+const (
+	argNone = iota
+	argNote
+	argNoteOrPath // addfile's optional note, or the file
+	argNoteOrFile // rmfile's optional note, or the attachment
+	argAlias
+	argFile // an attachment of the note named by the previous argument
+	argPath
+	argDir
+	argShell
+	argCommand
+	argImportFormat
+)
+
+// complete implements the hidden __complete command used by the
+// completion scripts. Its arguments are the words of the command line
+// after "zk", the last being the one to complete. It prints one
+// candidate per line, as the value, a tab and a description; a final
+// ":files" or ":dirs" line asks the shell to complete paths too.
+func complete(args []string) {
+	// Skip the global flags, noting which config they choose
+	for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+		name := strings.TrimLeft(args[0], "-")
+		if name == "config" {
+			*configFile = args[1]
+			args = args[1:]
+		} else if strings.HasPrefix(name, "config=") {
+			*configFile = strings.TrimPrefix(name, "config=")
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return
+	}
+	word := args[len(args)-1]
+
+	if len(args) == 1 {
+		completeCommands(word, true)
+		return
+	}
+	c := findCommand(args[0])
+	if c == nil || c.hidden {
+		return
+	}
+
+	// Find which argument is being completed, after the flags
+	fs := c.flagSet()
+	if strings.HasPrefix(word, "-") {
+		fs.VisitAll(func(f *flag.Flag) {
+			if strings.HasPrefix("-"+f.Name, word) {
+				_, usage := flag.UnquoteUsage(f)
+				fmt.Printf("-%s\t%s\n", f.Name, usage)
+			}
+		})
+		return
+	}
+	if fs.Parse(args[1:len(args)-1]) != nil {
+		return
+	}
+	prev := args[len(args)-2]
+	n := fs.NArg()
+	if c.max >= 0 && n >= c.max || len(c.args) == 0 {
+		return
+	}
+	kind := c.args[len(c.args)-1]
+	if n < len(c.args) {
+		kind = c.args[n]
+	}
+
+	switch kind {
+	case argShell:
+		for _, sh := range []string{"bash", "zsh", "fish"} {
+			if strings.HasPrefix(sh, word) {
+				fmt.Println(sh)
+			}
+		}
+		return
+	case argCommand:
+		completeCommands(word, false)
+		return
+	case argImportFormat:
+		for _, f := range importFormats {
+			if strings.HasPrefix(f, word) {
+				fmt.Println(f)
+			}
+		}
+		return
+	case argPath:
+		fmt.Println(":files")
+		return
+	case argDir:
+		fmt.Println(":dirs")
+		return
+	case argNone:
+		return
+	}
+
+	// Everything else needs the zk, but failing to open it
+	// shouldn't print anything
+	if readConfig() != nil {
+		return
+	}
+	var err error
+	if z, err = zk.NewZK(cfg.ZKRoot); err != nil {
+		return
+	}
+	switch kind {
+	case argNote:
+		completeNotes(word)
+	case argNoteOrPath:
+		completeNotes(word)
+		fmt.Println(":files")
+	case argNoteOrFile:
+		completeFiles(cfg.CurrentNoteId, word)
+		completeNotes(word)
+	case argAlias:
+		completeAliases(word)
+	case argFile:
+		if id, err := z.ResolveNoteId(prev); err == nil {
+			completeFiles(id, word)
+		}
+	}
+}
+
+// completeCommands prints the commands starting with word, including
+// their short forms if short is set.
+func completeCommands(word string, short bool) {
+	for _, c := range commands {
+		if c.hidden {
+			continue
+		}
+		names := []string{c.name}
+		if short {
+			names = append(names, c.aliases...)
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, word) {
+				fmt.Printf("%s\t%s\n", name, c.summary)
+			}
+		}
+	}
+}
+
+func completeNotes(word string) {
+	var ids []int
+	for id := range z.MetadataDump() {
+		if strings.HasPrefix(strconv.Itoa(id), word) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		md, _ := z.GetNoteMeta(id)
+		fmt.Printf("%d\t%s\n", id, md.Title)
+	}
+	completeAliases(word)
+}
+
+func completeAliases(word string) {
+	aliases := z.Aliases()
+	var names []string
+	for name := range aliases {
+		if strings.HasPrefix(name, word) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		md, _ := z.GetNoteMeta(aliases[name])
+		fmt.Printf("%s\talias for %d: %s\n", name, md.Id, md.Title)
+	}
+}
+
+func completeFiles(id int, word string) {
+	md, err := z.GetNoteMeta(id)
+	if err != nil {
+		return
+	}
+	for _, f := range md.Files {
+		if strings.HasPrefix(f, word) {
+			fmt.Printf("%s\tfile of %d: %s\n", f, id, md.Title)
+		}
+	}
+}
+
+func completion(args []string) {
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		fatalf("no completion script for %q; try bash, zsh or fish", args[0])
+	}
+	os.Stdout.WriteString(script)
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for zk. Load it with
+#	source <(zk completion bash)
+_zk() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" line
+	COMPREPLY=()
+	while IFS= read -r line; do
+		case "$line" in
+		:files)
+			compopt -o filenames 2>/dev/null
+			COMPREPLY+=($(compgen -f -- "$cur"))
+			;;
+		:dirs)
+			compopt -o filenames 2>/dev/null
+			COMPREPLY+=($(compgen -d -- "$cur"))
+			;;
+		*)
+			COMPREPLY+=("${line%%$'\t'*}")
+			;;
+		esac
+	done < <(zk __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+}
+complete -F _zk zk
+`,
+	"zsh": `#compdef zk
+# zsh completion for zk. Load it with
+#	source <(zk completion zsh)
+# or save it as _zk somewhere in your $fpath.
+_zk() {
+	local -a cands
+	local line paths
+	for line in "${(@f)$(zk __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+		case "$line" in
+		:files) paths=files ;;
+		:dirs) paths=dirs ;;
+		'') ;;
+		*) cands+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}") ;;
+		esac
+	done
+	(( ${#cands} )) && _describe zk cands
+	[[ $paths == files ]] && _files
+	[[ $paths == dirs ]] && _files -/
+	return 0
+}
+if [[ "$funcstack[1]" == _zk ]]; then
+	_zk "$@"
+else
+	compdef _zk zk
+fi
+`,
+	"fish": `# fish completion for zk. Load it with
+#	zk completion fish | source
+function __zk_complete
+	set -l words (commandline -opc)
+	set -l cur (commandline -ct)
+	for line in (zk __complete $words[2..-1] "$cur" 2>/dev/null)
+		switch $line
+			case :files
+				__fish_complete_path $cur
+			case :dirs
+				__fish_complete_directories $cur
+			case '*'
+				echo $line
+		end
+	end
+end
+complete -c zk -f -a '(__zk_complete)'
+`,
+}
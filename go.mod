@@ -1,3 +1,9 @@
 module github.com/floren/zk
 
-go 1.13
+go 1.16
+
+require (
+	9fans.net/go v0.0.7
+	golang.org/x/net v0.1.0
+	golang.org/x/term v0.1.0
+)
@@ -0,0 +1,63 @@
+/*************************************************************************
+ * Copyright 2017 John Floren. All rights reserved.
+ * Contact: <john@jfloren.net>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+// Hooks are executables in the zk's hooks directory, named for the
+// events they follow: hooks/post-new runs after a note is created,
+// hooks/post-update after one is changed, and so on. Each is run with
+// the note's id as its argument and the event as JSON on its standard
+// input, from the zk's root. Its output goes to zk's standard error,
+// and if it fails zk just says so, since the change has already been
+// made.
+
+// jsonHookEvent is what a hook reads from its standard input.
+type jsonHookEvent struct {
+	Version int
+	zk.Event
+}
+
+// runHook runs the hook for an event, if there is one.
+func runHook(e zk.Event) {
+	name := "post-" + string(e.Type)
+	// The hook runs from the root, so a relative path won't do
+	p, err := filepath.Abs(filepath.Join(cfg.ZKRoot, "hooks", name))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Hook %v: %v\n", name, err)
+		return
+	}
+	fi, err := os.Stat(p)
+	if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+		return
+	}
+	b, err := json.Marshal(jsonHookEvent{Version: jsonVersion, Event: e})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Hook %v: %v\n", name, err)
+		return
+	}
+	cmd := exec.Command(p, strconv.Itoa(e.Note.Id))
+	cmd.Dir = cfg.ZKRoot
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Hook %v failed: %v\n", name, err)
+	}
+}
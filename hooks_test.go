@@ -0,0 +1,55 @@
+/*************************************************************************
+ * Copyright 2017 John Floren. All rights reserved.
+ * Contact: <john@jfloren.net>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+func TestRunHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook is found and run from a root given relative to the
+	// working directory
+	if err = os.MkdirAll(filepath.Join("zk", "hooks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook := "#!/bin/sh\necho \"$1\" > ran\ncat >> ran\n"
+	if err = ioutil.WriteFile(filepath.Join("zk", "hooks", "post-new"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ZKRoot = "zk"
+	defer func() { cfg.ZKRoot = "" }()
+	runHook(zk.Event{Type: zk.EventNew, Note: zk.NoteMeta{Id: 7}})
+	b, err := ioutil.ReadFile(filepath.Join("zk", "ran"))
+	if err != nil {
+		t.Fatalf("hook didn't run: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "7\n{\"Version\":1,\"Type\":\"new\"") {
+		t.Fatalf("hook got %q", b)
+	}
+}
@@ -0,0 +1,136 @@
+/*************************************************************************
+ * Copyright 2017 John Floren. All rights reserved.
+ * Contact: <john@jfloren.net>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+// Structures emitted by the -json and -jsonl flags. These are part of
+// zk's interface to scripts, so don't change existing fields; bump
+// jsonVersion if an incompatible change is ever unavoidable.
+// Notes are always represented as zk.NoteMeta, exactly as they appear
+// in each note's metadata file.
+
+const jsonVersion = 1
+
+var (
+	jsonOutput  = flag.Bool("json", false, "Emit JSON output")
+	jsonlOutput = flag.Bool("jsonl", false, "Emit JSON output, one object per line for commands returning lists")
+)
+
+// jsonShow is emitted by show and by changing notes.
+type jsonShow struct {
+	Version  int
+	Note     zk.NoteMeta
+	Subnotes []zk.NoteMeta
+}
+
+// jsonNote is emitted by new and by orphans in -jsonl mode.
+type jsonNote struct {
+	Version int
+	Note    zk.NoteMeta
+}
+
+// jsonNotes is emitted by orphans.
+type jsonNotes struct {
+	Version int
+	Notes   []zk.NoteMeta
+}
+
+// jsonBody is emitted by print.
+type jsonBody struct {
+	Version int
+	Note    zk.NoteMeta
+	Body    string
+}
+
+// jsonFiles is emitted by listfiles and addfile.
+type jsonFiles struct {
+	Version int
+	Note    zk.NoteMeta
+	Files   []string
+}
+
+// jsonTree is emitted by tree. Children is empty for a note which appears
+// above itself in the tree.
+type jsonTree struct {
+	Version  int `json:",omitempty"`
+	Note     zk.NoteMeta
+	Children []jsonTree
+}
+
+// jsonTreeLine is emitted by tree in -jsonl mode, one per note, in the
+// same order as the plain-text tree.
+type jsonTreeLine struct {
+	Version int
+	Depth   int
+	Note    zk.NoteMeta
+}
+
+// jsonGrepResult is a single match from grep or tgrep; in -jsonl mode
+// each one is printed on its own line.
+type jsonGrepResult struct {
+	Version int `json:",omitempty"`
+	Note    zk.NoteMeta
+	File    string `json:",omitempty"`
+	Line    string
+	Error   string `json:",omitempty"`
+}
+
+// jsonGrep is emitted by grep and tgrep.
+type jsonGrep struct {
+	Version int
+	Results []jsonGrepResult
+}
+
+// jsonAlias is a single alias; in -jsonl mode each one is printed on its
+// own line.
+type jsonAlias struct {
+	Version int `json:",omitempty"`
+	Name    string
+	Note    zk.NoteMeta
+}
+
+// jsonAliases is emitted by aliases.
+type jsonAliases struct {
+	Version int
+	Aliases []jsonAlias
+}
+
+// jsonWatchEvent is a change seen by watch; each one is printed on its
+// own line in either mode.
+type jsonWatchEvent struct {
+	Version int
+	Op      string
+	Note    zk.NoteMeta
+	Error   string `json:",omitempty"`
+}
+
+func jsonMode() bool {
+	return *jsonOutput || *jsonlOutput
+}
+
+func emitJSON(v interface{}) {
+	if err := json.NewEncoder(os.Stdout).Encode(v); err != nil {
+		fatalf("couldn't encode JSON: %v", err)
+	}
+}
+
+func newJSONGrepResult(r *zk.GrepResult) jsonGrepResult {
+	res := jsonGrepResult{Note: r.Note, File: r.File, Line: r.Line}
+	if r.Error != nil {
+		res.Error = r.Error.Error()
+	}
+	return res
+}
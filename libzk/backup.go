@@ -0,0 +1,277 @@
+package zk
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupManifest lists the contents of a backup. It's the last entry
+// in the archive, named by ManifestName.
+type BackupManifest struct {
+	Version int
+	Created time.Time
+	Notes   int
+	Files   []BackupFile
+}
+
+// A BackupFile is a file in a backup, with its size and SHA-256 sum.
+type BackupFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// ManifestName is the name of the manifest within a backup.
+const ManifestName = "MANIFEST.json"
+
+const backupVersion = 1
+
+// Backup writes a snapshot of the whole zk, as a gzipped tar file, to
+// w: the state, every note's body, metadata and attachments, and
+// anything else kept in the zk's directory, followed by a manifest of
+// the files and their checksums. The state and metadata are written
+// from memory, so they always agree with each other. Programs sharing
+// the ZK between goroutines should hold their lock while it runs.
+func (z *ZK) Backup(w io.Writer) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest := BackupManifest{Version: backupVersion, Created: time.Now().UTC(), Notes: len(z.state.Notes)}
+	now := time.Now()
+
+	add := func(name string, mode os.FileMode, r io.Reader) error {
+		// Buffer it, so the header has the right size even if the
+		// file is being written to
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: int64(mode.Perm()), Size: int64(len(b)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		manifest.Files = append(manifest.Files, BackupFile{name, int64(len(b)), hex.EncodeToString(sum[:])})
+		return nil
+	}
+	addJSON := func(name string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return add(name, 0644, strings.NewReader(string(b)+"\n"))
+	}
+
+	err = filepath.Walk(z.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(z.root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if isTempFile(name) {
+			return nil
+		}
+		if fi.IsDir() {
+			return tw.WriteHeader(&tar.Header{Name: name + "/", Mode: int64(fi.Mode().Perm()), ModTime: now, Typeflag: tar.TypeDir})
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if name == "state" {
+			return addJSON(name, z.state)
+		}
+		if dir, file := path.Split(name); file == "metadata" {
+			if id, err := strconv.Atoi(strings.TrimSuffix(dir, "/")); err == nil {
+				if md, ok := z.state.Notes[id]; ok {
+					return addJSON(name, md)
+				}
+			}
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return add(name, fi.Mode(), f)
+	})
+	if err != nil {
+		return err
+	}
+	if err := addJSON(ManifestName, manifest); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// isTempFile reports whether name, a slash-separated path within the
+// zk, is the lock or one of the files the zk writes and then renames
+// into place. Attachments are never skipped, whatever they're called.
+func isTempFile(name string) bool {
+	switch name {
+	case lockName, "state.tmp", "undo.tmp", "imports.tmp":
+		return true
+	}
+	dir, file := path.Split(name)
+	return dir == "sync/" && strings.HasSuffix(file, ".tmp")
+}
+
+// VerifyBackup reads a backup made by Backup, checking every file
+// against the manifest, and returns the manifest.
+func VerifyBackup(r io.Reader) (BackupManifest, error) {
+	return readBackup(r, "")
+}
+
+// Restore unpacks a backup made by Backup into a new zk at dir, which
+// must not exist or be empty. The whole backup is checked before
+// anything appears at dir, so a damaged or incomplete backup leaves
+// nothing behind.
+func Restore(r io.Reader, dir string) (BackupManifest, error) {
+	if contents, err := ioutil.ReadDir(dir); err == nil && len(contents) > 0 {
+		return BackupManifest{}, fmt.Errorf("%v already contains files", dir)
+	}
+	// Unpack next to dir, so it can be renamed into place
+	if err := os.MkdirAll(filepath.Dir(filepath.Clean(dir)), 0755); err != nil {
+		return BackupManifest{}, err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(filepath.Clean(dir)), ".zk-restore")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	manifest, err := readBackup(r, tmp)
+	if err != nil {
+		return manifest, err
+	}
+	if _, err := NewZK(tmp); err != nil {
+		return manifest, fmt.Errorf("restored zk is unusable: %v", err)
+	}
+	os.Remove(dir)
+	return manifest, os.Rename(tmp, dir)
+}
+
+// readBackup reads and checks a backup, unpacking it into dir unless
+// that's empty.
+func readBackup(r io.Reader, dir string) (manifest BackupManifest, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, fmt.Errorf("not a zk backup: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	found := make(map[string]BackupFile)
+	var haveManifest bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, fmt.Errorf("damaged backup: %v", err)
+		}
+		name := hdr.Name
+		clean := path.Clean(name)
+		if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return manifest, fmt.Errorf("bad file name %q in backup", name)
+		}
+		if haveManifest {
+			return manifest, fmt.Errorf("%v follows the manifest", name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(clean))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if dir != "" {
+				if err := os.MkdirAll(target, 0700|os.FileMode(hdr.Mode).Perm()); err != nil {
+					return manifest, err
+				}
+			}
+			continue
+		case tar.TypeReg:
+		default:
+			return manifest, fmt.Errorf("unexpected %v in backup", name)
+		}
+
+		if clean == ManifestName {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("bad manifest: %v", err)
+			}
+			haveManifest = true
+			continue
+		}
+		var w io.Writer = ioutil.Discard
+		var f *os.File
+		if dir != "" {
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return manifest, err
+			}
+			if f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return manifest, err
+			}
+			w = f
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, h), tr)
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("damaged backup: %v", err)
+		}
+		found[clean] = BackupFile{clean, n, hex.EncodeToString(h.Sum(nil))}
+	}
+	// Reading to the end checks the gzip checksum
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return manifest, fmt.Errorf("damaged backup: %v", err)
+	}
+
+	if !haveManifest {
+		return manifest, fmt.Errorf("backup has no manifest; it may be incomplete")
+	}
+	if manifest.Version > backupVersion {
+		return manifest, fmt.Errorf("backup version %d is newer than this zk understands", manifest.Version)
+	}
+	var problems []string
+	for _, want := range manifest.Files {
+		got, ok := found[want.Name]
+		if !ok {
+			problems = append(problems, want.Name+" is missing")
+		} else if got != want {
+			problems = append(problems, want.Name+" is damaged")
+		}
+		delete(found, want.Name)
+	}
+	for name := range found {
+		problems = append(problems, name+" isn't in the manifest")
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return manifest, fmt.Errorf("backup failed verification: %v", strings.Join(problems, ", "))
+	}
+	return manifest, nil
+}
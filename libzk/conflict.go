@@ -0,0 +1,403 @@
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Two copies of a zk can end up with different versions of the same
+// note's body. SyncWith keeps one and puts the other in a conflict
+// copy beneath it; Syncthing keeps one and leaves the other beside it
+// as a body.sync-conflict-... file; git leaves both in the body between
+// conflict markers. A note's base file, if it has one, holds the last
+// version of the body both copies agreed on. SyncWith writes it when it
+// makes a conflict copy, and keeps it up to date afterwards; Resolve
+// writes it when a conflict is resolved, so that with Syncthing or git
+// it travels to the other copy along with the note. A note without one
+// falls back on the common ancestor git keeps during a merge.
+// MergeConflict merges the versions of a body line by line against the
+// base, and Resolve puts the result in place.
+
+const (
+	baseName          = "base"
+	syncthingConflict = "body.sync-conflict-"
+	conflictSuffix    = " (conflict copy)"
+)
+
+// ErrConflictMarkers is returned by Resolve for a body which still has
+// conflict markers.
+var ErrConflictMarkers = errors.New("conflict markers remain")
+
+// maxMergeCells limits the work of comparing the changed lines of two
+// texts; beyond it, all the changed lines are taken to differ.
+const maxMergeCells = 1 << 20
+
+// A Conflict is a note with more than one version of its body.
+type Conflict struct {
+	Id int
+	// Copies are the ids of conflict copies of the note made by
+	// SyncWith.
+	Copies []int
+	// Files are the names of other versions of the body left beside
+	// it by Syncthing.
+	Files []string
+	// Markers is set if the body has conflict markers in it, as git
+	// leaves.
+	Markers bool
+}
+
+// Conflicts returns the notes with unresolved conflicts, by id.
+func (z *ZK) Conflicts() ([]Conflict, error) {
+	found := make(map[int]*Conflict)
+	get := func(id int) *Conflict {
+		if found[id] == nil {
+			found[id] = &Conflict{Id: id}
+		}
+		return found[id]
+	}
+	ids := z.syncIds()
+	for id, md := range z.state.Notes {
+		if md.Conflict != "" {
+			if orig, ok := ids[md.Conflict]; ok && orig != id {
+				c := get(orig)
+				c.Copies = append(c.Copies, id)
+			}
+		}
+		p := filepath.Join(z.root, fmt.Sprintf("%d", id))
+		fis, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if strings.HasPrefix(fi.Name(), syncthingConflict) {
+				c := get(id)
+				c.Files = append(c.Files, fi.Name())
+			}
+		}
+		b, err := ioutil.ReadFile(filepath.Join(p, "body"))
+		if err != nil {
+			return nil, err
+		}
+		if hasConflictMarkers(string(b)) {
+			get(id).Markers = true
+		}
+	}
+	var ret []Conflict
+	for _, c := range found {
+		sort.Ints(c.Copies)
+		sort.Strings(c.Files)
+		ret = append(ret, *c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id < ret[j].Id })
+	return ret, nil
+}
+
+// conflict returns the conflict involving the note, which may be the
+// note in conflict or one of its conflict copies.
+func (z *ZK) conflict(id int) (Conflict, error) {
+	if _, ok := z.state.Notes[id]; !ok {
+		return Conflict{}, fmt.Errorf("Note %d not found", id)
+	}
+	conflicts, err := z.Conflicts()
+	if err != nil {
+		return Conflict{}, err
+	}
+	for _, c := range conflicts {
+		if c.Id == id {
+			return c, nil
+		}
+		for _, cp := range c.Copies {
+			if cp == id {
+				return c, nil
+			}
+		}
+	}
+	return Conflict{}, fmt.Errorf("Note %d has no conflicts", id)
+}
+
+// MergeConflict merges the versions of the body of a note in conflict
+// against the note's base, as MergeText does. The note may also be
+// given by one of its conflict copies. If the note has no base file but
+// the zk is a git checkout in the middle of a merge, git's common
+// ancestor of the body is the base instead. Failing both, the versions
+// are merged against an empty base, which is no better than a two-way
+// merge: every difference between them is a conflict. The result has
+// conflict markers where the versions can't be reconciled, in which
+// case clean is false. If the body already has conflict markers, it's
+// taken to be the result of an earlier merge, and returned as it is.
+func (z *ZK) MergeConflict(id int) (merged string, clean bool, err error) {
+	c, err := z.conflict(id)
+	if err != nil {
+		return "", false, err
+	}
+	note, err := z.GetNote(c.Id)
+	if err != nil {
+		return "", false, err
+	}
+	p := filepath.Join(z.root, fmt.Sprintf("%d", c.Id))
+	base, err := ioutil.ReadFile(filepath.Join(p, baseName))
+	if os.IsNotExist(err) {
+		base, err = z.gitBase(c.Id), nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if c.Markers {
+		return note.Body, false, nil
+	}
+	merged, clean = note.Body, true
+	ours := fmt.Sprintf("note %d", c.Id)
+	for _, cp := range c.Copies {
+		other, err := z.GetNote(cp)
+		if err != nil {
+			return "", false, err
+		}
+		var ok bool
+		merged, ok = MergeText(string(base), merged, unconflictBody(other.Body), ours, fmt.Sprintf("conflict copy %d", cp))
+		clean = clean && ok
+	}
+	for _, name := range c.Files {
+		other, err := ioutil.ReadFile(filepath.Join(p, name))
+		if err != nil {
+			return "", false, err
+		}
+		var ok bool
+		merged, ok = MergeText(string(base), merged, string(other), ours, name)
+		clean = clean && ok
+	}
+	return merged, clean, nil
+}
+
+// Resolve settles a conflict by making body the body of the note in
+// conflict and its new base. The note may also be given by one of its
+// conflict copies. The conflict copies are unlinked, leaving them
+// orphans, and Syncthing's versions of the body are removed. If body
+// still has conflict markers, it's saved as the note's body but the
+// conflict is left as it was, and ErrConflictMarkers is returned.
+func (z *ZK) Resolve(id int, body string) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	c, err := z.conflict(id)
+	if err != nil {
+		return err
+	}
+	if err := z.UpdateNote(c.Id, body); err != nil {
+		return err
+	}
+	if hasConflictMarkers(body) {
+		return ErrConflictMarkers
+	}
+	if err := z.writeBase(c.Id, body); err != nil {
+		return err
+	}
+	for _, cp := range c.Copies {
+		if err := z.UnlinkNote(c.Id, cp); err != nil {
+			return err
+		}
+		md := z.state.Notes[cp]
+		md.Conflict = ""
+		z.state.Notes[cp] = md
+		if err := z.writeNoteMetadata(md); err != nil {
+			return err
+		}
+	}
+	p := filepath.Join(z.root, fmt.Sprintf("%d", c.Id))
+	for _, name := range c.Files {
+		if err := os.Remove(filepath.Join(p, name)); err != nil {
+			return err
+		}
+	}
+	return z.writeState()
+}
+
+// gitBase returns the common ancestor git recorded for a note's body
+// when a merge left it in conflict, or nil if there isn't one or git
+// can't be run.
+func (z *ZK) gitBase(id int) []byte {
+	cmd := exec.Command("git", "show", fmt.Sprintf(":1:./%d/body", id))
+	cmd.Dir = z.root
+	b, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// writeBase records body as the last version of a note's body both
+// copies of the zk agreed on.
+func (z *ZK) writeBase(id int, body string) error {
+	p := filepath.Join(z.root, fmt.Sprintf("%d", id), baseName)
+	return ioutil.WriteFile(p, []byte(body), 0600)
+}
+
+// MergeText merges two versions of a text, ours and theirs, both made
+// from base, line by line. Lines changed in only one version are taken
+// from it. Where the versions changed the same lines differently, both
+// are kept between conflict markers, as git does:
+//
+//	<<<<<<< ours
+//	our lines
+//	=======
+//	their lines
+//	>>>>>>> theirs
+//
+// with ours and theirs replaced by the labels. MergeText reports
+// whether the merge was clean, without conflicts.
+func MergeText(base, ours, theirs, oursLabel, theirsLabel string) (merged string, clean bool) {
+	b, o, t := splitLines(base), splitLines(ours), splitLines(theirs)
+	mo, mt := matchLines(b, o), matchLines(b, t)
+	var out []string
+	clean = true
+	i, j, k := 0, 0, 0
+	for {
+		// The lines up to the next base line both versions kept are
+		// either unchanged, changed on one side, or in conflict
+		n := i
+		for n < len(b) && (mo[n] < 0 || mt[n] < 0) {
+			n++
+		}
+		oe, te := len(o), len(t)
+		if n < len(b) {
+			oe, te = mo[n], mt[n]
+		}
+		bc, oc, tc := b[i:n], o[j:oe], t[k:te]
+		switch {
+		case sameLines(oc, bc):
+			out = append(out, tc...)
+		case sameLines(tc, bc), sameLines(oc, tc):
+			out = append(out, oc...)
+		default:
+			clean = false
+			out = append(out, "<<<<<<< "+oursLabel+"\n")
+			out = appendLines(out, oc)
+			out = append(out, "=======\n")
+			out = appendLines(out, tc)
+			out = append(out, ">>>>>>> "+theirsLabel+"\n")
+		}
+		if n == len(b) {
+			break
+		}
+		out = append(out, b[n])
+		i, j, k = n+1, mo[n]+1, mt[n]+1
+	}
+	return strings.Join(out, ""), clean
+}
+
+// splitLines splits s into lines, keeping their newlines.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// appendLines appends lines to out, making sure the last ends in a
+// newline so a conflict marker can follow it.
+func appendLines(out, lines []string) []string {
+	out = append(out, lines...)
+	if n := len(out); n > 0 && !strings.HasSuffix(out[n-1], "\n") {
+		out[n-1] += "\n"
+	}
+	return out
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLines pairs the lines of a with the lines of b in a longest
+// common subsequence, returning for each line of a the index of its
+// partner in b, or -1 if it has none.
+func matchLines(a, b []string) []int {
+	m := make([]int, len(a))
+	for i := range m {
+		m[i] = -1
+	}
+	// Most edits leave the start and end alone
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		m[pre] = pre
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		m[len(a)-1-suf] = len(b) - 1 - suf
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if len(a)*len(b) > maxMergeCells {
+		return m
+	}
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			m[pre+i] = pre + j
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return m
+}
+
+// hasConflictMarkers reports whether body has a complete set of
+// conflict markers.
+func hasConflictMarkers(body string) bool {
+	var start, mid bool
+	for _, line := range strings.Split(body, "\n") {
+		switch {
+		case strings.HasPrefix(line, "<<<<<<<"):
+			start = true
+		case start && line == "=======":
+			mid = true
+		case mid && strings.HasPrefix(line, ">>>>>>>"):
+			return true
+		}
+	}
+	return false
+}
+
+// unconflictBody undoes conflictBody.
+func unconflictBody(body string) string {
+	parts := strings.SplitN(body, "\n", 2)
+	parts[0] = strings.TrimSuffix(parts[0], conflictSuffix)
+	return strings.Join(parts, "\n")
+}
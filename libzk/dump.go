@@ -0,0 +1,419 @@
+package zk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A dump is a zk written as JSON lines, independent of the layout of
+// the zk's directory: first a header line, {"zk": DumpHeader}, then a
+// line for each note in order of id, {"note": DumpNote}.
+const dumpVersion = 1
+
+// A DumpHeader holds the parts of a dump which aren't notes.
+type DumpHeader struct {
+	Version    int
+	NextNoteId int
+	Aliases    map[string]int
+	UniqueIds  bool `json:",omitempty"`
+}
+
+// A DumpNote is a note in a dump: its metadata, its body and the
+// contents of its files.
+type DumpNote struct {
+	NoteMeta
+	Body        string
+	Attachments []DumpFile `json:",omitempty"`
+}
+
+// A DumpFile is a file attached to a note. Its contents are either in
+// Data, which is base64 in the JSON, or in the file at Path, relative
+// to a directory kept alongside the dump.
+type DumpFile struct {
+	Name string
+	Data []byte `json:",omitempty"`
+	Path string `json:",omitempty"`
+}
+
+type dumpLine struct {
+	Header *DumpHeader `json:"zk,omitempty"`
+	Note   *DumpNote   `json:"note,omitempty"`
+}
+
+// Dump writes the whole zk to w. If fileDir is empty, attached files
+// are included in the dump; otherwise they're copied into fileDir, as
+// fileDir/<id>/<name>, and the dump refers to them.
+func (z *ZK) Dump(w io.Writer, fileDir string) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(dumpLine{Header: &DumpHeader{dumpVersion, z.state.NextNoteId, z.state.Aliases, z.state.UniqueIds}}); err != nil {
+		return err
+	}
+	var ids []int
+	for id := range z.state.Notes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		note, err := z.GetNote(id)
+		if err != nil {
+			return err
+		}
+		dn := DumpNote{NoteMeta: note.NoteMeta, Body: note.Body}
+		for _, name := range note.Files {
+			p, err := z.getFilePath(id, name)
+			if err != nil {
+				return err
+			}
+			f := DumpFile{Name: name}
+			if fileDir == "" {
+				if f.Data, err = ioutil.ReadFile(p); err != nil {
+					return err
+				}
+			} else {
+				f.Path = filepath.ToSlash(filepath.Join(strconv.Itoa(id), name))
+				if err := copyFile(p, filepath.Join(fileDir, f.Path)); err != nil {
+					return err
+				}
+			}
+			dn.Attachments = append(dn.Attachments, f)
+		}
+		if err := enc.Encode(dumpLine{Note: &dn}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readDump reads a whole dump and checks that its files can be found
+// in fileDir, so that nothing is loaded from a broken one.
+func readDump(r io.Reader, fileDir string) (hdr DumpHeader, notes []DumpNote, err error) {
+	dec := json.NewDecoder(r)
+	seen := make(map[int]bool)
+	for n := 1; ; n++ {
+		var l dumpLine
+		if err = dec.Decode(&l); err == io.EOF {
+			break
+		} else if err != nil {
+			return hdr, nil, fmt.Errorf("dump entry %d: %v", n, err)
+		}
+		switch {
+		case n == 1 && l.Header != nil:
+			hdr = *l.Header
+			if hdr.Version > dumpVersion {
+				return hdr, nil, fmt.Errorf("dump version %d is newer than this zk understands", hdr.Version)
+			}
+		case n == 1:
+			return hdr, nil, fmt.Errorf("not a zk dump: no header")
+		case l.Note != nil:
+			if seen[l.Note.Id] {
+				return hdr, nil, fmt.Errorf("dump entry %d: note %d appears twice", n, l.Note.Id)
+			}
+			seen[l.Note.Id] = true
+			for _, f := range l.Note.Attachments {
+				if f.Name == "" || f.Name != filepath.Base(f.Name) || f.Name == "." || f.Name == ".." {
+					return hdr, nil, fmt.Errorf("note %d: bad file name %q", l.Note.Id, f.Name)
+				}
+				if f.Path != "" {
+					if _, err := os.Stat(dumpFilePath(fileDir, f.Path)); err != nil {
+						return hdr, nil, fmt.Errorf("note %d: can't find %v in %q", l.Note.Id, f.Path, fileDir)
+					}
+				}
+			}
+			notes = append(notes, *l.Note)
+		default:
+			return hdr, nil, fmt.Errorf("dump entry %d: neither a header nor a note", n)
+		}
+	}
+	if len(notes) == 0 && hdr.Version == 0 {
+		return hdr, nil, fmt.Errorf("not a zk dump: no header")
+	}
+	return hdr, notes, nil
+}
+
+func dumpFilePath(fileDir, p string) string {
+	p = filepath.FromSlash(p)
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(fileDir, p)
+}
+
+// Load reads a dump written by Dump into the zk, keeping the ids,
+// aliases and tree of the original. The zk must be empty: nothing
+// but an unchanged top-level note, which the dump's replaces. Files
+// referred to by the dump are found relative to fileDir.
+func (z *ZK) Load(r io.Reader, fileDir string) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !z.Empty() {
+		return fmt.Errorf("zk already has notes; load the dump under a note instead")
+	}
+	hdr, notes, err := readDump(r, fileDir)
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if err := z.loadNote(n, fileDir); err != nil {
+			return err
+		}
+		if n.Id >= z.state.NextNoteId {
+			z.state.NextNoteId = n.Id + 1
+		}
+	}
+	if hdr.NextNoteId > z.state.NextNoteId {
+		z.state.NextNoteId = hdr.NextNoteId
+	}
+	var names []string
+	for name, id := range hdr.Aliases {
+		z.state.Aliases[name] = id
+		names = append(names, name)
+	}
+	z.state.UniqueIds = hdr.UniqueIds
+	if err := z.writeState(); err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		id := hdr.Aliases[name]
+		z.notify(Event{Type: EventAlias, Note: z.state.Notes[id], Alias: name})
+	}
+	return nil
+}
+
+// Empty reports whether the zk is as InitZK left it.
+func (z *ZK) Empty() bool {
+	top := z.state.Notes[0]
+	return len(z.state.Notes) == 1 && len(top.Subnotes) == 0 && len(top.Files) == 0 && len(z.state.Aliases) == 0
+}
+
+// LoadUnder reads a dump written by Dump into the zk beneath the note
+// parent, giving each note a new id. The dump's top-level note, and
+// any note whose parent isn't in the dump, becomes a subnote of
+// parent. References between the notes are changed to the new ids.
+// An alias which is already in use is renamed, and references to it
+// changed to match, as are unique ids already in use. LoadUnder
+// returns the new id of each note in the dump and the new names of the
+// renamed aliases.
+func (z *ZK) LoadUnder(r io.Reader, parent int, fileDir string) (ids map[int]int, renamed map[string]string, err error) {
+	var unlock func()
+	if unlock, err = z.lock(); err != nil {
+		return
+	}
+	defer unlock()
+	if _, ok := z.state.Notes[parent]; !ok {
+		return nil, nil, fmt.Errorf("Note %d not found", parent)
+	}
+	hdr, notes, err := readDump(r, fileDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return z.loadUnder(notes, hdr.Aliases, parent, fileDir)
+}
+
+// loadUnder does the work of LoadUnder and Merge.
+func (z *ZK) loadUnder(notes []DumpNote, aliases map[string]int, parent int, fileDir string) (ids map[int]int, renamed map[string]string, err error) {
+	ids = make(map[int]int)
+	for _, n := range notes {
+		ids[n.Id] = z.newNoteId()
+	}
+
+	// Find new names for the aliases first, so references to them
+	// can be rewritten
+	renamed = make(map[string]string)
+	var names []string
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		id, ok := ids[aliases[name]]
+		if !ok {
+			continue
+		}
+		newName := name
+		for i := 2; ; i++ {
+			if _, taken := z.state.Aliases[newName]; !taken {
+				break
+			}
+			newName = fmt.Sprintf("%s-%d", name, i)
+		}
+		if newName != name {
+			renamed[name] = newName
+		}
+		z.state.Aliases[newName] = id
+	}
+
+	// Unique ids must stay unique. References are rewritten through
+	// the same map as aliases, but only renamed aliases are reported.
+	targets := make(map[string]string)
+	for name, newName := range renamed {
+		targets[name] = newName
+	}
+	uids := make(map[string]bool)
+	for _, md := range z.state.Notes {
+		if md.UID != "" {
+			uids[md.UID] = true
+		}
+	}
+	for i, n := range notes {
+		if n.UID == "" && z.state.UniqueIds {
+			notes[i].UID = NewUID()
+		} else if n.UID != "" && uids[n.UID] {
+			notes[i].UID = NewUID()
+			targets[n.UID] = notes[i].UID
+		}
+		if notes[i].UID != "" {
+			uids[notes[i].UID] = true
+		}
+	}
+
+	var roots []int
+	for _, n := range notes {
+		orig := n.Id
+		n.Id = ids[orig]
+		if p, ok := ids[n.Parent]; ok && n.Parent != orig {
+			n.Parent = p
+		} else {
+			n.Parent = parent
+			roots = append(roots, n.Id)
+		}
+		n.Subnotes = remapIds(n.Subnotes, ids)
+		if n.Search != nil {
+			s := *n.Search
+			if id, ok := ids[s.Root]; ok {
+				s.Root = id
+			}
+			n.Search = &s
+		}
+		n.Body = remapReferences(n.Body, ids, targets)
+		if err := z.loadNote(n, fileDir); err != nil {
+			return ids, renamed, err
+		}
+	}
+	for _, id := range roots {
+		if err := z.LinkNote(parent, id); err != nil {
+			return ids, renamed, err
+		}
+	}
+	if err := z.writeState(); err != nil {
+		return ids, renamed, err
+	}
+	for _, name := range names {
+		id, ok := ids[aliases[name]]
+		if !ok {
+			continue
+		}
+		newName := name
+		if r, ok := renamed[name]; ok {
+			newName = r
+		}
+		z.notify(Event{Type: EventAlias, Note: z.state.Notes[id], Alias: newName})
+	}
+	return ids, renamed, nil
+}
+
+// remapIds returns the ids which are in the map, mapped.
+func remapIds(old []int, ids map[int]int) []int {
+	var ret []int
+	for _, id := range old {
+		if n, ok := ids[id]; ok {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// remapReferences rewrites references in body to note ids, and to
+// aliases and unique ids, through the maps. Other references are left
+// alone.
+func remapReferences(body string, ids map[int]int, aliases map[string]string) string {
+	return rewriteReferences(body, func(target string) (string, bool) {
+		if t, ok := aliases[target]; ok {
+			return t, true
+		}
+		if t, ok := aliases[strings.ToUpper(target)]; ok && isUID(target) {
+			return t, true
+		}
+		old, err := strconv.Atoi(target)
+		if id, ok := ids[old]; ok && err == nil {
+			return strconv.Itoa(id), true
+		}
+		return "", false
+	})
+}
+
+// rewriteReferences replaces the targets of the references in body for
+// which f returns true, keeping their labels.
+func rewriteReferences(body string, f func(target string) (string, bool)) string {
+	var b strings.Builder
+	last := 0
+	for _, r := range ParseReferences(body) {
+		target, ok := f(r.Target)
+		if !ok {
+			continue
+		}
+		b.WriteString(body[last:r.Start])
+		if r.Label != "" {
+			fmt.Fprintf(&b, "[[%s|%s]]", target, r.Label)
+		} else {
+			fmt.Fprintf(&b, "[[%s]]", target)
+		}
+		last = r.End
+	}
+	b.WriteString(body[last:])
+	return b.String()
+}
+
+// loadNote writes a note from a dump to disk and into the state,
+// replacing any note with its id.
+func (z *ZK) loadNote(n DumpNote, fileDir string) error {
+	p := filepath.Join(z.root, fmt.Sprintf("%d", n.Id))
+	files := filepath.Join(p, "files")
+	if err := os.MkdirAll(files, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(p, "body"), []byte(n.Body), 0700); err != nil {
+		return err
+	}
+	meta := n.NoteMeta
+	meta.Title = strings.SplitN(n.Body, "\n", 2)[0]
+	meta.Files = nil
+	for _, f := range n.Attachments {
+		dst := filepath.Join(files, f.Name)
+		var err error
+		if f.Path != "" {
+			err = copyFile(dumpFilePath(fileDir, f.Path), dst)
+		} else {
+			err = ioutil.WriteFile(dst, f.Data, 0600)
+		}
+		if err != nil {
+			return err
+		}
+		meta.Files = append(meta.Files, f.Name)
+	}
+	if err := z.writeNoteMetadata(meta); err != nil {
+		return err
+	}
+	typ := EventNew
+	if _, ok := z.state.Notes[meta.Id]; ok {
+		typ = EventUpdate
+	}
+	z.state.Notes[meta.Id] = meta
+	z.notify(Event{Type: typ, Note: meta})
+	for _, name := range meta.Files {
+		z.notify(Event{Type: EventAddFile, Note: meta, File: name})
+	}
+	return nil
+}
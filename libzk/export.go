@@ -0,0 +1,461 @@
+package zk
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/floren/zk/libzk/internal/markdown"
+)
+
+// Formats for Export
+const (
+	ExportMarkdown = "md"
+	ExportHTML     = "html"
+	ExportOrg      = "org"
+)
+
+// Export writes the note root and the tree of notes below it to the
+// directory dest, which must be empty or not yet exist. The format is
+// ExportMarkdown, for a directory of Markdown files, or ExportHTML, for
+// a static web site. ExportOrg instead writes the notes to a single
+// org-mode file named dest, as WriteOrg does; the file must not yet
+// exist.
+//
+// Each note becomes a file named after its title. Its attachments and
+// the notes below it go in a directory of the same name, alongside the
+// file, so the directories mirror the tree. A note linked in several
+// places is written once, at the shallowest place it appears, and
+// linked to from the others. References between exported notes become
+// relative links, and an index page at the top lists the whole tree.
+func (z *ZK) Export(root int, format string, dest string) error {
+	if format != ExportMarkdown && format != ExportHTML && format != ExportOrg {
+		return fmt.Errorf("Unknown export format %q", format)
+	}
+	if _, ok := z.state.Notes[root]; !ok {
+		return fmt.Errorf("Note %d not found", root)
+	}
+	if format == ExportOrg {
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return fmt.Errorf("%v already exists", dest)
+		} else if err != nil {
+			return err
+		}
+		if err := z.WriteOrg(root, f); err != nil {
+			f.Close()
+			os.Remove(dest)
+			return err
+		}
+		return f.Close()
+	}
+	if contents, err := ioutil.ReadDir(dest); err == nil && len(contents) > 0 {
+		return fmt.Errorf("%v already contains files", dest)
+	}
+	e := &exporter{
+		z:      z,
+		format: format,
+		dest:   dest,
+		places: make(map[int]*exportPlace),
+		used:   make(map[string]map[string]bool),
+	}
+	e.take("", "index")
+	if err := e.plan(root); err != nil {
+		return err
+	}
+	for _, id := range e.order {
+		if err := e.writeNote(id); err != nil {
+			return err
+		}
+	}
+	return e.writeIndex(root)
+}
+
+// SafeFileName makes a note title usable as a file name, replacing
+// characters which aren't allowed in file names on common systems.
+func SafeFileName(title string) string {
+	title = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '-'
+		}
+		return r
+	}, title)
+	title = strings.Trim(title, " .")
+	if r := []rune(title); len(r) > 100 {
+		title = strings.TrimSpace(string(r[:100]))
+	}
+	if title == "" {
+		title = "Untitled"
+	}
+	return title
+}
+
+// An exportPlace is where a note is written. Paths are relative to the
+// destination and slash-separated.
+type exportPlace struct {
+	id       int
+	parent   int // the note it's written beneath, or -1 at the top
+	file     string
+	dir      string // holds its attachments and children
+	children []int  // the notes written beneath it
+}
+
+type exporter struct {
+	z      *ZK
+	format string
+	dest   string
+	places map[int]*exportPlace
+	order  []int
+	// The names taken in each directory, lower-cased in case the
+	// file system ignores case
+	used map[string]map[string]bool
+}
+
+// plan decides where every note goes, breadth first so that notes with
+// several parents end up as high in the tree as they can.
+func (e *exporter) plan(root int) error {
+	e.place(root, -1)
+	for i := 0; i < len(e.order); i++ {
+		p := e.places[e.order[i]]
+		// Attachments keep their names, so claim them first
+		for _, f := range e.z.state.Notes[p.id].Files {
+			e.take(p.dir, f)
+		}
+		subnotes, err := e.z.GetSubnotes(p.id)
+		if err != nil {
+			return err
+		}
+		for _, sn := range subnotes {
+			if _, ok := e.places[sn]; ok {
+				continue
+			}
+			if _, ok := e.z.state.Notes[sn]; !ok {
+				continue
+			}
+			e.place(sn, p.id)
+			p.children = append(p.children, sn)
+		}
+	}
+	return nil
+}
+
+// place gives a note a file named after its title, beneath parent.
+func (e *exporter) place(id, parent int) {
+	dir := ""
+	if parent >= 0 {
+		dir = e.places[parent].dir
+	}
+	name := SafeFileName(e.z.state.Notes[id].Title)
+	if e.taken(dir, name) {
+		name = fmt.Sprintf("%s (%d)", name, id)
+	}
+	e.take(dir, name)
+	p := path.Join(dir, name)
+	e.places[id] = &exportPlace{id: id, parent: parent, file: p + "." + e.format, dir: p}
+	e.order = append(e.order, id)
+}
+
+// take claims a name in a directory, along with the page which would
+// go with it.
+func (e *exporter) take(dir, name string) {
+	if e.used[dir] == nil {
+		e.used[dir] = make(map[string]bool)
+	}
+	e.used[dir][strings.ToLower(name)] = true
+	e.used[dir][strings.ToLower(name+"."+e.format)] = true
+}
+
+func (e *exporter) taken(dir, name string) bool {
+	return e.used[dir][strings.ToLower(name)] || e.used[dir][strings.ToLower(name+"."+e.format)]
+}
+
+// link returns a relative link from the page at file to target.
+func link(file, target string) string {
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(file)), filepath.FromSlash(target))
+	if err != nil {
+		rel = target
+	}
+	return (&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath()
+}
+
+// An exportLink is a link on a page to a note or file.
+type exportLink struct {
+	Title string
+	Href  string
+}
+
+func (e *exporter) writeNote(id int) error {
+	note, err := e.z.GetNote(id)
+	if err != nil {
+		return err
+	}
+	p := e.places[id]
+
+	var files []exportLink
+	for _, f := range note.Files {
+		src, err := e.z.getFilePath(id, f)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(p.dir, f)
+		if err := copyFile(src, filepath.Join(e.dest, filepath.FromSlash(dst))); err != nil {
+			return err
+		}
+		files = append(files, exportLink{f, link(p.file, dst)})
+	}
+
+	// Every sub-note is listed, wherever it was written
+	var subnotes []exportLink
+	ids, err := e.z.GetSubnotes(id)
+	if err != nil {
+		return err
+	}
+	for _, sn := range ids {
+		if sp, ok := e.places[sn]; ok {
+			subnotes = append(subnotes, exportLink{e.z.state.Notes[sn].Title, link(p.file, sp.file)})
+		}
+	}
+
+	body := e.rewriteLinks(note, p)
+	var out string
+	if e.format == ExportMarkdown {
+		out = markdownPage(body, subnotes, files)
+	} else {
+		page := htmlPage{
+			Title:    note.Title,
+			Index:    link(p.file, "index.html"),
+			Subnotes: subnotes,
+			Files:    files,
+		}
+		if p.parent >= 0 {
+			page.Up = &exportLink{e.z.state.Notes[p.parent].Title, link(p.file, e.places[p.parent].file)}
+		}
+		// The title is the heading, so leave it out of the body
+		if i := strings.IndexByte(body, '\n'); i >= 0 {
+			body = body[i+1:]
+		} else {
+			body = ""
+		}
+		page.Body = template.HTML(markdown.Render(body, nil))
+		if out, err = executeTemplate("note", page); err != nil {
+			return err
+		}
+	}
+	return e.writeFile(p.file, out)
+}
+
+var mdLinkRe = regexp.MustCompile(`(\]\()([^)\s]+)(\))`)
+
+// rewriteLinks points links to the note's attachments at their copies,
+// and turns references to other notes into links to their pages.
+func (e *exporter) rewriteLinks(note Note, p *exportPlace) string {
+	files := make(map[string]bool)
+	for _, f := range note.Files {
+		files[f] = true
+	}
+	body := mdLinkRe.ReplaceAllStringFunc(note.Body, func(m string) string {
+		sm := mdLinkRe.FindStringSubmatch(m)
+		target, err := url.PathUnescape(sm[2])
+		if err != nil || !files[target] {
+			return m
+		}
+		return sm[1] + link(p.file, path.Join(p.dir, target)) + sm[3]
+	})
+
+	refs := ParseReferences(body)
+	var b strings.Builder
+	last := 0
+	for _, r := range refs {
+		b.WriteString(body[last:r.Start])
+		last = r.End
+		id, err := e.z.ResolveReference(r)
+		if err != nil {
+			// Leave broken references alone
+			b.WriteString(body[r.Start:r.End])
+			continue
+		}
+		label := r.Label
+		if label == "" {
+			label = e.z.state.Notes[id].Title
+		}
+		if tp, ok := e.places[id]; ok {
+			fmt.Fprintf(&b, "[%s](%s)", linkText(label, e.format), link(p.file, tp.file))
+		} else {
+			// Not exported, so there's nothing to link to
+			b.WriteString(label)
+		}
+	}
+	b.WriteString(body[last:])
+	return b.String()
+}
+
+// linkText makes a label safe to put inside the brackets of a
+// Markdown link. The HTML renderer doesn't understand escapes, so
+// brackets become parentheses there.
+func linkText(label, format string) string {
+	if format == ExportHTML {
+		return strings.NewReplacer("[", "(", "]", ")").Replace(label)
+	}
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(label)
+}
+
+// markdownPage makes the first line of a note's body a heading, if it
+// isn't already, and lists its sub-notes and files at the end.
+func markdownPage(body string, subnotes, files []exportLink) string {
+	if !strings.HasPrefix(body, "#") {
+		body = "# " + body
+	}
+	body = strings.TrimRight(body, "\n") + "\n"
+	list := func(heading string, links []exportLink) {
+		if len(links) == 0 {
+			return
+		}
+		body += "\n## " + heading + "\n\n"
+		for _, l := range links {
+			body += fmt.Sprintf("- [%s](%s)\n", linkText(l.Title, ExportMarkdown), l.Href)
+		}
+	}
+	list("Sub-notes", subnotes)
+	list("Files", files)
+	return body
+}
+
+// An exportTree is the index page's view of the exported notes.
+type exportTree struct {
+	exportLink
+	Children []exportTree
+}
+
+func (e *exporter) tree(id int) exportTree {
+	p := e.places[id]
+	t := exportTree{exportLink: exportLink{e.z.state.Notes[id].Title, link("index", p.file)}}
+	for _, c := range p.children {
+		t.Children = append(t.Children, e.tree(c))
+	}
+	return t
+}
+
+func (e *exporter) writeIndex(root int) error {
+	t := e.tree(root)
+	var out string
+	if e.format == ExportMarkdown {
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s\n\n", t.Title)
+		var list func(t exportTree, depth int)
+		list = func(t exportTree, depth int) {
+			fmt.Fprintf(&b, "%s- [%s](%s)\n", strings.Repeat("  ", depth), linkText(t.Title, ExportMarkdown), t.Href)
+			for _, c := range t.Children {
+				list(c, depth+1)
+			}
+		}
+		list(t, 0)
+		out = b.String()
+	} else {
+		var err error
+		if out, err = executeTemplate("index", t); err != nil {
+			return err
+		}
+	}
+	return e.writeFile("index."+e.format, out)
+}
+
+func (e *exporter) writeFile(name, contents string) error {
+	p := filepath.Join(e.dest, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, []byte(contents), 0644)
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// htmlPage is a note's page in an HTML export.
+type htmlPage struct {
+	Title    string
+	Index    string
+	Up       *exportLink
+	Body     template.HTML
+	Subnotes []exportLink
+	Files    []exportLink
+}
+
+func executeTemplate(name string, data interface{}) (string, error) {
+	var b strings.Builder
+	err := exportTemplates.ExecuteTemplate(&b, name, data)
+	return b.String(), err
+}
+
+var exportTemplates = template.Must(template.New("").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+<style>
+body { max-width: 50em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; }
+nav { font-size: small; }
+pre { background: #f4f4f4; padding: 0.5em; overflow: auto; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "note"}}{{template "head" .Title}}<nav><a href="{{.Index}}">Index</a>{{with .Up}} · Up: <a href="{{.Href}}">{{.Title}}</a>{{end}}</nav>
+<h1>{{.Title}}</h1>
+{{.Body}}
+{{- if .Subnotes}}
+<h2>Sub-notes</h2>
+<ul>
+{{range .Subnotes}}<li><a href="{{.Href}}">{{.Title}}</a></li>
+{{end}}</ul>
+{{- end}}
+{{- if .Files}}
+<h2>Files</h2>
+<ul>
+{{range .Files}}<li><a href="{{.Href}}">{{.Title}}</a></li>
+{{end}}</ul>
+{{- end}}
+</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "head" .Title}}<h1>{{.Title}}</h1>
+<ul>
+{{template "tree" .}}</ul>
+</body>
+</html>
+{{end}}
+
+{{define "tree"}}<li><a href="{{.Href}}">{{.Title}}</a>
+{{- if .Children}}
+<ul>
+{{range .Children}}{{template "tree" .}}{{end}}</ul>
+{{- end}}</li>
+{{end}}
+`))
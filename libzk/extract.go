@@ -0,0 +1,83 @@
+package zk
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// An Extractor converts the contents of an attached file into plain
+// text, which can then be searched line-by-line. Register extractors
+// for new file formats with RegisterExtractor.
+type Extractor interface {
+	Extract(r io.Reader) (io.Reader, error)
+}
+
+// ExtractorFunc allows an ordinary function to be used as an Extractor.
+type ExtractorFunc func(r io.Reader) (io.Reader, error)
+
+// Extract calls f(r).
+func (f ExtractorFunc) Extract(r io.Reader) (io.Reader, error) {
+	return f(r)
+}
+
+// PlainText is the Extractor used for files which are already text;
+// it simply hands back the original reader.
+var PlainText Extractor = ExtractorFunc(func(r io.Reader) (io.Reader, error) {
+	return r, nil
+})
+
+var (
+	extractorLock sync.RWMutex
+	extractors    = map[string]Extractor{}
+)
+
+func init() {
+	for _, ext := range []string{
+		".txt", ".text", ".md", ".markdown", ".org", ".rst",
+		".csv", ".tsv", ".json", ".xml", ".yaml", ".yml", ".toml", ".ini", ".conf",
+		".eml", ".mbox", ".log", ".html", ".htm",
+		".go", ".c", ".h", ".cpp", ".hpp", ".py", ".rb", ".js", ".ts", ".java",
+		".rs", ".sh", ".pl", ".lua", ".sql",
+	} {
+		extractors[ext] = PlainText
+	}
+}
+
+// RegisterExtractor installs an Extractor for attached files whose names
+// end in the given extension, e.g. ".odt". Extensions are matched without
+// regard to case. Registering a nil Extractor removes any existing one.
+func RegisterExtractor(ext string, e Extractor) {
+	extractorLock.Lock()
+	defer extractorLock.Unlock()
+	ext = strings.ToLower(ext)
+	if e == nil {
+		delete(extractors, ext)
+		return
+	}
+	extractors[ext] = e
+}
+
+// extractText returns a reader of plain text for the named file, or nil
+// if the file does not appear to contain text and no extractor has been
+// registered for its extension.
+func extractText(name string, r io.Reader) (io.Reader, error) {
+	extractorLock.RLock()
+	e, ok := extractors[strings.ToLower(filepath.Ext(name))]
+	extractorLock.RUnlock()
+	if ok {
+		return e.Extract(r)
+	}
+
+	// We don't know the extension; sniff the beginning of the file
+	// and only search it if it looks like text.
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(512)
+	if !strings.HasPrefix(http.DetectContentType(head), "text/") {
+		return nil, nil
+	}
+	return br, nil
+}
@@ -0,0 +1,435 @@
+package zk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ImportMarkdown imports a folder of Markdown files, such as an
+// Obsidian vault, beneath the note parent. It returns the ids of the
+// notes it created.
+//
+// Every .md file becomes a note, titled by its first line if that's a
+// level one heading, and otherwise by its file name. Every folder
+// becomes a note too, with the folder's contents as sub-notes; if the
+// folder holds an index.md, README.md or a file named after the folder,
+// that file is the folder's note. Hidden files and folders are skipped.
+//
+// [[wikilinks]] and relative links to other files in the folder become
+// zk references, and images and other files they link to are attached
+// to the linking note. The imported files are remembered, so running
+// the import again only brings in files which are new since last time.
+func (z *ZK) ImportMarkdown(dir string, parent int) ([]int, error) {
+	unlock, err := z.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if _, ok := z.state.Notes[parent]; !ok {
+		return nil, fmt.Errorf("Note %d not found", parent)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dir)
+	}
+	imported, err := z.readImports()
+	if err != nil {
+		return nil, err
+	}
+	im := &mdImport{
+		z:        z,
+		dir:      dir,
+		imported: imported,
+		notes:    make(map[string]int),
+		names:    make(map[string][]string),
+		hasNotes: make(map[string]bool),
+		sources:  make(map[int]string),
+	}
+	if err := im.index(); err != nil {
+		return nil, err
+	}
+	err = im.walk(dir, parent)
+	// Remember whatever was created, even if something went wrong
+	if werr := z.writeImports(im.imported); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return im.created, err
+	}
+	for _, id := range im.created {
+		if src, ok := im.sources[id]; ok {
+			if err := im.convert(id, src); err != nil {
+				return im.created, err
+			}
+		}
+	}
+	return im.created, nil
+}
+
+type mdImport struct {
+	z   *ZK
+	dir string
+	// imported maps the sources of every import into this zk to the
+	// notes made from them
+	imported map[string]int
+	// notes maps the Markdown files and folders of this import to
+	// their notes
+	notes map[string]int
+	// names maps lower-cased base names, without .md, to the files in
+	// the folder, for resolving wikilinks
+	names map[string][]string
+	// hasNotes is set for the folders with Markdown files somewhere
+	// below them; the rest, such as folders of images, aren't notes
+	hasNotes map[string]bool
+	sources  map[int]string // the file each new note came from
+	created  []int
+}
+
+// index finds every file in the folder, skipping hidden ones.
+func (im *mdImport) index() error {
+	return filepath.Walk(im.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != im.dir && strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		base := strings.ToLower(strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name())))
+		im.names[base] = append(im.names[base], p)
+		if isMarkdown(p) {
+			for d := filepath.Dir(p); im.within(d) && !im.hasNotes[d]; d = filepath.Dir(d) {
+				im.hasNotes[d] = true
+			}
+		}
+		return nil
+	})
+}
+
+// walk imports the contents of a folder beneath the note parent.
+func (im *mdImport) walk(dir string, parent int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	skip := ""
+	if dir != im.dir {
+		skip = folderNote(dir)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			if !im.hasNotes[p] {
+				continue
+			}
+			id, err := im.note(p, parent, folderNote(p))
+			if err != nil {
+				return err
+			}
+			if err := im.walk(p, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if isMarkdown(p) && p != skip {
+			if _, err := im.note(p, parent, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// note finds or creates the note for a file or folder. src is the
+// Markdown file holding the note's text, if any.
+func (im *mdImport) note(key string, parent int, src string) (int, error) {
+	id, ok := im.imported[key]
+	if _, exists := im.z.state.Notes[id]; !ok || !exists {
+		body := filepath.Base(key) + "\n"
+		if src != "" {
+			b, err := ioutil.ReadFile(src)
+			if err != nil {
+				return 0, err
+			}
+			// A folder's note is named after the folder, not its
+			// index file, unless it has a heading
+			name := filepath.Base(key)
+			if src == key {
+				name = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+			body = markdownBody(name, string(b))
+		}
+		var err error
+		if id, err = im.z.NewNote(parent, body); err != nil {
+			return 0, err
+		}
+		im.imported[key] = id
+		im.created = append(im.created, id)
+		if src != "" {
+			im.sources[id] = src
+		}
+	}
+	im.notes[key] = id
+	if src != "" {
+		im.notes[src] = id
+	}
+	return id, nil
+}
+
+// folderNote returns the file within a folder which holds the folder's
+// own text, or "" if there isn't one.
+func folderNote(dir string) string {
+	for _, name := range []string{"index.md", "README.md", filepath.Base(dir) + ".md"} {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+func isMarkdown(p string) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// markdownBody turns a Markdown file into a note body, whose first line
+// is the title. A leading level one heading becomes the title;
+// otherwise the title is the given name. YAML front matter is kept,
+// after the title.
+func markdownBody(name, text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	front := ""
+	if strings.HasPrefix(text, "---\n") {
+		if i := strings.Index(text[3:], "\n---\n"); i >= 0 {
+			front, text = text[:i+8], text[i+8:]
+		}
+	}
+	rest := strings.TrimLeft(text, "\n")
+	if strings.HasPrefix(rest, "# ") {
+		line := rest
+		rest = ""
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line, rest = line[:i], line[i+1:]
+		}
+		return strings.TrimSpace(line[2:]) + "\n" + front + rest
+	}
+	return name + "\n\n" + front + rest
+}
+
+// importLinkRe matches [[wikilinks]], optionally embedded with a !,
+// and Markdown links and images.
+var importLinkRe = regexp.MustCompile(`(!?)(?:\[\[([^\[\]|\n]+)(?:\|([^\[\]\n]*))?\]\]|\[([^\]\n]*)\]\(([^)\n]+)\))`)
+
+// convert rewrites the links in a new note's body, attaching the files
+// they point to.
+func (im *mdImport) convert(id int, src string) error {
+	note, err := im.z.GetNote(id)
+	if err != nil {
+		return err
+	}
+	from := filepath.Dir(src)
+	attached := make(map[string]string) // source path to attachment name
+	var ferr error
+	attach := func(p string) string {
+		if name, ok := attached[p]; ok {
+			return name
+		}
+		name := im.attachmentName(id, filepath.Base(p))
+		if err := im.z.AddFile(id, p, name); err != nil && ferr == nil {
+			ferr = err
+		}
+		attached[p] = name
+		return name
+	}
+
+	body := importLinkRe.ReplaceAllStringFunc(note.Body, func(m string) string {
+		sm := importLinkRe.FindStringSubmatch(m)
+		embed := sm[1] == "!"
+		var p, label string
+		if sm[2] != "" {
+			target := strings.TrimSpace(sm[2])
+			if i := strings.IndexByte(target, '#'); i >= 0 {
+				target = target[:i]
+			}
+			if target != "" {
+				p = im.resolveWiki(target, from)
+			}
+			label = strings.TrimSpace(sm[3])
+		} else {
+			p = im.resolveLink(strings.TrimSpace(sm[5]), from)
+			label = sm[4]
+		}
+		if p == "" {
+			return m
+		}
+		if nid, ok := im.notes[p]; ok {
+			return im.z.reference(nid, label)
+		}
+		if isMarkdown(p) {
+			// Hidden, so not imported
+			return m
+		}
+		name := attach(p)
+		if label == "" && sm[2] != "" {
+			label = name
+		}
+		link := "[" + label + "](" + escapeLink(name) + ")"
+		if embed {
+			link = "!" + link
+		}
+		return link
+	})
+	if ferr != nil {
+		return ferr
+	}
+	if body == note.Body {
+		return nil
+	}
+	return im.z.UpdateNote(id, body)
+}
+
+// resolveWiki finds the file a wikilink names: a path relative to the
+// linking file or the top of the folder, or failing that any file in
+// the folder with that name. Notes may leave off the .md.
+func (im *mdImport) resolveWiki(target, from string) string {
+	target = filepath.FromSlash(target)
+	for _, dir := range []string{from, im.dir} {
+		for _, p := range []string{filepath.Join(dir, target), filepath.Join(dir, target+".md")} {
+			if im.within(p) && isFile(p) {
+				return p
+			}
+		}
+	}
+	base := strings.ToLower(filepath.Base(target))
+	candidates := im.names[strings.TrimSuffix(base, ".md")]
+	if ext := filepath.Ext(base); ext != "" && !isMarkdown(base) {
+		candidates = im.names[strings.TrimSuffix(base, ext)]
+	}
+	sort.Strings(candidates)
+	for _, p := range candidates {
+		if strings.ToLower(filepath.Base(p)) == base || strings.ToLower(filepath.Base(p)) == base+".md" {
+			return p
+		}
+	}
+	return ""
+}
+
+// resolveLink finds the file a relative Markdown link points to, or ""
+// if it isn't a relative link to a file within the folder.
+func (im *mdImport) resolveLink(target, from string) string {
+	if strings.HasPrefix(target, "<") {
+		if i := strings.IndexByte(target, '>'); i > 0 {
+			target = target[1:i]
+		}
+	} else if i := strings.IndexAny(target, " \t"); i >= 0 {
+		// Obsidian allows spaces in paths, but otherwise it's a title
+		if p := im.resolveLink("<"+target+">", from); p != "" {
+			return p
+		}
+		target = target[:i]
+	}
+	if i := strings.IndexByte(target, '#'); i >= 0 {
+		target = target[:i]
+	}
+	if target == "" || strings.HasPrefix(target, "/") || strings.Contains(target, ":") {
+		return ""
+	}
+	if t, err := url.PathUnescape(target); err == nil {
+		target = t
+	}
+	p := filepath.Join(from, filepath.FromSlash(target))
+	if im.within(p) && isFile(p) {
+		return p
+	}
+	return ""
+}
+
+func (im *mdImport) within(p string) bool {
+	rel, err := filepath.Rel(im.dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func isFile(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && !fi.IsDir()
+}
+
+// attachmentName picks a name for a new attachment which doesn't clash
+// with the note's existing files.
+func (im *mdImport) attachmentName(id int, name string) string {
+	taken := make(map[string]bool)
+	for _, f := range im.z.state.Notes[id].Files {
+		taken[f] = true
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return name
+}
+
+// reference returns a zk reference to a note.
+func (z *ZK) reference(id int, label string) string {
+	if label = strings.NewReplacer("[", "(", "]", ")", "|", "/").Replace(label); label != "" {
+		return fmt.Sprintf("[[%s|%s]]", z.RefTarget(id), label)
+	}
+	return fmt.Sprintf("[[%s]]", z.RefTarget(id))
+}
+
+func escapeLink(name string) string {
+	return (&url.URL{Path: name}).EscapedPath()
+}
+
+func (z *ZK) importsPath() string {
+	return filepath.Join(z.root, "imports")
+}
+
+// readImports returns the mapping from imported files to the notes made
+// from them.
+func (z *ZK) readImports() (map[string]int, error) {
+	imported := make(map[string]int)
+	b, err := ioutil.ReadFile(z.importsPath())
+	if os.IsNotExist(err) {
+		return imported, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &imported); err != nil {
+		return nil, fmt.Errorf("failed to parse imports file: %v", err)
+	}
+	return imported, nil
+}
+
+func (z *ZK) writeImports(imported map[string]int) error {
+	b, err := json.MarshalIndent(imported, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := z.importsPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, z.importsPath())
+}
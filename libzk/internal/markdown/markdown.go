@@ -0,0 +1,158 @@
+// Package markdown renders the Markdown found in notes as HTML. It's
+// shared by the web interface and the HTML export.
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Render renders the common subset of Markdown found in notes:
+// headings, paragraphs, lists, block quotes, code blocks, rules, and
+// inline code, emphasis, links and images. Everything else is treated
+// as text, and all text is escaped, so the output is always safe.
+//
+// resolve rewrites link and image targets; it is used to point relative
+// links at the note's attachments.
+func Render(src string, resolve func(string) string) string {
+	var out strings.Builder
+	lines := strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n")
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + inline(strings.Join(para, "\n"), resolve) + "</p>\n")
+			para = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t"):
+			if len(para) > 0 {
+				// A continuation of the paragraph, not code
+				para = append(para, trimmed)
+				continue
+			}
+			var code []string
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.HasPrefix(lines[i], "\t") || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "    "))
+			}
+			i--
+			out.WriteString("<pre><code>" + html.EscapeString(strings.TrimRight(strings.Join(code, "\n"), "\n")) + "</code></pre>\n")
+		case headingRe.MatchString(trimmed):
+			flush()
+			m := headingRe.FindStringSubmatch(trimmed)
+			n := string('0' + rune(len(m[1])))
+			out.WriteString("<h" + n + ">" + inline(strings.TrimRight(m[2], " #"), resolve) + "</h" + n + ">\n")
+		case ruleRe.MatchString(trimmed):
+			flush()
+			out.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(q, " "))
+			}
+			i--
+			out.WriteString("<blockquote>\n" + Render(strings.Join(quote, "\n"), resolve) + "</blockquote>\n")
+		case bulletRe.MatchString(line) || orderedRe.MatchString(line):
+			flush()
+			re, tag := bulletRe, "ul"
+			if orderedRe.MatchString(line) {
+				re, tag = orderedRe, "ol"
+			}
+			out.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && re.MatchString(lines[i]); i++ {
+				item := re.ReplaceAllString(lines[i], "")
+				// Indented lines belong to the item
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" &&
+					(strings.HasPrefix(lines[i+1], "  ") || strings.HasPrefix(lines[i+1], "\t")) &&
+					!re.MatchString(lines[i+1]) {
+					i++
+					item += "\n" + strings.TrimSpace(lines[i])
+				}
+				out.WriteString("<li>" + inline(item, resolve) + "</li>\n")
+			}
+			i--
+			out.WriteString("</" + tag + ">\n")
+		default:
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+	return out.String()
+}
+
+var (
+	headingRe = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	ruleRe    = regexp.MustCompile(`^((\*\s*){3,}|(-\s*){3,}|(_\s*){3,})$`)
+	bulletRe  = regexp.MustCompile(`^\s{0,3}[-*+]\s+`)
+	orderedRe = regexp.MustCompile(`^\s{0,3}\d+[.)]\s+`)
+
+	codeRe   = regexp.MustCompile("`([^`]+)`")
+	imageRe  = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	linkRe   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	autoRe   = regexp.MustCompile(`&lt;(https?://[^\s&]+)&gt;`)
+	strongRe = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	emRe     = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+)
+
+// inline renders the inline elements of a span of text. Code spans are
+// pulled out first so nothing inside them is interpreted.
+func inline(s string, resolve func(string) string) string {
+	var codes []string
+	s = codeRe.ReplaceAllStringFunc(s, func(m string) string {
+		codes = append(codes, "<code>"+html.EscapeString(codeRe.FindStringSubmatch(m)[1])+"</code>")
+		return "\x00"
+	})
+	s = html.EscapeString(s)
+
+	s = imageRe.ReplaceAllStringFunc(s, func(m string) string {
+		sm := imageRe.FindStringSubmatch(m)
+		return `<img alt="` + sm[1] + `" src="` + safeURL(sm[2], resolve) + `">`
+	})
+	s = linkRe.ReplaceAllStringFunc(s, func(m string) string {
+		sm := linkRe.FindStringSubmatch(m)
+		return `<a href="` + safeURL(sm[2], resolve) + `">` + sm[1] + `</a>`
+	})
+	s = autoRe.ReplaceAllString(s, `<a href="$1">$1</a>`)
+	s = strongRe.ReplaceAllString(s, "<strong>$1$2</strong>")
+	s = emRe.ReplaceAllString(s, "<em>$1$2</em>")
+	s = strings.Replace(s, "\n", "<br>\n", -1)
+
+	for _, c := range codes {
+		s = strings.Replace(s, "\x00", c, 1)
+	}
+	return s
+}
+
+// safeURL resolves an (already escaped) link target, refusing anything
+// which could run script.
+func safeURL(u string, resolve func(string) string) string {
+	raw := html.UnescapeString(u)
+	lower := strings.ToLower(strings.TrimSpace(raw))
+	if i := strings.Index(lower, ":"); i >= 0 && !strings.ContainsAny(lower[:i], "/?#") {
+		scheme := lower[:i]
+		if scheme != "http" && scheme != "https" && scheme != "mailto" {
+			return "#"
+		}
+		return html.EscapeString(raw)
+	}
+	if resolve != nil {
+		raw = resolve(raw)
+	}
+	return html.EscapeString(raw)
+}
@@ -0,0 +1,25 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdown(t *testing.T) {
+	src := "# Title\n\nSome *emphasis*, **strong** and `<code>`.\n\n- one\n- [two](pic.png)\n\n```\nx < y\n```\n<script>alert(1)</script> [bad](javascript:alert(1))\n"
+	got := Render(src, func(u string) string { return "/file/1/" + u })
+	for _, want := range []string{
+		"<h1>Title</h1>",
+		"<em>emphasis</em>",
+		"<strong>strong</strong>",
+		"<code>&lt;code&gt;</code>",
+		"<ul>\n<li>one</li>\n<li><a href=\"/file/1/pic.png\">two</a></li>\n</ul>",
+		"<pre><code>x &lt; y</code></pre>",
+		"&lt;script&gt;",
+		"<a href=\"#\">bad</a>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Rendered markdown missing %q:\n%s", want, got)
+		}
+	}
+}
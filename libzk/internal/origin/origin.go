@@ -0,0 +1,41 @@
+// Package origin protects the web interface and the JSON API from
+// cross-site request forgery: a page on another site making the
+// user's browser send a request which changes the zk. It's shared by
+// zkweb and zkhttp.
+package origin
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Same reports whether r was sent by a page from the same origin as
+// the server, or by something other than a browser. Browsers say where
+// a request came from with Sec-Fetch-Site, or failing that Origin;
+// requests with neither, such as those made by curl or zk sync, are
+// allowed.
+func Same(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return true
+	}
+	u, err := url.Parse(o)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// Safe reports whether a request's method only reads, so it needs no
+// protection.
+func Safe(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package origin
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSame(t *testing.T) {
+	tests := []struct {
+		site, origin string
+		same         bool
+	}{
+		{"", "", true},
+		{"same-origin", "", true},
+		{"none", "", true},
+		{"cross-site", "", false},
+		{"same-site", "http://other.example.com:8080", false},
+		{"", "http://zk.example.com:8080", true},
+		{"", "http://evil.example.com", false},
+		{"", "null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "http://zk.example.com:8080/note/1", nil)
+		if tt.site != "" {
+			r.Header.Set("Sec-Fetch-Site", tt.site)
+		}
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := Same(r); got != tt.same {
+			t.Errorf("Sec-Fetch-Site %q, Origin %q: got %v, want %v", tt.site, tt.origin, got, tt.same)
+		}
+	}
+}
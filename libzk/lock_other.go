@@ -0,0 +1,39 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package zk
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockTimeout is how long lockFile waits before deciding the lock was
+// left behind by a process which died.
+const lockTimeout = 10 * time.Second
+
+// lockFile takes an exclusive lock on the file at p by creating it,
+// waiting for any other process holding it.
+func lockFile(p string) (*os.File, error) {
+	start := time.Now()
+	for {
+		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if time.Since(start) > lockTimeout {
+			return nil, fmt.Errorf("zk is locked by %v; remove it if no other program is using the zk", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	f.Close()
+	return os.Remove(f.Name())
+}
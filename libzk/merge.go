@@ -0,0 +1,71 @@
+package zk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Merge copies every note in other into the zk beneath the note parent,
+// giving each a new id. Other's top-level note becomes a subnote of
+// parent, with the rest of other's tree below it as before. Subnotes,
+// parents and references between the notes are changed to the new ids.
+// An alias which is already in use is renamed, by adding a number, and
+// references to it changed to match. Merge returns the new id of each
+// of other's notes and the new names of the renamed aliases. Other is
+// left as it was.
+func (z *ZK) Merge(other *ZK, parent int) (ids map[int]int, renamed map[string]string, err error) {
+	var unlock func()
+	if unlock, err = z.lock(); err != nil {
+		return
+	}
+	defer unlock()
+	if _, ok := z.state.Notes[parent]; !ok {
+		return nil, nil, fmt.Errorf("Note %d not found", parent)
+	}
+	if same(z.root, other.root) {
+		return nil, nil, fmt.Errorf("can't merge a zk into itself")
+	}
+
+	// Gather all of other's notes before changing anything, so a
+	// broken note doesn't leave half a merge behind
+	var otherIds []int
+	for id := range other.state.Notes {
+		otherIds = append(otherIds, id)
+	}
+	sort.Ints(otherIds)
+	var notes []DumpNote
+	for _, id := range otherIds {
+		note, err := other.GetNote(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		dn := DumpNote{NoteMeta: note.NoteMeta, Body: note.Body}
+		for _, name := range note.Files {
+			p, err := other.getFilePath(id, name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if p, err = filepath.Abs(p); err != nil {
+				return nil, nil, err
+			}
+			dn.Attachments = append(dn.Attachments, DumpFile{Name: name, Path: p})
+		}
+		notes = append(notes, dn)
+	}
+	return z.loadUnder(notes, other.state.Aliases, parent, "")
+}
+
+// same reports whether two paths are the same directory.
+func same(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
@@ -0,0 +1,90 @@
+package zk
+
+// EventType says what kind of change an Event describes. Most of the
+// values match the names of the zk commands which make the changes;
+// update is any replacement of a note's body, by zk edit, sed, resolve
+// and the like.
+type EventType string
+
+const (
+	EventNew        EventType = "new"
+	EventUpdate     EventType = "update"
+	EventAppend     EventType = "append"
+	EventLink       EventType = "link"
+	EventUnlink     EventType = "unlink"
+	EventAlias      EventType = "alias"
+	EventUnalias    EventType = "unalias"
+	EventAddFile    EventType = "addfile"
+	EventRemoveFile EventType = "rmfile"
+)
+
+// An Event describes a change made to a note through the ZK's methods:
+// NewNote, UpdateNote, AppendNote, LinkNote, UnlinkNote, AddAlias,
+// RemoveAlias, AddFile, ReplaceFile and RemoveFile. Load, LoadUnder,
+// Merge, SyncWith and SyncApply report the notes, links, files and
+// aliases they create or change with the same events.
+type Event struct {
+	Type EventType
+	// Note is the note's metadata after the change.
+	Note NoteMeta
+	// Parent is the note linked to or unlinked from, for link and
+	// unlink events.
+	Parent int
+	// Alias is the alias added or removed, for alias and unalias
+	// events.
+	Alias string `json:",omitempty"`
+	// File is the name of the file added or removed, for addfile and
+	// rmfile events.
+	File string `json:",omitempty"`
+}
+
+// An Observer is told of every change made to a zk it's been added to,
+// with AddObserver.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc allows an ordinary function to be used as an Observer.
+type ObserverFunc func(e Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+type observer struct {
+	id int
+	o  Observer
+}
+
+// AddObserver adds an Observer to the zk. After each successful change,
+// the observers are called in the order they were added, on the
+// goroutine which made the change, before the method making it returns.
+// Calling the returned function removes the observer.
+func (z *ZK) AddObserver(o Observer) (remove func()) {
+	z.nextObserver++
+	id := z.nextObserver
+	z.observers = append(z.observers, observer{id, o})
+	return func() {
+		for i := range z.observers {
+			if z.observers[i].id == id {
+				z.observers = append(z.observers[:i:i], z.observers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// notify tells the observers of an event. While the zk is locked, the
+// events are held until it's unlocked, so that observers which run zk
+// commands don't wait forever for the lock.
+func (z *ZK) notify(e Event) {
+	if z.locked > 0 {
+		z.pending = append(z.pending, e)
+		return
+	}
+	// Observers may add or remove observers
+	for _, o := range append([]observer(nil), z.observers...) {
+		o.o.Observe(e)
+	}
+}
@@ -0,0 +1,214 @@
+package zk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// zk has no tags or properties of its own, so org-mode tags are kept
+// on the second line of the note, as "Tags: :a:b:", and property
+// drawers are left in the body as they are. Both go back where they
+// came from on export, so converting in either direction and back
+// loses nothing.
+const orgTagsPrefix = "Tags: "
+
+var (
+	orgHeadingRe = regexp.MustCompile(`^(\*+)\s+(.*?)\s*$`)
+	orgTagsRe    = regexp.MustCompile(`^(.*?)\s*(:(?:[^\s:]+:)+)$`)
+	// Lines of text which would be read as headings are escaped
+	// with a comma, as org-mode does in source blocks
+	orgEscapedRe = regexp.MustCompile(`^,*\*+\s`)
+)
+
+// An orgNode is a heading of an org-mode file and its section.
+type orgNode struct {
+	level    int
+	title    string
+	tags     string
+	text     []string
+	children []*orgNode
+}
+
+// ImportOrg imports an org-mode file beneath the note parent, returning
+// the ids of the notes it created. The file becomes a note titled by
+// its #+TITLE line, or its name, holding the text before the first
+// heading. Each heading becomes a note below the heading above it, with
+// the heading as its title and the section's text as its body.
+func (z *ZK) ImportOrg(file string, parent int) ([]int, error) {
+	unlock, err := z.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if _, ok := z.state.Notes[parent]; !ok {
+		return nil, fmt.Errorf("Note %d not found", parent)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	root, err := parseOrg(f)
+	if err != nil {
+		return nil, err
+	}
+	if root.title == "" {
+		root.title = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+
+	var created []int
+	var add func(n *orgNode, parent int) error
+	add = func(n *orgNode, parent int) error {
+		id, err := z.NewNote(parent, n.body())
+		if err != nil {
+			return err
+		}
+		created = append(created, id)
+		for _, c := range n.children {
+			if err := add(c, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return created, add(root, parent)
+}
+
+// parseOrg reads an org-mode file into a tree. The root is the text
+// before the first heading.
+func parseOrg(r io.Reader) (*orgNode, error) {
+	root := &orgNode{}
+	stack := []*orgNode{root}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<24)
+	for s.Scan() {
+		line := s.Text()
+		cur := stack[len(stack)-1]
+		if m := orgHeadingRe.FindStringSubmatch(line); m != nil {
+			n := &orgNode{level: len(m[1]), title: m[2]}
+			if t := orgTagsRe.FindStringSubmatch(n.title); t != nil {
+				n.title, n.tags = t[1], t[2]
+			}
+			for stack[len(stack)-1].level >= n.level {
+				stack = stack[:len(stack)-1]
+			}
+			p := stack[len(stack)-1]
+			p.children = append(p.children, n)
+			stack = append(stack, n)
+			continue
+		}
+		if cur == root {
+			if v, ok := orgKeyword(line, "TITLE"); ok && root.title == "" {
+				root.title = v
+				continue
+			}
+			if v, ok := orgKeyword(line, "FILETAGS"); ok && root.tags == "" {
+				root.tags = v
+				continue
+			}
+		}
+		if orgEscapedRe.MatchString(line) {
+			line = line[1:]
+		}
+		cur.text = append(cur.text, line)
+	}
+	return root, s.Err()
+}
+
+// orgKeyword returns the value of a #+KEYWORD: line.
+func orgKeyword(line, keyword string) (string, bool) {
+	prefix := "#+" + keyword + ":"
+	if len(line) < len(prefix) || !strings.EqualFold(line[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(line[len(prefix):]), true
+}
+
+// body returns the note body for a heading.
+func (n *orgNode) body() string {
+	var b strings.Builder
+	b.WriteString(n.title + "\n")
+	if n.tags != "" {
+		b.WriteString(orgTagsPrefix + n.tags + "\n")
+	}
+	for _, l := range n.text {
+		b.WriteString(l + "\n")
+	}
+	return b.String()
+}
+
+// WriteOrg writes the note root and the notes below it to w as a single
+// org-mode file, the reverse of ImportOrg. A note linked in several
+// places is only written at the first.
+func (z *ZK) WriteOrg(root int, w io.Writer) error {
+	if _, ok := z.state.Notes[root]; !ok {
+		return fmt.Errorf("Note %d not found", root)
+	}
+	bw := bufio.NewWriter(w)
+	seen := make(map[int]bool)
+	var write func(id, level int) error
+	write = func(id, level int) error {
+		seen[id] = true
+		note, err := z.GetNote(id)
+		if err != nil {
+			return err
+		}
+		title, tags, text := splitOrgBody(note.Body)
+		if level == 0 {
+			fmt.Fprintf(bw, "#+TITLE: %s\n", title)
+			if tags != "" {
+				fmt.Fprintf(bw, "#+FILETAGS: %s\n", tags)
+			}
+		} else {
+			fmt.Fprintf(bw, "%s %s", strings.Repeat("*", level), title)
+			if tags != "" {
+				fmt.Fprintf(bw, " %s", tags)
+			}
+			bw.WriteString("\n")
+		}
+		for _, l := range text {
+			if orgEscapedRe.MatchString(l) {
+				l = "," + l
+			}
+			bw.WriteString(l + "\n")
+		}
+		subnotes, err := z.GetSubnotes(id)
+		if err != nil {
+			return err
+		}
+		for _, sn := range subnotes {
+			if seen[sn] {
+				continue
+			}
+			if _, ok := z.state.Notes[sn]; !ok {
+				continue
+			}
+			if err := write(sn, level+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write(root, 0); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// splitOrgBody splits a note body into its title, org-mode tags and the
+// lines of the rest.
+func splitOrgBody(body string) (title, tags string, text []string) {
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	title, lines = lines[0], lines[1:]
+	if len(lines) > 0 && strings.HasPrefix(lines[0], orgTagsPrefix) {
+		if t := strings.TrimPrefix(lines[0], orgTagsPrefix); orgTagsRe.MatchString(t) && !strings.ContainsAny(t, " \t") {
+			tags, lines = t, lines[1:]
+		}
+	}
+	return title, tags, lines
+}
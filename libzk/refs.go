@@ -0,0 +1,49 @@
+package zk
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A Reference is a link from a note's body to another note, written
+// [[target]] or [[target|label]], where the target is a note ID or an
+// alias.
+type Reference struct {
+	Target string
+	Label  string
+	// Start and End are the byte offsets of the whole reference,
+	// brackets included, within the body.
+	Start, End int
+}
+
+var refRe = regexp.MustCompile(`\[\[([^\[\]|\n]+)(?:\|([^\[\]\n]*))?\]\]`)
+
+// ParseReferences returns the references in a note body, in order.
+func ParseReferences(body string) []Reference {
+	var refs []Reference
+	for _, m := range refRe.FindAllStringSubmatchIndex(body, -1) {
+		r := Reference{
+			Target: strings.TrimSpace(body[m[2]:m[3]]),
+			Start:  m[0],
+			End:    m[1],
+		}
+		if m[4] >= 0 {
+			r.Label = strings.TrimSpace(body[m[4]:m[5]])
+		}
+		refs = append(refs, r)
+	}
+	return refs
+}
+
+// ResolveReference returns the ID of the note a reference points to,
+// or an error if there is no such note.
+func (z *ZK) ResolveReference(r Reference) (int, error) {
+	id, err := z.ResolveNoteId(r.Target)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := z.GetNoteMeta(id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
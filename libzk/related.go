@@ -0,0 +1,163 @@
+package zk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// A Relation is one result from Related: a note and how similar it is
+// to the note in question. Score is between 0 and 1.
+type Relation struct {
+	Note  NoteMeta
+	Score float64
+}
+
+// How much of the score comes from shared links rather than text.
+const linkWeight = 0.25
+
+// Related ranks other notes by how similar they are to the specified note
+// and returns the best n of them. Similarity is the cosine of the TF-IDF
+// vectors of the note titles and bodies, plus a bonus for sharing parents
+// or subnotes. If n <= 0, all notes with a non-zero score are returned.
+func (z *ZK) Related(id int, n int) ([]Relation, error) {
+	if _, ok := z.state.Notes[id]; !ok {
+		return nil, fmt.Errorf("Note %d not found", id)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(z.root, fmt.Sprintf("%d", id), "body"))
+	if err != nil {
+		return nil, err
+	}
+	return z.related(string(body), id, n)
+}
+
+// RelatedText is like Related, but for a body of text which is not (yet)
+// a note. This is useful for suggesting parents for a new note.
+func (z *ZK) RelatedText(body string, n int) ([]Relation, error) {
+	return z.related(body, -1, n)
+}
+
+func (z *ZK) related(body string, id int, n int) ([]Relation, error) {
+	// Tokenize every note and count how many notes contain each term
+	docs := map[int]map[string]float64{}
+	df := map[string]int{}
+	for nid := range z.state.Notes {
+		if nid == id {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(z.root, fmt.Sprintf("%d", nid), "body"))
+		if err != nil {
+			continue
+		}
+		docs[nid] = termFreqs(string(b))
+		for t := range docs[nid] {
+			df[t]++
+		}
+	}
+	target := termFreqs(body)
+	for t := range target {
+		df[t]++
+	}
+	total := float64(len(docs) + 1)
+
+	weigh := func(tf map[string]float64) map[string]float64 {
+		v := map[string]float64{}
+		for t, f := range tf {
+			v[t] = f * math.Log(total/float64(df[t]))
+		}
+		return v
+	}
+	tv := weigh(target)
+
+	var links map[int]map[int]bool
+	if id >= 0 {
+		links = z.neighbors()
+	}
+	var result []Relation
+	for nid, tf := range docs {
+		score := cosine(tv, weigh(tf))
+		if id >= 0 {
+			score = (1-linkWeight)*score + linkWeight*jaccard(links[id], links[nid])
+		}
+		if score > 0 {
+			result = append(result, Relation{Note: z.state.Notes[nid], Score: score})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score == result[j].Score {
+			return result[i].Note.Id < result[j].Note.Id
+		}
+		return result[i].Score > result[j].Score
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
+}
+
+// neighbors returns, for every note, the set of notes linked to or
+// from it.
+func (z *ZK) neighbors() map[int]map[int]bool {
+	r := map[int]map[int]bool{}
+	add := func(a, b int) {
+		if r[a] == nil {
+			r[a] = map[int]bool{}
+		}
+		r[a][b] = true
+	}
+	for pid, md := range z.state.Notes {
+		for _, sn := range md.Subnotes {
+			add(pid, sn)
+			add(sn, pid)
+		}
+	}
+	return r
+}
+
+// termFreqs splits text into lower-cased words and returns the
+// frequency of each. Very short words are ignored as noise.
+func termFreqs(text string) map[string]float64 {
+	tf := map[string]float64{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, w := range words {
+		if len(w) > 2 {
+			tf[w]++
+		}
+	}
+	return tf
+}
+
+func cosine(a, b map[string]float64) float64 {
+	var dot, na, nb float64
+	for t, x := range a {
+		dot += x * b[t]
+		na += x * x
+	}
+	for _, y := range b {
+		nb += y * y
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+func jaccard(a, b map[int]bool) float64 {
+	var both int
+	for k := range a {
+		if b[k] {
+			both++
+		}
+	}
+	union := len(a) + len(b) - both
+	if union == 0 {
+		return 0
+	}
+	return float64(both) / float64(union)
+}
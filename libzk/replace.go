@@ -0,0 +1,160 @@
+package zk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// A Replacement records the change Replace made (or would make) to a
+// single note.
+type Replacement struct {
+	Note NoteMeta
+	Old  string
+	New  string
+}
+
+// Replace rewrites every match of the regular expression pattern in the
+// bodies of the specified notes; if notes is empty, all notes are used.
+// The replacement may refer to submatches as in regexp.Expand, e.g. "$1".
+// Bodies are written with UpdateNote, so titles are kept up to date.
+//
+// If dryRun is set, nothing is changed, but the returned Replacements
+// show what would have happened. Otherwise, the original bodies are saved
+// before anything is written so the whole operation can be reversed with
+// UndoReplace; if any note cannot be written, the ones already changed
+// are restored and an error is returned. If some of those can't be
+// restored either, the error lists them, and UndoReplace can be used to
+// try again.
+func (z *ZK) Replace(pattern, replacement string, notes []int, dryRun bool) ([]Replacement, error) {
+	unlock, err := z.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(notes) == 0 {
+		for id := range z.state.Notes {
+			notes = append(notes, id)
+		}
+	} else {
+		notes = append([]int{}, notes...)
+	}
+	sort.Ints(notes)
+
+	// Figure out every change before touching anything
+	var changes []Replacement
+	seen := map[int]bool{}
+	for _, id := range notes {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		note, err := z.GetNote(id)
+		if err != nil {
+			return nil, err
+		}
+		nb := re.ReplaceAllString(note.Body, replacement)
+		if nb != note.Body {
+			changes = append(changes, Replacement{Note: note.NoteMeta, Old: note.Body, New: nb})
+		}
+	}
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	// Save the old bodies so we can undo
+	if err := z.writeUndo(changes); err != nil {
+		return nil, err
+	}
+	for i, c := range changes {
+		if err := z.UpdateNote(c.Note.Id, c.New); err != nil {
+			// Put back everything we've done so far
+			var failed []int
+			for _, done := range changes[:i] {
+				if z.UpdateNote(done.Note.Id, done.Old) != nil {
+					failed = append(failed, done.Note.Id)
+				}
+			}
+			if len(failed) > 0 {
+				// Keep the undo file, so UndoReplace can try again
+				return nil, fmt.Errorf("failed to update note %d: %v; notes %v were changed and could not be restored", c.Note.Id, err, failed)
+			}
+			os.Remove(z.undoPath())
+			return nil, fmt.Errorf("failed to update note %d, no changes made: %v", c.Note.Id, err)
+		}
+		changes[i].Note = z.state.Notes[c.Note.Id]
+	}
+	return changes, nil
+}
+
+// ErrNoUndo is returned by UndoReplace if there is nothing to undo.
+var ErrNoUndo = errors.New("no replacement to undo")
+
+// UndoReplace reverts the most recent Replace, restoring the previous
+// bodies of every note it changed. Only one level of undo is kept.
+// Notes which have been edited since the replacement are left alone
+// and listed in the returned error.
+func (z *ZK) UndoReplace() ([]Replacement, error) {
+	unlock, err := z.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	b, err := ioutil.ReadFile(z.undoPath())
+	if os.IsNotExist(err) {
+		return nil, ErrNoUndo
+	} else if err != nil {
+		return nil, err
+	}
+	var changes []Replacement
+	if err := json.Unmarshal(b, &changes); err != nil {
+		return nil, fmt.Errorf("failed to parse undo file: %v", err)
+	}
+	var undone []Replacement
+	var skipped []int
+	for _, c := range changes {
+		note, err := z.GetNote(c.Note.Id)
+		if err != nil || note.Body != c.New {
+			skipped = append(skipped, c.Note.Id)
+			continue
+		}
+		if err := z.UpdateNote(c.Note.Id, c.Old); err != nil {
+			return undone, err
+		}
+		undone = append(undone, Replacement{Note: z.state.Notes[c.Note.Id], Old: c.New, New: c.Old})
+	}
+	if err := os.Remove(z.undoPath()); err != nil {
+		return undone, err
+	}
+	if len(skipped) > 0 {
+		return undone, fmt.Errorf("notes modified since the replacement were not restored: %v", skipped)
+	}
+	return undone, nil
+}
+
+func (z *ZK) undoPath() string {
+	return filepath.Join(z.root, "undo")
+}
+
+func (z *ZK) writeUndo(changes []Replacement) error {
+	b, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it into place, so we never
+	// leave a half-written undo file behind.
+	tmp := z.undoPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, z.undoPath())
+}
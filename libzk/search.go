@@ -0,0 +1,212 @@
+package zk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A SavedSearch describes a query whose results make up the subnotes
+// of a "smart" note. The search is re-evaluated every time the smart
+// note's subnotes are requested, so the results are always current.
+type SavedSearch struct {
+	// Pattern is a regular expression matched against note bodies.
+	// An empty pattern matches every note.
+	Pattern string
+	// Files causes text-like attachments to be searched too.
+	Files bool
+	// If Tree is set, only Root and the notes beneath it are searched;
+	// otherwise every note (including orphans) is considered.
+	Tree bool
+	Root int
+	// If non-zero, only notes whose bodies were modified within
+	// the given range are included.
+	After  time.Time
+	Before time.Time
+}
+
+func (s *SavedSearch) equal(o *SavedSearch) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	return s.Pattern == o.Pattern && s.Files == o.Files && s.Tree == o.Tree && s.Root == o.Root &&
+		s.After.Equal(o.After) && s.Before.Equal(o.Before)
+}
+
+// String formats the search in the syntax accepted by ParseSearch.
+func (s SavedSearch) String() string {
+	var parts []string
+	if s.Tree {
+		parts = append(parts, fmt.Sprintf("under:%d", s.Root))
+	}
+	if s.Files {
+		parts = append(parts, "files:")
+	}
+	if !s.After.IsZero() {
+		parts = append(parts, "after:"+s.After.Format(searchDate))
+	}
+	if !s.Before.IsZero() {
+		parts = append(parts, "before:"+s.Before.Format(searchDate))
+	}
+	if s.Pattern != "" {
+		parts = append(parts, s.Pattern)
+	}
+	return strings.Join(parts, " ")
+}
+
+const searchDate = "2006-01-02"
+
+// ParseSearch builds a SavedSearch from a query string. The query is a
+// regular expression, optionally preceded by any of the following terms:
+//
+//	under:<id>         only search note <id> and its subnotes
+//	files:             also search text-like attachments
+//	after:YYYY-MM-DD   only notes modified on or after the date
+//	before:YYYY-MM-DD  only notes modified before the date
+func ParseSearch(query string) (s SavedSearch, err error) {
+	rest := strings.TrimLeftFunc(query, unicode.IsSpace)
+	for rest != "" {
+		f := rest
+		if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+			f = rest[:i]
+		}
+		switch {
+		case strings.HasPrefix(f, "under:"):
+			s.Tree = true
+			if s.Root, err = strconv.Atoi(strings.TrimPrefix(f, "under:")); err != nil {
+				return s, fmt.Errorf("bad note id in %q: %v", f, err)
+			}
+		case f == "files:":
+			s.Files = true
+		case strings.HasPrefix(f, "after:"):
+			if s.After, err = time.ParseInLocation(searchDate, strings.TrimPrefix(f, "after:"), time.Local); err != nil {
+				return s, fmt.Errorf("bad date in %q: %v", f, err)
+			}
+		case strings.HasPrefix(f, "before:"):
+			if s.Before, err = time.ParseInLocation(searchDate, strings.TrimPrefix(f, "before:"), time.Local); err != nil {
+				return s, fmt.Errorf("bad date in %q: %v", f, err)
+			}
+		default:
+			// Everything from here on is the pattern, spaces and all
+			s.Pattern = rest
+			return
+		}
+		rest = strings.TrimLeftFunc(rest[len(f):], unicode.IsSpace)
+	}
+	return
+}
+
+// NewSavedSearch creates a smart note under the given parent. The note's
+// body is the title followed by the query; its subnotes are the results
+// of the search. Returns the id of the new note.
+func (z *ZK) NewSavedSearch(parent int, title string, s SavedSearch) (int, error) {
+	unlock, err := z.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	// Make sure the search is valid before creating anything
+	if _, err := z.EvalSearch(s); err != nil {
+		return 0, err
+	}
+	id, err := z.NewNote(parent, fmt.Sprintf("%s\n\nSaved search: %s\n", title, s))
+	if err != nil {
+		return 0, err
+	}
+	meta := z.state.Notes[id]
+	meta.Search = &s
+	z.state.Notes[id] = meta
+	if err := z.writeNoteMetadata(meta); err != nil {
+		return id, err
+	}
+	return id, z.writeState()
+}
+
+// EvalSearch runs the search and returns the ids of all matching notes,
+// sorted in ascending order.
+func (z *ZK) EvalSearch(s SavedSearch) ([]int, error) {
+	var notes []int
+	if s.Tree {
+		if _, ok := z.state.Notes[s.Root]; !ok {
+			return nil, fmt.Errorf("Note %d does not exist", s.Root)
+		}
+		notes = z.subtree(s.Root)
+	} else {
+		for id := range z.state.Notes {
+			notes = append(notes, id)
+		}
+	}
+
+	// Filter by modification time before doing the expensive part
+	if !s.After.IsZero() || !s.Before.IsZero() {
+		var inRange []int
+		for _, id := range notes {
+			fi, err := os.Stat(filepath.Join(z.root, fmt.Sprintf("%d", id), "body"))
+			if err != nil {
+				continue
+			}
+			if !s.After.IsZero() && fi.ModTime().Before(s.After) {
+				continue
+			}
+			if !s.Before.IsZero() && !fi.ModTime().Before(s.Before) {
+				continue
+			}
+			inRange = append(inRange, id)
+		}
+		notes = inRange
+	}
+	if len(notes) == 0 {
+		return []int{}, nil
+	}
+
+	c, err := z.grepNotes(s.Pattern, notes, s.Files)
+	if err != nil {
+		return nil, err
+	}
+	matched := map[int]bool{}
+	for r := range c {
+		if r.Error == nil {
+			matched[r.Note.Id] = true
+		}
+	}
+	result := []int{}
+	for id := range matched {
+		result = append(result, id)
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+// GetSubnotes returns the subnotes of the given note. For ordinary notes
+// this is just the Subnotes field of the metadata; for smart notes, the
+// results of the saved search follow any explicitly-linked subnotes.
+// A smart note never appears among its own results.
+func (z *ZK) GetSubnotes(id int) ([]int, error) {
+	meta, ok := z.state.Notes[id]
+	if !ok {
+		return nil, fmt.Errorf("Note %d not found", id)
+	}
+	result := append([]int{}, meta.Subnotes...)
+	if meta.Search == nil {
+		return result, nil
+	}
+	found, err := z.EvalSearch(*meta.Search)
+	if err != nil {
+		return result, err
+	}
+	seen := map[int]bool{id: true}
+	for _, sn := range result {
+		seen[sn] = true
+	}
+	for _, sn := range found {
+		if !seen[sn] {
+			result = append(result, sn)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,890 @@
+package zk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Syncing keeps two copies of a zk in step. Notes are matched by their
+// unique ids (see EnableUniqueIds), except for the top-level notes,
+// which always match each other. Unique ids must be enabled before a
+// zk is copied: a copy made earlier gets different ones, so two zks
+// with no notes in common are refused on their first sync. Each copy
+// remembers what every note looked like at the end of its last sync
+// with the other, in the sync directory, so it can tell which side
+// changed what since then:
+//
+//   - a note only one side has is copied to the other;
+//   - a body, parent or file changed on one side is copied to the other;
+//   - links, attachments and aliases added or removed on either side
+//     are added or removed on both;
+//   - where both sides changed a body, the changes are merged line by
+//     line (see MergeText); if they can't be, the local body is kept,
+//     the other side's is put in a conflict copy beneath it, and the
+//     body at the last sync is kept as the note's base for
+//     MergeConflict.
+//
+// Numeric references in bodies, [[12]], mean different notes in each
+// copy, so they're rewritten to unique ids, [[01HV...]], in the notes
+// sent to the other side. The sender's own bodies are left alone.
+
+// ErrSyncChanged is returned by SyncApply if the zk changed after the
+// SyncState the changes were based on.
+var ErrSyncChanged = errors.New("zk changed during the sync; try again")
+
+// ErrNoUniqueIds is returned by SyncState for a zk which doesn't have
+// unique ids yet. SyncWith gives them to the zk it's called on, and to
+// a *ZK peer, but a peer served over HTTP must be given them first.
+var ErrNoUniqueIds = errors.New("zk has no unique ids to sync with; enable them first")
+
+// rootKey stands for the top-level note in place of its unique id.
+const rootKey = "0"
+
+// A SyncPeer is the other side of a sync. *ZK is a SyncPeer, for zks
+// on the same machine; zkhttp provides one for zks served over HTTP.
+type SyncPeer interface {
+	// SyncState describes every note in the peer.
+	SyncState() (SyncState, error)
+	// SyncNotes returns the full contents of the named notes.
+	SyncNotes(keys []string) ([]SyncNote, error)
+	// SyncApply changes the peer's notes, provided nothing has changed
+	// since the SyncState with the same Token, and records the result
+	// as the base for future syncs with the replica From.
+	SyncApply(c SyncChanges) error
+}
+
+// SyncState describes a zk for a sync. Notes and aliases refer to
+// notes by key: a note's unique id, or "0" for the top-level note.
+type SyncState struct {
+	Replica string
+	// Token changes whenever any note does.
+	Token   string
+	Notes   map[string]SyncMeta
+	Aliases map[string]string
+}
+
+// SyncMeta describes a note in a sync, with notes named by key and
+// the body and files by their SHA-256 sums.
+type SyncMeta struct {
+	Parent   string
+	Subnotes []string
+	// Search is a saved search, with its root in SearchRoot.
+	Search     *SavedSearch `json:",omitempty"`
+	SearchRoot string       `json:",omitempty"`
+	Conflict   string       `json:",omitempty"`
+	BodyHash   string
+	Files      map[string]string
+}
+
+// A SyncNote is a note being transferred in a sync. Data holds the
+// contents of those of its files the receiver needs.
+type SyncNote struct {
+	Key string
+	SyncMeta
+	Body string
+	// Base is set for a note in conflict, to the body at the last
+	// sync.
+	Base string            `json:",omitempty"`
+	Data map[string][]byte `json:",omitempty"`
+}
+
+// SyncChanges are the changes one side of a sync makes to the other:
+// the notes to create or change, and the aliases afterwards.
+type SyncChanges struct {
+	From    string
+	Token   string
+	Notes   []SyncNote
+	Aliases map[string]string
+}
+
+// SyncResult summarizes a sync.
+type SyncResult struct {
+	// Received and Sent count the notes changed on each side.
+	Received, Sent int
+	// Conflicts are the ids of the conflict copies made.
+	Conflicts []int
+	// Merged counts the bodies both sides changed which were merged.
+	Merged int
+}
+
+// syncBase is the state at the end of the last sync with a peer,
+// including the notes' bodies.
+type syncBase struct {
+	Notes   map[string]SyncNote
+	Aliases map[string]string
+}
+
+// SyncWith brings the zk and the peer into step, as described above.
+func (z *ZK) SyncWith(p SyncPeer) (res SyncResult, err error) {
+	var unlock func()
+	if unlock, err = z.lock(); err != nil {
+		return
+	}
+	defer unlock()
+	if o, ok := p.(*ZK); ok && same(o.root, z.root) {
+		return res, fmt.Errorf("can't sync a zk with itself")
+	}
+	if err := z.prepareSync(); err != nil {
+		return res, err
+	}
+	if o, ok := p.(*ZK); ok {
+		unlock, err := o.lock()
+		if err != nil {
+			return res, err
+		}
+		defer unlock()
+		if err := o.prepareSync(); err != nil {
+			return res, err
+		}
+	}
+	remote, err := p.SyncState()
+	if err != nil {
+		return res, err
+	}
+	if remote.Replica == z.state.ReplicaId {
+		// The two were copied from one backup, so one needs a new name
+		z.state.ReplicaId = NewUID()
+		if err := z.writeState(); err != nil {
+			return res, err
+		}
+	}
+	local, err := z.SyncState()
+	if err != nil {
+		return res, err
+	}
+	base, err := z.readSyncBase(remote.Replica)
+	if err != nil {
+		return res, err
+	}
+	if base.Notes == nil && !shareNotes(local, remote) {
+		// Most likely one was copied from the other before it had
+		// unique ids, so they were given different ones; syncing
+		// would duplicate every note
+		return res, fmt.Errorf("the zks have no notes in common; copy one from the other after enabling unique ids, or merge them instead")
+	}
+
+	// Fetch the full notes which differ, so every body and file either
+	// side needs is to hand
+	var differ []string
+	for key, r := range remote.Notes {
+		if l, ok := local.Notes[key]; !ok || !sameJSON(l, r) {
+			differ = append(differ, key)
+		}
+	}
+	for key := range local.Notes {
+		if _, ok := remote.Notes[key]; !ok {
+			differ = append(differ, key)
+		}
+	}
+	sort.Strings(differ)
+	bodies := make(map[string]string)
+	data := make(map[string][]byte)
+	fetched := make(map[string]SyncNote)
+	gather := func(notes []SyncNote, keep bool) {
+		for _, n := range notes {
+			bodies[n.BodyHash] = n.Body
+			for name, b := range n.Data {
+				data[n.Files[name]] = b
+			}
+			if keep {
+				fetched[n.Key] = n
+			}
+		}
+	}
+	var want []string
+	for _, key := range differ {
+		if _, ok := remote.Notes[key]; ok {
+			want = append(want, key)
+		}
+	}
+	rnotes, err := p.SyncNotes(want)
+	if err != nil {
+		return res, err
+	}
+	gather(rnotes, true)
+	want = want[:0]
+	for _, key := range differ {
+		if _, ok := local.Notes[key]; ok {
+			want = append(want, key)
+		}
+	}
+	lnotes, err := z.SyncNotes(want)
+	if err != nil {
+		return res, err
+	}
+	gather(lnotes, false)
+
+	// Work out what every note should be
+	final := make(map[string]SyncMeta)
+	merged := 0
+	// merge merges the two sides' bodies of a note into f, if they
+	// merge cleanly
+	merge := func(base string, f *SyncMeta, r SyncMeta) bool {
+		body, clean := MergeText(base, bodies[f.BodyHash], bodies[r.BodyHash], "local", "remote")
+		if !clean {
+			return false
+		}
+		bodies[hashString(body)] = body
+		f.BodyHash = hashString(body)
+		merged++
+		return true
+	}
+	var conflicts []string
+	inConflict := make(map[string]string)
+	for _, key := range differ {
+		l, lok := local.Notes[key]
+		r, rok := remote.Notes[key]
+		if !lok {
+			final[key] = r
+			continue
+		}
+		if !rok {
+			final[key] = l
+			continue
+		}
+		b, bok := base.Notes[key]
+		f := l
+		switch {
+		case l.BodyHash == r.BodyHash:
+		case bok && l.BodyHash == b.BodyHash:
+			f.BodyHash = r.BodyHash
+		case bok && r.BodyHash == b.BodyHash:
+		case bok && merge(b.Body, &f, r):
+		default:
+			// Both changed: keep ours, and file theirs beneath it
+			c := NewUID()
+			body := conflictBody(fetched[key].Body)
+			bodies[hashString(body)] = body
+			final[c] = SyncMeta{Parent: key, Subnotes: []string{}, Conflict: key, BodyHash: hashString(body), Files: map[string]string{}}
+			conflicts = append(conflicts, c)
+			r.Subnotes = append(r.Subnotes, c)
+			l.Subnotes = append(l.Subnotes, c)
+			if bok {
+				inConflict[key] = b.Body
+			}
+		}
+		f.Parent = pick(l.Parent, r.Parent, b.Parent, bok)
+		f.Subnotes = mergeSet(l.Subnotes, r.Subnotes, b.Subnotes, bok)
+		f.Conflict = pick(l.Conflict, r.Conflict, b.Conflict, bok)
+		ls, rs, bs := searchJSON(l), searchJSON(r), searchJSON(b.SyncMeta)
+		if pick(ls, rs, bs, bok) != ls {
+			f.Search, f.SearchRoot = r.Search, r.SearchRoot
+		}
+		f.Files = make(map[string]string)
+		for _, name := range keys(l.Files, r.Files) {
+			lf, rf, bf := l.Files[name], r.Files[name], b.Files[name]
+			if lf != "" && rf != "" && lf != rf && !(bok && (lf == bf || rf == bf)) {
+				// Both changed: keep ours, and theirs beside it
+				f.Files[name] = lf
+				f.Files[conflictFileName(name, f.Files)] = rf
+			} else if h := pick(lf, rf, bf, bok); h != "" {
+				f.Files[name] = h
+			}
+		}
+		final[key] = f
+	}
+	aliases := make(map[string]string)
+	for _, name := range keys(local.Aliases, remote.Aliases) {
+		if k := pick(local.Aliases[name], remote.Aliases[name], base.Aliases[name], base.Aliases != nil); k != "" {
+			aliases[name] = k
+		}
+	}
+
+	// Send the other side what it lacks, then take what we lack
+	note := func(key string, m SyncMeta, have SyncMeta, ok bool) (SyncNote, error) {
+		n := SyncNote{Key: key, SyncMeta: m, Body: bodies[m.BodyHash], Base: inConflict[key]}
+		if ok && have.BodyHash == m.BodyHash {
+			n.Body = ""
+		} else if _, found := bodies[m.BodyHash]; !found {
+			return n, fmt.Errorf("no body for note %v", key)
+		}
+		for name, h := range m.Files {
+			if ok && have.Files[name] == h {
+				continue
+			}
+			b, found := data[h]
+			if !found {
+				return n, fmt.Errorf("no contents for file %v of note %v", name, key)
+			}
+			if n.Data == nil {
+				n.Data = make(map[string][]byte)
+			}
+			n.Data[name] = b
+		}
+		return n, nil
+	}
+	changes := SyncChanges{From: z.state.ReplicaId, Token: remote.Token, Aliases: aliases}
+	var mine []SyncNote
+	var finalKeys []string
+	for key := range final {
+		finalKeys = append(finalKeys, key)
+	}
+	sort.Strings(finalKeys)
+	for _, key := range finalKeys {
+		m := final[key]
+		if r, ok := remote.Notes[key]; !ok || !sameJSON(r, m) {
+			n, err := note(key, m, r, ok)
+			if err != nil {
+				return res, err
+			}
+			changes.Notes = append(changes.Notes, n)
+		}
+		if l, ok := local.Notes[key]; !ok || !sameJSON(l, m) {
+			n, err := note(key, m, l, ok)
+			if err != nil {
+				return res, err
+			}
+			mine = append(mine, n)
+		}
+	}
+	if err := p.SyncApply(changes); err != nil {
+		return res, err
+	}
+	if err := z.applySync(mine, aliases); err != nil {
+		return res, err
+	}
+	if err := z.recordSyncBase(remote.Replica); err != nil {
+		return res, err
+	}
+	res.Sent, res.Received, res.Merged = len(changes.Notes), len(mine), merged
+	ids := z.syncIds()
+	for _, c := range conflicts {
+		res.Conflicts = append(res.Conflicts, ids[c])
+	}
+	return res, nil
+}
+
+// prepareSync gives the zk unique ids and a replica id, if it hasn't
+// got them yet.
+func (z *ZK) prepareSync() error {
+	if !z.state.UniqueIds || z.state.ReplicaId == "" {
+		return z.EnableUniqueIds()
+	}
+	return nil
+}
+
+// syncKey returns the key for a note in a sync.
+func (z *ZK) syncKey(id int) string {
+	if id == 0 {
+		return rootKey
+	}
+	return z.state.Notes[id].UID
+}
+
+// syncIds maps the keys of the zk's notes to their ids.
+func (z *ZK) syncIds() map[string]int {
+	ids := make(map[string]int)
+	for id, md := range z.state.Notes {
+		if id == 0 {
+			ids[rootKey] = 0
+		} else if md.UID != "" {
+			ids[md.UID] = id
+		}
+	}
+	return ids
+}
+
+// syncBody returns a body as it's sent in a sync, with the numeric
+// references in it replaced by unique ids.
+func (z *ZK) syncBody(body string) string {
+	return rewriteReferences(body, func(target string) (string, bool) {
+		ref, err := strconv.Atoi(target)
+		if err != nil || ref == 0 {
+			return "", false
+		}
+		if md, ok := z.state.Notes[ref]; ok && md.UID != "" {
+			return md.UID, true
+		}
+		return "", false
+	})
+}
+
+// syncNote reads a note as it's sent in a sync, with its body as
+// syncBody gives it; the note itself is left as it was. The contents
+// of the files are included if withData is set.
+func (z *ZK) syncNote(id int, withData bool) (n SyncNote, err error) {
+	note, err := z.GetNote(id)
+	if err != nil {
+		return n, err
+	}
+	body := z.syncBody(note.Body)
+	n = SyncNote{Key: z.syncKey(id), Body: body}
+	n.Parent = z.syncKey(note.Parent)
+	n.Subnotes = []string{}
+	for _, sn := range note.Subnotes {
+		if k := z.syncKey(sn); k != "" {
+			n.Subnotes = append(n.Subnotes, k)
+		}
+	}
+	if note.Search != nil {
+		s := *note.Search
+		n.SearchRoot, s.Root = z.syncKey(s.Root), 0
+		n.Search = &s
+	}
+	n.Conflict = note.Conflict
+	n.BodyHash = hashString(body)
+	n.Files = make(map[string]string)
+	if withData {
+		n.Data = make(map[string][]byte)
+	}
+	for _, name := range note.Files {
+		p, err := z.getFilePath(id, name)
+		if err != nil {
+			return n, err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return n, err
+		}
+		n.Files[name] = hashBytes(b)
+		if withData {
+			n.Data[name] = b
+		}
+	}
+	return n, nil
+}
+
+// SyncState implements SyncPeer. It doesn't change the zk, so it
+// fails with ErrNoUniqueIds if the zk isn't ready to sync.
+func (z *ZK) SyncState() (SyncState, error) {
+	s := SyncState{Notes: make(map[string]SyncMeta), Aliases: make(map[string]string)}
+	if !z.state.UniqueIds || z.state.ReplicaId == "" {
+		return s, ErrNoUniqueIds
+	}
+	s.Replica = z.state.ReplicaId
+	for id := range z.state.Notes {
+		n, err := z.syncNote(id, false)
+		if err != nil {
+			return s, err
+		}
+		s.Notes[n.Key] = n.SyncMeta
+	}
+	for name, id := range z.state.Aliases {
+		if k := z.syncKey(id); k != "" {
+			s.Aliases[name] = k
+		}
+	}
+	b, err := json.Marshal([]interface{}{s.Notes, s.Aliases})
+	if err != nil {
+		return s, err
+	}
+	s.Token = hashBytes(b)
+	return s, nil
+}
+
+// SyncNotes implements SyncPeer.
+func (z *ZK) SyncNotes(keys []string) ([]SyncNote, error) {
+	ids := z.syncIds()
+	var notes []SyncNote
+	for _, key := range keys {
+		id, ok := ids[key]
+		if !ok {
+			return nil, fmt.Errorf("no note has unique id %v", key)
+		}
+		n, err := z.syncNote(id, true)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, nil
+}
+
+// SyncApply implements SyncPeer.
+func (z *ZK) SyncApply(c SyncChanges) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := z.SyncState()
+	if err != nil {
+		return err
+	}
+	if s.Token != c.Token {
+		return ErrSyncChanged
+	}
+	if err := z.applySync(c.Notes, c.Aliases); err != nil {
+		return err
+	}
+	return z.recordSyncBase(c.From)
+}
+
+// applySync writes notes received in a sync, creating those the zk
+// doesn't have, and replaces the aliases.
+func (z *ZK) applySync(notes []SyncNote, aliases map[string]string) error {
+	// Remember how things were, to tell the observers what changed
+	oldAliases := z.Aliases()
+	old := make(map[int]NoteMeta)
+	created := make(map[int]bool)
+	updated := make(map[int]bool)
+
+	ids := z.syncIds()
+	for _, n := range notes {
+		if _, ok := ids[n.Key]; ok {
+			continue
+		}
+		id := z.newNoteId()
+		created[id] = true
+		p := filepath.Join(z.root, fmt.Sprintf("%d", id))
+		if err := os.Mkdir(p, 0700); err != nil {
+			return err
+		}
+		if err := os.Mkdir(filepath.Join(p, "files"), 0700); err != nil {
+			return err
+		}
+		z.state.Notes[id] = NoteMeta{Id: id, UID: n.Key}
+		ids[n.Key] = id
+	}
+	for _, n := range notes {
+		id := ids[n.Key]
+		md := z.state.Notes[id]
+		old[id] = md
+		p := filepath.Join(z.root, fmt.Sprintf("%d", id))
+		if b, err := ioutil.ReadFile(filepath.Join(p, "body")); err != nil || hashString(z.syncBody(string(b))) != n.BodyHash {
+			if hashString(n.Body) != n.BodyHash {
+				return fmt.Errorf("no body for note %v", n.Key)
+			}
+			if err := ioutil.WriteFile(filepath.Join(p, "body"), []byte(n.Body), 0700); err != nil {
+				return err
+			}
+			updated[id] = true
+		}
+		if n.Base != "" {
+			if err := z.writeBase(id, n.Base); err != nil {
+				return err
+			}
+		}
+		md.Title = ""
+		if b, err := ioutil.ReadFile(filepath.Join(p, "body")); err == nil {
+			md.Title = strings.SplitN(string(b), "\n", 2)[0]
+		}
+
+		files := filepath.Join(p, "files")
+		existing, err := ioutil.ReadDir(files)
+		if err != nil {
+			return err
+		}
+		for _, fi := range existing {
+			if _, ok := n.Files[fi.Name()]; !ok {
+				if err := os.Remove(filepath.Join(files, fi.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		md.Files = nil
+		for _, name := range keys(n.Files) {
+			if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+				return fmt.Errorf("note %v: bad file name %q", n.Key, name)
+			}
+			dst := filepath.Join(files, name)
+			if b, ok := n.Data[name]; ok {
+				if hashBytes(b) != n.Files[name] {
+					return fmt.Errorf("file %v of note %v is damaged", name, n.Key)
+				}
+				if err := ioutil.WriteFile(dst, b, 0600); err != nil {
+					return err
+				}
+			} else if b, err := ioutil.ReadFile(dst); err != nil || hashBytes(b) != n.Files[name] {
+				return fmt.Errorf("no contents for file %v of note %v", name, n.Key)
+			}
+			md.Files = append(md.Files, name)
+		}
+
+		md.Parent = ids[n.Parent]
+		md.Subnotes = nil
+		for _, k := range n.Subnotes {
+			if sn, ok := ids[k]; ok {
+				md.Subnotes = append(md.Subnotes, sn)
+			}
+		}
+		md.Search = nil
+		if n.Search != nil {
+			s := *n.Search
+			s.Root = ids[n.SearchRoot]
+			md.Search = &s
+		}
+		md.Conflict = n.Conflict
+		z.state.Notes[id] = md
+		if err := z.writeNoteMetadata(md); err != nil {
+			return err
+		}
+	}
+	z.state.Aliases = make(map[string]int)
+	for name, k := range aliases {
+		if id, ok := ids[k]; ok {
+			z.state.Aliases[name] = id
+		}
+	}
+	if err := z.writeState(); err != nil {
+		return err
+	}
+
+	// Now everything's in place, tell the observers: first of the new
+	// notes, then of the changes to them and the rest
+	for _, n := range notes {
+		if id := ids[n.Key]; created[id] {
+			z.notify(Event{Type: EventNew, Note: z.state.Notes[id]})
+		}
+	}
+	for _, n := range notes {
+		id := ids[n.Key]
+		md, was := z.state.Notes[id], old[id]
+		if updated[id] && !created[id] {
+			z.notify(Event{Type: EventUpdate, Note: md})
+		}
+		for _, name := range md.Files {
+			if !hasString(was.Files, name) {
+				z.notify(Event{Type: EventAddFile, Note: md, File: name})
+			}
+		}
+		for _, name := range was.Files {
+			if !hasString(md.Files, name) {
+				z.notify(Event{Type: EventRemoveFile, Note: md, File: name})
+			}
+		}
+		for _, sn := range md.Subnotes {
+			if !hasInt(was.Subnotes, sn) {
+				z.notify(Event{Type: EventLink, Note: z.state.Notes[sn], Parent: id})
+			}
+		}
+		for _, sn := range was.Subnotes {
+			if !hasInt(md.Subnotes, sn) {
+				z.notify(Event{Type: EventUnlink, Note: z.state.Notes[sn], Parent: id})
+			}
+		}
+	}
+	var names []string
+	for name := range z.state.Aliases {
+		names = append(names, name)
+	}
+	for name := range oldAliases {
+		if _, ok := z.state.Aliases[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		id, ok := z.state.Aliases[name]
+		if !ok {
+			z.notify(Event{Type: EventUnalias, Note: z.state.Notes[oldAliases[name]], Alias: name})
+		} else if oid, had := oldAliases[name]; !had || oid != id {
+			z.notify(Event{Type: EventAlias, Note: z.state.Notes[id], Alias: name})
+		}
+	}
+	return nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasInt(list []int, n int) bool {
+	for _, x := range list {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *ZK) syncBasePath(replica string) string {
+	return filepath.Join(z.root, "sync", replica)
+}
+
+// readSyncBase reads the state at the end of the last sync with a
+// replica. It's empty if they've never synced.
+func (z *ZK) readSyncBase(replica string) (base syncBase, err error) {
+	if !isUID(replica) {
+		return base, fmt.Errorf("bad replica id %q", replica)
+	}
+	b, err := ioutil.ReadFile(z.syncBasePath(replica))
+	if os.IsNotExist(err) {
+		return base, nil
+	} else if err != nil {
+		return base, err
+	}
+	err = json.Unmarshal(b, &base)
+	return base, err
+}
+
+// recordSyncBase saves the zk's notes as the base for the next sync
+// with a replica.
+func (z *ZK) recordSyncBase(replica string) error {
+	if !isUID(replica) {
+		return fmt.Errorf("bad replica id %q", replica)
+	}
+	// The bodies now match the other side's, so they're the new bases
+	// of the notes which have them, unless they're still in conflict
+	ids := z.syncIds()
+	inConflict := make(map[int]bool)
+	for _, md := range z.state.Notes {
+		if md.Conflict != "" {
+			inConflict[ids[md.Conflict]] = true
+		}
+	}
+	base := syncBase{Notes: make(map[string]SyncNote), Aliases: make(map[string]string)}
+	for id := range z.state.Notes {
+		n, err := z.syncNote(id, false)
+		if err != nil {
+			return err
+		}
+		base.Notes[n.Key] = n
+		if inConflict[id] {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(z.root, fmt.Sprintf("%d", id), baseName))
+		if err == nil && string(b) != n.Body {
+			if err := z.writeBase(id, n.Body); err != nil {
+				return err
+			}
+		}
+	}
+	for name, id := range z.state.Aliases {
+		if k := z.syncKey(id); k != "" {
+			base.Aliases[name] = k
+		}
+	}
+	b, err := json.Marshal(base)
+	if err != nil {
+		return err
+	}
+	p := z.syncBasePath(replica)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// shareNotes reports whether two zks have a note in common, other
+// than the top-level note, or either has no other notes at all.
+func shareNotes(a, b SyncState) bool {
+	if len(a.Notes) <= 1 || len(b.Notes) <= 1 {
+		return true
+	}
+	for key := range a.Notes {
+		if _, ok := b.Notes[key]; ok && key != rootKey {
+			return true
+		}
+	}
+	return false
+}
+
+// pick chooses between the local and remote versions of something,
+// given what it was at the last sync: whichever side changed it, or
+// the local version if both did. An empty string means it's absent;
+// something changed on one side wins over its removal on the other,
+// as does anything over its absence if there was no last sync.
+func pick(l, r, b string, haveBase bool) string {
+	switch {
+	case l == r:
+		return l
+	case haveBase && l == b:
+		return r
+	case haveBase && r == b:
+		return l
+	case l == "":
+		return r
+	}
+	return l
+}
+
+// mergeSet combines two sides' changes to a list: items added on
+// either side are added, and items removed on either are removed.
+func mergeSet(l, r, b []string, haveBase bool) []string {
+	in := func(s []string) map[string]bool {
+		m := make(map[string]bool)
+		for _, x := range s {
+			m[x] = true
+		}
+		return m
+	}
+	inL, inR, inB := in(l), in(r), in(b)
+	ret := []string{}
+	for _, x := range l {
+		if inR[x] || !inB[x] || !haveBase {
+			ret = append(ret, x)
+		}
+	}
+	for _, x := range r {
+		if !inL[x] && !inB[x] {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// conflictBody is the body of a conflict copy of a note.
+func conflictBody(body string) string {
+	parts := strings.SplitN(body, "\n", 2)
+	parts[0] += conflictSuffix
+	return strings.Join(parts, "\n")
+}
+
+// conflictFileName names the other side's version of a file which both
+// sides changed.
+func conflictFileName(name string, taken map[string]string) string {
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		n := fmt.Sprintf("%s (conflict)%s", strings.TrimSuffix(name, ext), ext)
+		if i > 1 {
+			n = fmt.Sprintf("%s (conflict %d)%s", strings.TrimSuffix(name, ext), i, ext)
+		}
+		if _, ok := taken[n]; !ok {
+			return n
+		}
+	}
+}
+
+func searchJSON(m SyncMeta) string {
+	b, _ := json.Marshal([]interface{}{m.Search, m.SearchRoot})
+	return string(b)
+}
+
+func sameJSON(a, b interface{}) bool {
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	return string(ab) == string(bb)
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashString(s string) string {
+	return hashBytes([]byte(s))
+}
+
+// keys returns the keys of the maps, sorted, without repeats.
+func keys(maps ...map[string]string) []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				ret = append(ret, k)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
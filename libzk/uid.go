@@ -0,0 +1,103 @@
+package zk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Numeric ids are only unique within one copy of a zk: two copies
+// which both create notes will hand out the same ids. So that notes can
+// be told apart across copies, a zk can also give each note a unique
+// id, a ULID, kept in its metadata as NoteMeta.UID. A ULID is 26
+// characters of Crockford's base32, encoding a millisecond timestamp
+// and 80 random bits, so they sort by creation time.
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewUID returns a new ULID.
+func NewUID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+	// 128 bits, 5 at a time from the top, with 2 bits of padding
+	// ahead of the first character
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// isUID reports whether s looks like a ULID.
+func isUID(s string) bool {
+	if len(s) != 26 || s[0] > '7' {
+		return false
+	}
+	for _, c := range strings.ToUpper(s) {
+		if !strings.ContainsRune(crockford, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// UniqueIds reports whether the zk gives its notes unique ids.
+func (z *ZK) UniqueIds() bool {
+	return z.state.UniqueIds
+}
+
+// EnableUniqueIds makes the zk give every note a unique id, starting
+// with the notes it already has. It also names the zk for syncing (see
+// SyncWith).
+func (z *ZK) EnableUniqueIds() error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	z.state.UniqueIds = true
+	if z.state.ReplicaId == "" {
+		z.state.ReplicaId = NewUID()
+	}
+	for id, md := range z.state.Notes {
+		if md.UID != "" {
+			continue
+		}
+		md.UID = NewUID()
+		z.state.Notes[id] = md
+		if err := z.writeNoteMetadata(md); err != nil {
+			return err
+		}
+	}
+	return z.writeState()
+}
+
+// noteByUID returns the id of the note with the given unique id.
+func (z *ZK) noteByUID(uid string) (int, bool) {
+	uid = strings.ToUpper(uid)
+	for id, md := range z.state.Notes {
+		if md.UID == uid {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// RefTarget returns what a reference to the note should use as its
+// target: the note's unique id if it has one, which stays right when
+// the note is copied to another zk, otherwise its numeric id.
+func (z *ZK) RefTarget(id int) string {
+	if md, ok := z.state.Notes[id]; ok && md.UID != "" {
+		return md.UID
+	}
+	return strconv.Itoa(id)
+}
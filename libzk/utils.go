@@ -35,9 +35,148 @@ func (z *ZK) readState() (err error) {
 	if z.state.Notes == nil {
 		z.state.Notes = map[int]NoteMeta{}
 	}
+	z.loaded = copyState(z.state)
+	z.stamp = stateStamp(p)
 	return
 }
 
+// Other processes may be using the zk at the same time as this one: a
+// server, the TUI, a zk watch, a CLI command. Each holds the zk's lock
+// file while it changes the zk, and reads back the state file first if
+// someone else has changed it since; see lock. The in-memory state is
+// then merged with the file's, with z.loaded, the file as this process
+// last read or wrote it, to tell their changes from ours.
+
+const lockName = "lock"
+
+// lock takes the zk's lock, waiting for any other process holding it,
+// and brings the in-memory state up to date with the state file. It
+// returns a function which releases the lock. Locks nest, so a method
+// holding the lock can call others which take it.
+func (z *ZK) lock() (unlock func(), err error) {
+	if z.locked == 0 {
+		f, err := lockFile(filepath.Join(z.root, lockName))
+		if err != nil {
+			return nil, err
+		}
+		z.lockFile = f
+	}
+	z.locked++
+	unlock = func() {
+		z.locked--
+		if z.locked == 0 {
+			unlockFile(z.lockFile)
+			z.lockFile = nil
+			pending := z.pending
+			z.pending = nil
+			for _, e := range pending {
+				z.notify(e)
+			}
+		}
+	}
+	if z.locked == 1 {
+		if err := z.reloadState(); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// Reload brings the zk up to date with changes made by other processes
+// using it. Long-running programs should call it before reading from
+// the zk; methods which change the zk reload it themselves.
+func (z *ZK) Reload() error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	unlock()
+	return nil
+}
+
+// stateStamp identifies a version of the state file, or is empty if it
+// can't be read.
+func stateStamp(p string) string {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// reloadState merges the state file into the in-memory state, if it's
+// changed since this process last read or wrote it.
+func (z *ZK) reloadState() error {
+	p := filepath.Join(z.root, "state")
+	stamp := stateStamp(p)
+	if stamp == "" || stamp == z.stamp {
+		return nil
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var disk zkState
+	if err := json.Unmarshal(b, &disk); err != nil {
+		return fmt.Errorf("failure parsing state file: %v", err)
+	}
+	z.state = mergeState(z.loaded, z.state, disk)
+	z.loaded = copyState(disk)
+	z.stamp = stamp
+	return nil
+}
+
+// mergeState combines the changes made to the state base in ours and
+// theirs. Where both changed the same thing, ours wins.
+func mergeState(base, ours, theirs zkState) zkState {
+	ret := copyState(theirs)
+	if ours.NextNoteId > ret.NextNoteId {
+		ret.NextNoteId = ours.NextNoteId
+	}
+	ret.UniqueIds = ours.UniqueIds || theirs.UniqueIds
+	if ours.ReplicaId != base.ReplicaId {
+		ret.ReplicaId = ours.ReplicaId
+	}
+	for name := range base.Aliases {
+		if _, ok := ours.Aliases[name]; !ok {
+			delete(ret.Aliases, name)
+		}
+	}
+	for name, id := range ours.Aliases {
+		if b, ok := base.Aliases[name]; !ok || b != id {
+			ret.Aliases[name] = id
+		}
+	}
+	for id := range base.Notes {
+		if _, ok := ours.Notes[id]; !ok {
+			delete(ret.Notes, id)
+		}
+	}
+	for id, md := range ours.Notes {
+		if b, ok := base.Notes[id]; !ok || !b.Equal(md) {
+			ret.Notes[id] = md
+		}
+	}
+	return ret
+}
+
+// copyState returns a copy of s sharing nothing with it.
+func copyState(s zkState) zkState {
+	c := s
+	c.Aliases = make(map[string]int)
+	for k, v := range s.Aliases {
+		c.Aliases[k] = v
+	}
+	c.Notes = make(map[int]NoteMeta)
+	for id, md := range s.Notes {
+		md.Subnotes = append([]int(nil), md.Subnotes...)
+		md.Files = append([]string(nil), md.Files...)
+		c.Notes[id] = md
+	}
+	return c
+}
+
 func (z *ZK) deriveState() (state zkState, err error) {
 	state.Notes = make(map[int]NoteMeta)
 	// Stat the directory
@@ -58,6 +197,9 @@ func (z *ZK) deriveState() (state zkState, err error) {
 					continue
 				}
 				state.Notes[id] = note.NoteMeta
+				if note.UID != "" {
+					state.UniqueIds = true
+				}
 				if id >= state.NextNoteId {
 					state.NextNoteId = id + 1
 				}
@@ -116,22 +258,47 @@ func (z *ZK) writeNoteMetadata(meta NoteMeta) error {
 	return nil
 }
 
+// writeState writes the in-memory state to the state file, merged
+// with any changes other processes have made to it.
 func (z *ZK) writeState() (err error) {
-	p := filepath.Join(z.root, "state")
-	fd, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0755)
+	unlock, err := z.lock()
 	if err != nil {
-		err = fmt.Errorf("Failed to open state file: %v", err)
-		return
+		return err
 	}
-	defer fd.Close()
+	defer unlock()
 
-	fd.Truncate(0)
-	fd.Seek(0, 0)
-	enc := json.NewEncoder(fd)
-	err = enc.Encode(z.state)
+	p := filepath.Join(z.root, "state")
+	b, err := json.Marshal(z.state)
 	if err != nil {
-		err = fmt.Errorf("Failure marshalling to state file: %v", err)
+		return fmt.Errorf("Failure marshalling to state file: %v", err)
 	}
-	fd.Sync()
-	return
+	// Write a new file and swap it in, so nobody sees half of it
+	fd, err := os.OpenFile(p+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to open state file: %v", err)
+	}
+	_, err = fd.Write(append(b, '\n'))
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(p+".tmp", p)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write state file: %v", err)
+	}
+	z.loaded = copyState(z.state)
+	z.stamp = stateStamp(p)
+	return nil
+}
+
+// stateChanged reports whether the in-memory state differs from the
+// state file as this process last read or wrote it.
+func (z *ZK) stateChanged() bool {
+	a, _ := json.Marshal(z.state)
+	b, _ := json.Marshal(z.loaded)
+	return string(a) != string(b)
 }
@@ -0,0 +1,422 @@
+package zk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A zk's notes can be changed behind its back: an editor rewrites a
+// body, changing its title; Syncthing or git brings in new notes and
+// metadata from another copy. A Watcher notices such changes to the
+// body, metadata and files of the notes, takes them into the zk's
+// state, and reports them as WatchEvents. On Linux it's told of changes
+// by inotify; elsewhere, or if inotify isn't available, it polls.
+
+// DefaultPollInterval is how often a Watcher polls for changes when it
+// can't be told of them.
+const DefaultPollInterval = 2 * time.Second
+
+// watchSettle is how long a Watcher waits for a burst of changes, such
+// as an editor's save or a git checkout, to finish before reading them.
+const watchSettle = 50 * time.Millisecond
+
+// allNotes stands for every note, when a notifier can't tell which
+// ones changed.
+const allNotes = -1
+
+// stateNote stands for the state file, which other programs using the
+// zk change when they add notes or aliases.
+const stateNote = -2
+
+// WatchOp says what happened to a note.
+type WatchOp int
+
+const (
+	// NoteChanged means the note's body, metadata or files changed.
+	NoteChanged WatchOp = iota
+	// NoteAdded means a new note appeared.
+	NoteAdded
+	// NoteRemoved means the note's directory disappeared.
+	NoteRemoved
+)
+
+func (op WatchOp) String() string {
+	switch op {
+	case NoteChanged:
+		return "changed"
+	case NoteAdded:
+		return "added"
+	case NoteRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("WatchOp(%d)", int(op))
+}
+
+// A WatchEvent reports a change to a note which a Watcher has taken
+// into the zk's state. Note is the note's metadata afterwards, or
+// before, if it was removed. If Error is set, the watcher failed to
+// read a change and the rest of the event is empty.
+type WatchEvent struct {
+	Op    WatchOp
+	Note  NoteMeta
+	Error error
+}
+
+// A notifier tells a Watcher which notes may have changed, by id, or
+// allNotes.
+type notifier interface {
+	changes() <-chan []int
+	close() error
+}
+
+// A Watcher keeps a zk up to date with changes made to its notes from
+// outside, until it's closed.
+type Watcher struct {
+	// Events receives a WatchEvent for each change. It must be read
+	// from, and is closed when the Watcher is.
+	Events <-chan WatchEvent
+
+	z      *ZK
+	mu     sync.Locker
+	n      notifier
+	events chan WatchEvent
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Watch starts watching the zk's notes for changes, using inotify if
+// it can and polling every DefaultPollInterval otherwise. The watcher
+// changes the zk from its own goroutine: if anything else uses the zk
+// meanwhile, mu must be the lock which guards it, and the watcher will
+// hold it while it works. Otherwise mu may be nil.
+func (z *ZK) Watch(mu sync.Locker) (*Watcher, error) {
+	n, err := newInotify(z.root)
+	if err != nil {
+		n = newPoller(z.root, DefaultPollInterval)
+	}
+	return z.startWatcher(mu, n), nil
+}
+
+// WatchPoll is like Watch, but always polls, every interval. Polling
+// notices changes inotify misses, such as those made by another
+// machine to a zk on a network file system.
+func (z *ZK) WatchPoll(mu sync.Locker, interval time.Duration) (*Watcher, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("bad poll interval %v", interval)
+	}
+	return z.startWatcher(mu, newPoller(z.root, interval)), nil
+}
+
+func (z *ZK) startWatcher(mu sync.Locker, n notifier) *Watcher {
+	if mu == nil {
+		mu = &sync.Mutex{}
+	}
+	w := &Watcher{
+		z:      z,
+		mu:     mu,
+		n:      n,
+		events: make(chan WatchEvent),
+		done:   make(chan struct{}),
+	}
+	w.Events = w.events
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Close stops the watcher and closes its Events channel.
+func (w *Watcher) Close() error {
+	close(w.done)
+	err := w.n.close()
+	w.wg.Wait()
+	return err
+}
+
+func (w *Watcher) run() {
+	defer w.wg.Done()
+	defer close(w.events)
+	for {
+		var ids []int
+		select {
+		case <-w.done:
+			return
+		case ids = <-w.n.changes():
+		}
+		// Gather the rest of the burst
+		settle := time.After(watchSettle)
+	gather:
+		for {
+			select {
+			case <-w.done:
+				return
+			case more := <-w.n.changes():
+				ids = append(ids, more...)
+			case <-settle:
+				break gather
+			}
+		}
+		for _, ev := range w.refresh(ids) {
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// refresh brings the zk's state for the notes up to date with their
+// directories, returning what changed.
+func (w *Watcher) refresh(ids []int) (events []WatchEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Taking the lock reads in any changes to the state file, so
+	// writing the state below won't undo them. Notes changed that way
+	// are reported like the rest.
+	before := copyState(w.z.state).Notes
+	unlock, err := w.z.lock()
+	if err != nil {
+		return []WatchEvent{{Error: err}}
+	}
+	defer unlock()
+	for id, md := range w.z.state.Notes {
+		if old, ok := before[id]; !ok || !old.Equal(md) {
+			ids = append(ids, id)
+		}
+	}
+	for id := range before {
+		if _, ok := w.z.state.Notes[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		if id != allNotes {
+			continue
+		}
+		all, err := noteDirs(w.z.root)
+		if err != nil {
+			return []WatchEvent{{Error: err}}
+		}
+		for id := range w.z.state.Notes {
+			all = append(all, id)
+		}
+		ids = all
+		break
+	}
+	seen := make(map[int]bool)
+	var todo []int
+	for _, id := range ids {
+		if !seen[id] && id >= 0 {
+			seen[id] = true
+			todo = append(todo, id)
+		}
+	}
+	sort.Ints(todo)
+	changed := false
+	for _, id := range todo {
+		old, had := before[id]
+		evs, err := w.z.refreshNote(id, old, had)
+		if err != nil {
+			events = append(events, WatchEvent{Error: fmt.Errorf("note %d: %v", id, err)})
+		}
+		if len(evs) > 0 {
+			events = append(events, evs...)
+			changed = true
+		}
+	}
+	if changed {
+		if err := w.z.writeState(); err != nil {
+			events = append(events, WatchEvent{Error: err})
+		}
+	}
+	return events
+}
+
+// refreshNote re-reads a note from its directory, returning how it
+// differs from old, the note as it was before, if the zk had it.
+func (z *ZK) refreshNote(id int, old NoteMeta, had bool) (events []WatchEvent, err error) {
+	p := filepath.Join(z.root, fmt.Sprintf("%d", id))
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		if !had || id == 0 {
+			return nil, nil
+		}
+		return z.forgetNote(id, old)
+	}
+	// A note which is still being written will be seen again when
+	// it's finished
+	for _, name := range []string{"metadata", "body", "files"} {
+		if _, err := os.Stat(filepath.Join(p, name)); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	note, err := z.readNote(id)
+	if err != nil {
+		return nil, err
+	}
+	if id >= z.state.NextNoteId {
+		z.state.NextNoteId = id + 1
+	}
+	if !had {
+		return []WatchEvent{{Op: NoteAdded, Note: note.NoteMeta}}, nil
+	}
+	if old.Equal(note.NoteMeta) {
+		return nil, nil
+	}
+	return []WatchEvent{{Op: NoteChanged, Note: note.NoteMeta}}, nil
+}
+
+// forgetNote takes a note whose directory has gone out of the state,
+// along with the links and aliases to it. Its subnotes whose parent it
+// was are given to note 0.
+func (z *ZK) forgetNote(id int, old NoteMeta) (events []WatchEvent, err error) {
+	events = append(events, WatchEvent{Op: NoteRemoved, Note: old})
+	delete(z.state.Notes, id)
+	for name, target := range z.state.Aliases {
+		if target == id {
+			delete(z.state.Aliases, name)
+		}
+	}
+	var ids []int
+	for other := range z.state.Notes {
+		ids = append(ids, other)
+	}
+	sort.Ints(ids)
+	for _, other := range ids {
+		md := z.state.Notes[other]
+		changed := false
+		var subnotes []int
+		for _, sn := range md.Subnotes {
+			if sn == id {
+				changed = true
+			} else {
+				subnotes = append(subnotes, sn)
+			}
+		}
+		md.Subnotes = subnotes
+		if md.Parent == id {
+			md.Parent = 0
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		z.state.Notes[other] = md
+		if err := z.writeNoteMetadata(md); err != nil {
+			return events, err
+		}
+		events = append(events, WatchEvent{Op: NoteChanged, Note: md})
+	}
+	return events, nil
+}
+
+// noteDirs returns the ids of the note directories in root.
+func noteDirs(root string) ([]int, error) {
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, fi := range fis {
+		if id, err := strconv.Atoi(fi.Name()); err == nil && fi.IsDir() && id >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// A poller finds changes by looking at the notes' directories now and
+// then, and comparing what it sees with the last time.
+type poller struct {
+	root     string
+	interval time.Duration
+	c        chan []int
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newPoller(root string, interval time.Duration) *poller {
+	p := &poller{root: root, interval: interval, c: make(chan []int), done: make(chan struct{})}
+	last := p.look()
+	p.wg.Add(1)
+	go p.run(last)
+	return p
+}
+
+func (p *poller) changes() <-chan []int {
+	return p.c
+}
+
+func (p *poller) close() error {
+	close(p.done)
+	p.wg.Wait()
+	return nil
+}
+
+func (p *poller) run(last map[int]string) {
+	defer p.wg.Done()
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		now := p.look()
+		var ids []int
+		for id, s := range now {
+			if last[id] != s {
+				ids = append(ids, id)
+			}
+		}
+		for id := range last {
+			if _, ok := now[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		select {
+		case p.c <- ids:
+			last = now
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// look describes each note directory by the sizes and times of the
+// things in it a change would touch, and the state file by its own.
+func (p *poller) look() map[int]string {
+	ret := make(map[int]string)
+	ids, err := noteDirs(p.root)
+	if err != nil {
+		return ret
+	}
+	for _, id := range ids {
+		dir := filepath.Join(p.root, fmt.Sprintf("%d", id))
+		var s string
+		for _, name := range []string{"body", "metadata", "files"} {
+			if fi, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				s += fmt.Sprintf("%d.%d ", fi.Size(), fi.ModTime().UnixNano())
+			} else {
+				s += "- "
+			}
+		}
+		if files, err := ioutil.ReadDir(filepath.Join(dir, "files")); err == nil {
+			for _, fi := range files {
+				s += fi.Name() + "/"
+			}
+		}
+		ret[id] = s
+	}
+	ret[stateNote] = stateStamp(filepath.Join(p.root, "state"))
+	return ret
+}
@@ -0,0 +1,148 @@
+//go:build linux
+// +build linux
+
+package zk
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotify watches the root, each note's directory and each note's
+// files directory.
+type inotify struct {
+	root string
+	f    *os.File
+	fd   int
+	c    chan []int
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// wds maps watch descriptors to note ids, or allNotes for the
+	// root.
+	wds map[int]int
+}
+
+const (
+	rootMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+	noteMask = rootMask | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB
+)
+
+func newInotify(root string) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	// Reading through an *os.File lets Close interrupt a read
+	n := &inotify{root: root, f: os.NewFile(uintptr(fd), "inotify"), fd: fd, c: make(chan []int), done: make(chan struct{}), wds: make(map[int]int)}
+	if err := n.add(root, allNotes); err != nil {
+		n.f.Close()
+		return nil, err
+	}
+	ids, err := noteDirs(root)
+	if err != nil {
+		n.f.Close()
+		return nil, err
+	}
+	for _, id := range ids {
+		n.addNote(id)
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n, nil
+}
+
+func (n *inotify) add(path string, id int) error {
+	mask := uint32(noteMask)
+	if id == allNotes {
+		mask = rootMask
+	}
+	wd, err := syscall.InotifyAddWatch(n.fd, path, mask)
+	if err != nil {
+		return err
+	}
+	n.wds[wd] = id
+	return nil
+}
+
+// addNote watches a note's directories, if they're there yet.
+func (n *inotify) addNote(id int) {
+	dir := filepath.Join(n.root, strconv.Itoa(id))
+	if n.add(dir, id) == nil {
+		n.add(filepath.Join(dir, "files"), id)
+	}
+}
+
+func (n *inotify) changes() <-chan []int {
+	return n.c
+}
+
+func (n *inotify) close() error {
+	close(n.done)
+	err := n.f.Close()
+	n.wg.Wait()
+	return err
+}
+
+func (n *inotify) run() {
+	defer n.wg.Done()
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		l, err := n.f.Read(buf)
+		if err != nil {
+			// Closed
+			return
+		}
+		var ids []int
+		for off := 0; off+syscall.SizeofInotifyEvent <= l; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+int(ev.Len)]), "\x00")
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				ids = append(ids, allNotes)
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.wds, int(ev.Wd))
+				continue
+			}
+			id, ok := n.wds[int(ev.Wd)]
+			if !ok {
+				continue
+			}
+			if id == allNotes {
+				// Something appeared in or vanished from the root
+				if name == "state" {
+					ids = append(ids, stateNote)
+					continue
+				}
+				nid, err := strconv.Atoi(name)
+				if err != nil || nid < 0 {
+					continue
+				}
+				if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					n.addNote(nid)
+				}
+				ids = append(ids, nid)
+				continue
+			}
+			if name == "files" && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				n.add(filepath.Join(n.root, strconv.Itoa(id), "files"), id)
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		select {
+		case n.c <- ids:
+		case <-n.done:
+			return
+		}
+	}
+}
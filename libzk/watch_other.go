@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package zk
+
+import "errors"
+
+func newInotify(root string) (notifier, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
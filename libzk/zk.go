@@ -19,6 +19,11 @@ type zkState struct {
 	NextNoteId int
 	Aliases    map[string]int
 	Notes      map[int]NoteMeta
+	// UniqueIds is set if new notes get unique ids; see EnableUniqueIds.
+	UniqueIds bool `json:",omitempty"`
+	// ReplicaId identifies this copy of the zk to others it syncs
+	// with; see SyncWith.
+	ReplicaId string `json:",omitempty"`
 }
 
 type NoteMeta struct {
@@ -27,10 +32,22 @@ type NoteMeta struct {
 	Subnotes []int
 	Files    []string
 	Parent   int
+	// Search is set for "smart" notes, whose subnotes are
+	// computed from a saved search. See GetSubnotes.
+	Search *SavedSearch `json:",omitempty"`
+	// UID is the note's unique id, if the zk gives them out. See
+	// EnableUniqueIds.
+	UID string `json:",omitempty"`
+	// Conflict is set on a conflict copy made by SyncWith, to the
+	// unique id of the note it conflicts with.
+	Conflict string `json:",omitempty"`
 }
 
 func (o *NoteMeta) Equal(n NoteMeta) bool {
-	if o.Id != n.Id || o.Title != n.Title || o.Parent != n.Parent {
+	if o.Id != n.Id || o.Title != n.Title || o.Parent != n.Parent || o.UID != n.UID || o.Conflict != n.Conflict {
+		return false
+	}
+	if !o.Search.equal(n.Search) {
 		return false
 	}
 	if len(o.Subnotes) != len(n.Subnotes) || len(o.Files) != len(n.Files) {
@@ -57,6 +74,18 @@ type Note struct {
 type ZK struct {
 	root  string
 	state zkState
+	// loaded is the state file as this process last read or wrote
+	// it, and stamp identifies that version of the file; see lock.
+	loaded zkState
+	stamp  string
+	// locked counts the nested holds on lockFile.
+	locked   int
+	lockFile *os.File
+
+	observers    []observer
+	nextObserver int
+	// pending holds events waiting for the zk to be unlocked.
+	pending []Event
 }
 
 // InitZK will initialize a new zk with the specified path as the
@@ -101,13 +130,27 @@ func NewZK(root string) (z *ZK, err error) {
 	return
 }
 
+// Close writes out any changes to the in-memory state which haven't
+// been written yet. It writes nothing if there are none, so a program
+// which only reads the zk never replaces the state file.
 func (z *ZK) Close() {
-	z.writeState()
+	z.Sync()
+}
+
+// Sync writes the in-memory state out to disk, merged with any changes
+// other processes have made to it. Not every change is written to the
+// state file immediately, so long-running programs should call Sync
+// after making changes rather than waiting for Close.
+func (z *ZK) Sync() error {
+	if !z.stateChanged() {
+		return nil
+	}
+	return z.writeState()
 }
 
 // ResolveNoteId returns the numeric ID from a string name.  You'll
-// use this to determine if the user has specified an exact ID or an
-// alias.
+// use this to determine if the user has specified an exact ID, an
+// alias or a unique ID.
 func (z *ZK) ResolveNoteId(name string) (int, error) {
 	// First check if it's an alias
 	for k, v := range z.state.Aliases {
@@ -115,6 +158,12 @@ func (z *ZK) ResolveNoteId(name string) (int, error) {
 			return v, nil
 		}
 	}
+	if isUID(name) {
+		if id, ok := z.noteByUID(name); ok {
+			return id, nil
+		}
+		return 0, fmt.Errorf("no note has unique id %v", name)
+	}
 	// Otherwise, just treat it as a number
 	return strconv.Atoi(name)
 }
@@ -183,16 +232,38 @@ func (z *ZK) GetNoteMeta(id int) (md NoteMeta, err error) {
 }
 
 func (z *ZK) NewNote(parent int, body string) (int, error) {
-	id := z.state.NextNoteId
-	err := z.makeNote(id, parent, body)
+	unlock, err := z.lock()
 	if err != nil {
 		return 0, err
 	}
-	z.state.NextNoteId++
-	return id, z.writeState()
+	defer unlock()
+	id := z.newNoteId()
+	err = z.makeNote(id, parent, body)
+	if err != nil {
+		return 0, err
+	}
+	if err := z.writeState(); err != nil {
+		return id, err
+	}
+	z.notify(Event{Type: EventNew, Note: z.state.Notes[id]})
+	return id, nil
+}
+
+// newNoteId takes the next free note id. An id whose directory exists
+// is skipped, even if the state doesn't know of the note: another
+// program may have made it and not yet written the state file.
+func (z *ZK) newNoteId() int {
+	for {
+		id := z.state.NextNoteId
+		z.state.NextNoteId++
+		if _, err := os.Lstat(filepath.Join(z.root, fmt.Sprintf("%d", id))); os.IsNotExist(err) {
+			return id
+		}
+	}
 }
 
-// makeNote does NOT write the state file
+// makeNote does NOT write the state file. It refuses to make a note
+// whose directory already exists.
 func (z *ZK) makeNote(id, parent int, body string) error {
 	// First verify that the id doesn't already exist
 	if m, ok := z.state.Notes[id]; ok {
@@ -205,11 +276,16 @@ func (z *ZK) makeNote(id, parent int, body string) error {
 	}
 
 	meta.Parent = parent
+	if z.state.UniqueIds {
+		meta.UID = NewUID()
+	}
 
 	// make the note dir
 	path := filepath.Join(z.root, fmt.Sprintf("%d", id))
-	err := os.MkdirAll(path, 0700)
-	if err != nil {
+	err := os.Mkdir(path, 0700)
+	if os.IsExist(err) {
+		return fmt.Errorf("a directory for note %v already exists", id)
+	} else if err != nil {
 		return err
 	}
 
@@ -250,6 +326,20 @@ func (z *ZK) makeNote(id, parent int, body string) error {
 }
 
 func (z *ZK) UpdateNote(id int, body string) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := z.updateNote(id, body); err != nil {
+		return err
+	}
+	z.notify(Event{Type: EventUpdate, Note: z.state.Notes[id]})
+	return nil
+}
+
+// updateNote is UpdateNote without telling the observers.
+func (z *ZK) updateNote(id int, body string) error {
 	// Make sure the note exists
 	var meta NoteMeta
 	var ok bool
@@ -278,16 +368,48 @@ func (z *ZK) UpdateNote(id int, body string) error {
 	return nil
 }
 
+// AppendNote adds text to the end of the specified note's body.
+func (z *ZK) AppendNote(id int, text string) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	note, err := z.GetNote(id)
+	if err != nil {
+		return err
+	}
+	if err := z.updateNote(id, note.Body+text); err != nil {
+		return err
+	}
+	z.notify(Event{Type: EventAppend, Note: z.state.Notes[id]})
+	return nil
+}
+
 // AddAlias installs an alias, allowing the note with the given id to
 // be referred to by the specified name.
 func (z *ZK) AddAlias(id int, name string) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	z.state.Aliases[name] = id
-	return z.writeState()
+	if err := z.writeState(); err != nil {
+		return err
+	}
+	z.notify(Event{Type: EventAlias, Note: z.state.Notes[id], Alias: name})
+	return nil
 }
 
 // RemoveAlias removes the specified alias.
 func (z *ZK) RemoveAlias(name string) {
+	id, ok := z.state.Aliases[name]
+	if !ok {
+		return
+	}
 	delete(z.state.Aliases, name)
+	z.notify(Event{Type: EventUnalias, Note: z.state.Notes[id], Alias: name})
 }
 
 // Aliases returns a *copy* of the map of aliases
@@ -309,7 +431,8 @@ func (z *ZK) MetadataDump() map[int]NoteMeta {
 // file, suitable for passing to an editor. Note that changing the
 // note's title here by editing this file will not change the title
 // in the in-memory metadata until GetNote, Rescan, or another function
-// which reads and parses the on-disk files is called.
+// which reads and parses the on-disk files is called, or a Watcher
+// (see Watch) notices the change.
 func (z *ZK) GetNoteBodyPath(id int) (path string, err error) {
 	if _, ok := z.state.Notes[id]; !ok {
 		err = fmt.Errorf("Note %d not found", id)
@@ -321,6 +444,11 @@ func (z *ZK) GetNoteBodyPath(id int) (path string, err error) {
 
 // LinkNote links the specified note as a child of the parent note.
 func (z *ZK) LinkNote(parent, id int) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	// Get the parent
 	p, ok := z.state.Notes[parent]
 	if !ok {
@@ -344,11 +472,20 @@ func (z *ZK) LinkNote(parent, id int) error {
 
 	// Write state & metadata file
 	z.state.Notes[parent] = p
-	return z.writeNoteMetadata(p)
+	if err := z.writeNoteMetadata(p); err != nil {
+		return err
+	}
+	z.notify(Event{Type: EventLink, Note: z.state.Notes[id], Parent: parent})
+	return nil
 }
 
 // UnlinkNote removes the specified note from the parent note's subnotes
 func (z *ZK) UnlinkNote(parent, id int) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	// Get the child
 	child, ok := z.state.Notes[id]
 	if !ok {
@@ -379,19 +516,39 @@ func (z *ZK) UnlinkNote(parent, id int) error {
 
 	// Write state & metadata file
 	z.state.Notes[parent] = p
-	return z.writeNoteMetadata(p)
+	if err := z.writeNoteMetadata(p); err != nil {
+		return err
+	}
+	z.notify(Event{Type: EventUnlink, Note: z.state.Notes[id], Parent: parent})
+	return nil
 }
 
 // AddFile copies the file at the specified path into the given note's files.
 // If dstName is not empty, the resulting file will be given that name.
 func (z *ZK) AddFile(id int, path string, dstName string) error {
+	return z.addFile(id, path, dstName, false)
+}
+
+// ReplaceFile is like AddFile, but if the note already has a file with
+// that name, its contents are replaced. The new contents are copied in
+// beside the old and renamed over them, so a failure leaves the old
+// file as it was.
+func (z *ZK) ReplaceFile(id int, path string, dstName string) error {
+	return z.addFile(id, path, dstName, true)
+}
+
+func (z *ZK) addFile(id int, path string, dstName string, replace bool) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	// Make sure that note actually exists
 	dstNote, ok := z.state.Notes[id]
 	if !ok {
 		return fmt.Errorf("Note %d not found", id)
 	}
 	// Verify that the source file exists
-	var err error
 	_, err = os.Stat(path)
 	if err != nil {
 		return fmt.Errorf("Cannot find source file %v: %v", dstName, err)
@@ -400,6 +557,7 @@ func (z *ZK) AddFile(id int, path string, dstName string) error {
 	if err != nil {
 		return fmt.Errorf("Cannot open source file %v: %v", path, err)
 	}
+	defer src.Close()
 
 	// Verify that the destination files directory exists
 	p := filepath.Join(z.root, fmt.Sprintf("%d", id), "files")
@@ -418,32 +576,63 @@ func (z *ZK) AddFile(id int, path string, dstName string) error {
 	}
 	// Make sure there's not already a file with that name in the destination
 	for _, f := range dstNote.Files {
-		if f == base {
+		if f == base && !replace {
 			return fmt.Errorf("File named %v already exists for note %d", base, id)
 		}
 	}
 
 	dstPath := filepath.Join(p, base)
-	dst, err := os.Create(dstPath)
+	var dst *os.File
+	if replace {
+		// Write beside the old file under a name no attachment has,
+		// then swap it in
+		if dst, err = ioutil.TempFile(p, ".replace-*"); err == nil {
+			mode := os.FileMode(0644)
+			if fi, err := os.Stat(dstPath); err == nil {
+				mode = fi.Mode().Perm()
+			}
+			err = dst.Chmod(mode)
+		}
+	} else {
+		dst, err = os.Create(dstPath)
+	}
 	if err != nil {
+		if dst != nil {
+			dst.Close()
+			os.Remove(dst.Name())
+		}
 		return fmt.Errorf("Cannot create destination file %v: %v", dstPath, err)
 	}
+	tmpPath := dst.Name()
 
 	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && replace {
+		err = os.Rename(tmpPath, dstPath)
+	}
 	if err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("Problem copying %v to %v: %v", path, dstPath, err)
 	}
 
 	// Re-read the note to update the metadata
-	_, err = z.readNote(id)
+	note, err := z.readNote(id)
 	if err != nil {
 		return fmt.Errorf("Failed to read note %v: %v", id, err)
 	}
+	z.notify(Event{Type: EventAddFile, Note: note.NoteMeta, File: base})
 	return nil
 }
 
 // RemoveFile removes the specified file from the note.
 func (z *ZK) RemoveFile(id int, name string) error {
+	unlock, err := z.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	// Make sure that note actually exists
 	dstNote, ok := z.state.Notes[id]
 	if !ok {
@@ -467,7 +656,11 @@ func (z *ZK) RemoveFile(id int, name string) error {
 
 	// And update metadata
 	z.state.Notes[id] = dstNote
-	return z.writeNoteMetadata(dstNote)
+	if err := z.writeNoteMetadata(dstNote); err != nil {
+		return err
+	}
+	z.notify(Event{Type: EventRemoveFile, Note: dstNote, File: name})
+	return nil
 }
 
 // GetFilePath returns an absolute path to a given file within a note
@@ -512,9 +705,12 @@ func (z *ZK) Rescan() error {
 
 // GrepResult contains a single matching line returned from the Grep function.
 // The Note field is the id of the note which matched
+// The File field is the name of the attached file which matched, or empty
+// if the match was in the note body.
 // The Line field is the text of the note which matched.
 type GrepResult struct {
 	Note  NoteMeta
+	File  string
 	Line  string
 	Error error
 }
@@ -523,31 +719,62 @@ type oneGrep struct {
 	c chan *GrepResult
 }
 
-func (z *ZK) grep(n NoteMeta, pattern *regexp.Regexp, c chan *oneGrep) {
+func (z *ZK) grep(n NoteMeta, pattern *regexp.Regexp, files bool, c chan *oneGrep) {
 	// Create a channel of GrepResults and hand it back up to the master routine
 	res := make(chan *GrepResult)
 	defer close(res)
 	c <- &oneGrep{res}
 
 	// Get a reader on the note body
-	p := filepath.Join(z.root, fmt.Sprintf("%d", n.Id), "body")
-	f, err := os.Open(p)
+	p := filepath.Join(z.root, fmt.Sprintf("%d", n.Id))
+	f, err := os.Open(filepath.Join(p, "body"))
 	if err != nil {
 		res <- &GrepResult{Note: n, Error: err}
 		return
 	}
-	defer f.Close()
+	grepReader(n, "", f, pattern, res)
+	f.Close()
 
-	// Now walk it, looking for any matching lines
-	rdr := bufio.NewReader(f)
+	if !files {
+		return
+	}
+
+	// Now check any attachments which we can turn into text
+	contents, err := ioutil.ReadDir(filepath.Join(p, "files"))
+	if err != nil {
+		res <- &GrepResult{Note: n, Error: err}
+		return
+	}
+	for _, fi := range contents {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(p, "files", fi.Name()))
+		if err != nil {
+			res <- &GrepResult{Note: n, File: fi.Name(), Error: err}
+			continue
+		}
+		if txt, err := extractText(fi.Name(), f); err != nil {
+			res <- &GrepResult{Note: n, File: fi.Name(), Error: err}
+		} else if txt != nil {
+			grepReader(n, fi.Name(), txt, pattern, res)
+		}
+		f.Close()
+	}
+}
+
+// grepReader walks the reader, sending any matching lines to res.
+func grepReader(n NoteMeta, file string, r io.Reader, pattern *regexp.Regexp, res chan *GrepResult) {
+	rdr := bufio.NewReader(r)
 	for {
 		if s, err := rdr.ReadString('\n'); err != nil && err != io.EOF {
 			// Legit error, pass it up
-			res <- &GrepResult{Note: n, Error: err}
+			res <- &GrepResult{Note: n, File: file, Error: err}
+			return
 		} else {
 			if pattern.MatchString(s) {
 				// match!
-				res <- &GrepResult{Note: n, Line: strings.TrimSuffix(s, "\n")}
+				res <- &GrepResult{Note: n, File: file, Line: strings.TrimSuffix(s, "\n")}
 			}
 			if err == io.EOF {
 				break
@@ -560,12 +787,37 @@ func (z *ZK) grep(n NoteMeta, pattern *regexp.Regexp, c chan *oneGrep) {
 // a regular expression string and a note ID. That note, and the entire tree of
 // subnotes below it, are searched.
 func (z *ZK) TreeGrep(pattern string, root int) (c chan *GrepResult, err error) {
+	return z.treeGrep(pattern, root, false)
+}
+
+// TreeGrepFiles is like TreeGrep, but also searches any text-like files
+// attached to the notes. See RegisterExtractor.
+func (z *ZK) TreeGrepFiles(pattern string, root int) (c chan *GrepResult, err error) {
+	return z.treeGrep(pattern, root, true)
+}
+
+func (z *ZK) treeGrep(pattern string, root int, files bool) (c chan *GrepResult, err error) {
 	// Make sure the specified root actually exists
 	if _, ok := z.state.Notes[root]; !ok {
 		err = fmt.Errorf("Note %d does not exist", root)
 		return
 	}
-	// Simple lambda function to walk the tree and build up a list of notes to search
+	return z.grepNotes(pattern, z.subtree(root), files)
+}
+
+// Subtree returns the ids of the specified note and every note in the
+// tree of subnotes below it.
+func (z *ZK) Subtree(root int) ([]int, error) {
+	if _, ok := z.state.Notes[root]; !ok {
+		return nil, fmt.Errorf("Note %d does not exist", root)
+	}
+	return z.subtree(root), nil
+}
+
+// subtree returns the ids of the given note and every note below it.
+// Notes linked in several places appear once per link.
+func (z *ZK) subtree(root int) []int {
+	// Simple lambda function to walk the tree and build up a list of notes
 	var f func(int) []int
 	f = func(id int) []int {
 		note, ok := z.state.Notes[id]
@@ -579,12 +831,22 @@ func (z *ZK) TreeGrep(pattern string, root int) (c chan *GrepResult, err error)
 		}
 		return l
 	}
-	return z.Grep(pattern, f(root))
+	return f(root)
 }
 
 // Grep searches note bodies for a regular expression and returns a channel of *GrepResult.
 // If the notes parameter is non-empty, it will restrict the search to only the specified note IDs.
 func (z *ZK) Grep(pattern string, notes []int) (c chan *GrepResult, err error) {
+	return z.grepNotes(pattern, notes, false)
+}
+
+// GrepFiles is like Grep, but also searches any text-like files attached
+// to the notes. Results from attachments have the File field set.
+func (z *ZK) GrepFiles(pattern string, notes []int) (c chan *GrepResult, err error) {
+	return z.grepNotes(pattern, notes, true)
+}
+
+func (z *ZK) grepNotes(pattern string, notes []int, files bool) (c chan *GrepResult, err error) {
 	c = make(chan *GrepResult, 1024)
 	results := make(chan *oneGrep)
 
@@ -609,22 +871,17 @@ func (z *ZK) Grep(pattern string, notes []int) (c chan *GrepResult, err error) {
 
 	// Fire off a goroutine for each note
 	for _, n := range toSearch {
-		go z.grep(n, re, results)
+		go z.grep(n, re, files, results)
 	}
 
 	// Now fire the goroutine which relays from those notes to the reader.
 	// We do it like this so we get all results from one note at a time.
 	go func() {
-		nGrep := len(toSearch)
-
-		for g := range results {
+		for nGrep := len(toSearch); nGrep > 0; nGrep-- {
+			g := <-results
 			for r := range g.c {
 				c <- r
 			}
-			nGrep--
-			if nGrep == 0 {
-				break
-			}
 		}
 
 		close(c)
@@ -0,0 +1,803 @@
+// Package zk9p serves a zk as a synthetic 9P2000 file system, so it can
+// be mounted (with v9fs on Linux, or 9pfuse from plan9port) and worked
+// on with ordinary tools. The file system looks like this:
+//
+//	/new              write a body here to create a note under note 0;
+//	                  reading it back afterwards returns the new note's id
+//	/aliases          one "name id" line per alias
+//	/<id>/            a directory per note; aliases may be walked too
+//	/<id>/title       the note's title
+//	/<id>/body        the note's body; writes replace the body when the file is closed
+//	/<id>/ctl         read for metadata; write commands: link <id>, unlink <id>,
+//	                  alias <name>, unalias <name>
+//	/<id>/new         like /new, but creates a subnote of this note
+//	/<id>/subnotes/   one entry per subnote, named by id and containing its title;
+//	                  creating an entry links a note, removing one unlinks it
+//	/<id>/files/      the note's attachments; files may be created, written and removed
+package zk9p
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"9fans.net/go/plan9"
+	zk "github.com/floren/zk/libzk"
+)
+
+const msize = 65536 + plan9.IOHDRSZ
+
+// Kinds of file in the tree
+const (
+	kRoot = iota
+	kRootNew
+	kAliases
+	kNote
+	kTitle
+	kBody
+	kCtl
+	kNew
+	kSubnotes
+	kSubnote
+	kFiles
+	kFile
+)
+
+// A node names one file in the tree.
+type node struct {
+	kind int
+	id   int    // the note, for everything below a note directory
+	name string // subnote id or attachment name
+}
+
+func (n node) isDir() bool {
+	return n.kind == kRoot || n.kind == kNote || n.kind == kSubnotes || n.kind == kFiles
+}
+
+func (n node) qid() plan9.Qid {
+	path := uint64(n.id+1)<<40 | uint64(n.kind)
+	if n.name != "" {
+		h := fnv.New32a()
+		io.WriteString(h, n.name)
+		path |= uint64(h.Sum32()) << 8
+	}
+	q := plan9.Qid{Path: path, Type: plan9.QTFILE}
+	if n.isDir() {
+		q.Type = plan9.QTDIR
+	}
+	return q
+}
+
+// A fid is the server's state for one client fid.
+type fid struct {
+	node  node
+	open  bool
+	mode  uint8
+	dirs  []byte   // directory contents, generated when read from offset 0
+	data  []byte   // snapshot of (or pending writes to) a synthetic file
+	dirty bool     // data must be written back on clunk
+	file  *os.File // attachment being read, or temporary file being written
+	tmp   string   // path of temporary file holding a new attachment
+	newId int      // id of the note created through a "new" file
+}
+
+// Server serves a ZK over 9P.
+type Server struct {
+	z   *zk.ZK
+	mu  sync.Locker
+	uid string
+}
+
+// NewServer returns a Server for the given zk. Every request holds mu
+// while it uses the ZK; pass the same Locker to anything else using the
+// ZK concurrently.
+func NewServer(z *zk.ZK, mu sync.Locker) *Server {
+	if mu == nil {
+		mu = &sync.Mutex{}
+	}
+	uid := os.Getenv("USER")
+	if uid == "" {
+		uid = "zk"
+	}
+	return &Server{z: z, mu: mu, uid: uid}
+}
+
+// Serve accepts connections on the listener and serves each one in a
+// new goroutine. It only returns if the listener fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(c); err != nil && err != io.EOF {
+				log.Printf("9p connection from %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn speaks 9P over a single connection until it is closed.
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+	fids := map[uint32]*fid{}
+	defer func() {
+		s.mu.Lock()
+		for _, f := range fids {
+			s.clunk(f)
+		}
+		s.mu.Unlock()
+	}()
+	for {
+		tx, err := plan9.ReadFcall(rwc)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		// Catch up with anyone else using the zk
+		var rx *plan9.Fcall
+		if err := s.z.Reload(); err != nil {
+			rx = rerror("%v", err)
+		} else {
+			rx = s.handle(fids, tx)
+		}
+		s.mu.Unlock()
+		rx.Tag = tx.Tag
+		if err := plan9.WriteFcall(rwc, rx); err != nil {
+			return err
+		}
+	}
+}
+
+func rerror(format string, args ...interface{}) *plan9.Fcall {
+	return &plan9.Fcall{Type: plan9.Rerror, Ename: fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) handle(fids map[uint32]*fid, tx *plan9.Fcall) *plan9.Fcall {
+	var f *fid
+	switch tx.Type {
+	case plan9.Tversion:
+		for k, f := range fids {
+			s.clunk(f)
+			delete(fids, k)
+		}
+		m := tx.Msize
+		if m > msize {
+			m = msize
+		}
+		if !strings.HasPrefix(tx.Version, "9P2000") {
+			return &plan9.Fcall{Type: plan9.Rversion, Msize: m, Version: "unknown"}
+		}
+		return &plan9.Fcall{Type: plan9.Rversion, Msize: m, Version: "9P2000"}
+	case plan9.Tauth:
+		return rerror("authentication not required")
+	case plan9.Tflush:
+		// Requests are answered in order, so there's nothing to flush
+		return &plan9.Fcall{Type: plan9.Rflush}
+	case plan9.Tattach:
+		if _, ok := fids[tx.Fid]; ok {
+			return rerror("fid in use")
+		}
+		f = &fid{node: node{kind: kRoot}}
+		fids[tx.Fid] = f
+		return &plan9.Fcall{Type: plan9.Rattach, Qid: f.node.qid()}
+	}
+
+	f, ok := fids[tx.Fid]
+	if !ok {
+		return rerror("unknown fid %d", tx.Fid)
+	}
+	switch tx.Type {
+	case plan9.Twalk:
+		return s.walk(fids, f, tx)
+	case plan9.Topen:
+		return s.open(f, tx.Mode)
+	case plan9.Tcreate:
+		return s.create(f, tx)
+	case plan9.Tread:
+		return s.read(f, tx)
+	case plan9.Twrite:
+		return s.write(f, tx)
+	case plan9.Tclunk:
+		delete(fids, tx.Fid)
+		if err := s.clunk(f); err != nil {
+			return rerror("%v", err)
+		}
+		return &plan9.Fcall{Type: plan9.Rclunk}
+	case plan9.Tremove:
+		delete(fids, tx.Fid)
+		s.clunk(f)
+		if err := s.remove(f.node); err != nil {
+			return rerror("%v", err)
+		}
+		return &plan9.Fcall{Type: plan9.Rremove}
+	case plan9.Tstat:
+		d, err := s.stat(f.node)
+		if err != nil {
+			return rerror("%v", err)
+		}
+		b, err := d.Bytes()
+		if err != nil {
+			return rerror("%v", err)
+		}
+		return &plan9.Fcall{Type: plan9.Rstat, Stat: b}
+	case plan9.Twstat:
+		return s.wstat(f, tx)
+	}
+	return rerror("bad message type %d", tx.Type)
+}
+
+func (s *Server) walk(fids map[uint32]*fid, f *fid, tx *plan9.Fcall) *plan9.Fcall {
+	if f.open {
+		return rerror("cannot walk an open fid")
+	}
+	if _, ok := fids[tx.Newfid]; ok && tx.Newfid != tx.Fid {
+		return rerror("fid in use")
+	}
+	n := f.node
+	var qids []plan9.Qid
+	for i, name := range tx.Wname {
+		next, err := s.step(n, name)
+		if err != nil {
+			if i == 0 {
+				return rerror("%v", err)
+			}
+			// A partial walk succeeds, but newfid isn't affected
+			return &plan9.Fcall{Type: plan9.Rwalk, Wqid: qids}
+		}
+		n = next
+		qids = append(qids, n.qid())
+	}
+	fids[tx.Newfid] = &fid{node: n}
+	return &plan9.Fcall{Type: plan9.Rwalk, Wqid: qids}
+}
+
+// step walks from n to the named file inside it.
+func (s *Server) step(n node, name string) (node, error) {
+	if name == ".." {
+		switch n.kind {
+		case kSubnotes, kFiles:
+			return node{kind: kNote, id: n.id}, nil
+		}
+		return node{kind: kRoot}, nil
+	}
+	switch n.kind {
+	case kRoot:
+		switch name {
+		case "new":
+			return node{kind: kRootNew}, nil
+		case "aliases":
+			return node{kind: kAliases}, nil
+		}
+		if id, err := s.z.ResolveNoteId(name); err == nil {
+			if _, err := s.z.GetNoteMeta(id); err == nil {
+				return node{kind: kNote, id: id}, nil
+			}
+		}
+	case kNote:
+		switch name {
+		case "title":
+			return node{kind: kTitle, id: n.id}, nil
+		case "body":
+			return node{kind: kBody, id: n.id}, nil
+		case "ctl":
+			return node{kind: kCtl, id: n.id}, nil
+		case "new":
+			return node{kind: kNew, id: n.id}, nil
+		case "subnotes":
+			return node{kind: kSubnotes, id: n.id}, nil
+		case "files":
+			return node{kind: kFiles, id: n.id}, nil
+		}
+	case kSubnotes:
+		if sn, err := s.z.GetSubnotes(n.id); err == nil {
+			for _, id := range sn {
+				if strconv.Itoa(id) == name {
+					return node{kind: kSubnote, id: n.id, name: name}, nil
+				}
+			}
+		}
+	case kFiles:
+		if _, err := s.z.GetFilePath(n.id, name); err == nil && !strings.Contains(name, "/") {
+			return node{kind: kFile, id: n.id, name: name}, nil
+		}
+	default:
+		return n, fmt.Errorf("not a directory")
+	}
+	return n, fmt.Errorf("%v does not exist", name)
+}
+
+func (s *Server) open(f *fid, mode uint8) *plan9.Fcall {
+	if f.open {
+		return rerror("fid already open")
+	}
+	write := mode&3 == plan9.OWRITE || mode&3 == plan9.ORDWR || mode&plan9.OTRUNC != 0
+	d, err := s.stat(f.node)
+	if err != nil {
+		return rerror("%v", err)
+	}
+	if write && d.Mode&0200 == 0 {
+		return rerror("permission denied")
+	}
+	if f.node.isDir() && mode&3 != plan9.OREAD {
+		return rerror("is a directory")
+	}
+
+	switch f.node.kind {
+	case kBody:
+		if mode&plan9.OTRUNC == 0 {
+			note, err := s.z.GetNote(f.node.id)
+			if err != nil {
+				return rerror("%v", err)
+			}
+			f.data = []byte(note.Body)
+		}
+		f.dirty = mode&plan9.OTRUNC != 0
+	case kFile:
+		p, err := s.z.GetFilePath(f.node.id, f.node.name)
+		if err != nil {
+			return rerror("%v", err)
+		}
+		if write {
+			// Make a copy to work on; it replaces the original on clunk
+			if err := s.startFile(f, p, mode&plan9.OTRUNC != 0); err != nil {
+				return rerror("%v", err)
+			}
+		} else if f.file, err = os.Open(p); err != nil {
+			return rerror("%v", err)
+		}
+	case kTitle, kCtl, kAliases, kSubnote:
+		f.data = s.contents(f.node)
+	}
+	f.open = true
+	f.mode = mode
+	return &plan9.Fcall{Type: plan9.Ropen, Qid: f.node.qid(), Iounit: msize - plan9.IOHDRSZ}
+}
+
+// startFile sets up a temporary file to receive writes to an attachment.
+func (s *Server) startFile(f *fid, orig string, trunc bool) error {
+	tmp, err := ioutil.TempFile("", "zk9p")
+	if err != nil {
+		return err
+	}
+	if orig != "" && !trunc {
+		src, err := os.Open(orig)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		_, err = io.Copy(tmp, src)
+		src.Close()
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	f.file = tmp
+	f.tmp = tmp.Name()
+	f.dirty = true
+	return nil
+}
+
+func (s *Server) create(f *fid, tx *plan9.Fcall) *plan9.Fcall {
+	if f.open {
+		return rerror("fid already open")
+	}
+	if tx.Perm&plan9.DMDIR != 0 {
+		return rerror("cannot create directories")
+	}
+	switch f.node.kind {
+	case kFiles:
+		if tx.Name == "." || tx.Name == ".." || strings.Contains(tx.Name, "/") {
+			return rerror("bad file name %q", tx.Name)
+		}
+		if _, err := s.z.GetFilePath(f.node.id, tx.Name); err == nil {
+			return rerror("%v already exists", tx.Name)
+		}
+		if err := s.startFile(f, "", true); err != nil {
+			return rerror("%v", err)
+		}
+		f.node = node{kind: kFile, id: f.node.id, name: tx.Name}
+	case kSubnotes:
+		child, err := s.z.ResolveNoteId(tx.Name)
+		if err != nil {
+			return rerror("no such note %v", tx.Name)
+		}
+		if err := s.z.LinkNote(f.node.id, child); err != nil {
+			return rerror("%v", err)
+		}
+		f.node = node{kind: kSubnote, id: f.node.id, name: strconv.Itoa(child)}
+		f.data = s.contents(f.node)
+	default:
+		return rerror("permission denied")
+	}
+	f.open = true
+	f.mode = tx.Mode
+	return &plan9.Fcall{Type: plan9.Rcreate, Qid: f.node.qid(), Iounit: msize - plan9.IOHDRSZ}
+}
+
+func (s *Server) read(f *fid, tx *plan9.Fcall) *plan9.Fcall {
+	if !f.open {
+		return rerror("fid not open")
+	}
+	if f.node.isDir() {
+		if tx.Offset == 0 {
+			dirs, err := s.readdir(f.node)
+			if err != nil {
+				return rerror("%v", err)
+			}
+			f.dirs = dirs
+		}
+		// Only return whole entries
+		if tx.Offset >= uint64(len(f.dirs)) {
+			return &plan9.Fcall{Type: plan9.Rread}
+		}
+		b := f.dirs[tx.Offset:]
+		var n int
+		for n < len(b) {
+			sz := int(b[n]) | int(b[n+1])<<8
+			if n+2+sz > int(tx.Count) {
+				break
+			}
+			n += 2 + sz
+		}
+		return &plan9.Fcall{Type: plan9.Rread, Data: b[:n]}
+	}
+
+	switch f.node.kind {
+	case kRootNew, kNew:
+		// Reading back gives the id of the note we created
+		if err := s.finishNew(f); err != nil {
+			return rerror("%v", err)
+		}
+		f.data = []byte(fmt.Sprintf("%d\n", f.newId))
+	case kFile:
+		buf := make([]byte, tx.Count)
+		n, err := f.file.ReadAt(buf, int64(tx.Offset))
+		if err != nil && err != io.EOF {
+			return rerror("%v", err)
+		}
+		return &plan9.Fcall{Type: plan9.Rread, Data: buf[:n]}
+	}
+	if tx.Offset >= uint64(len(f.data)) {
+		return &plan9.Fcall{Type: plan9.Rread}
+	}
+	end := tx.Offset + uint64(tx.Count)
+	if end > uint64(len(f.data)) {
+		end = uint64(len(f.data))
+	}
+	return &plan9.Fcall{Type: plan9.Rread, Data: f.data[tx.Offset:end]}
+}
+
+func (s *Server) write(f *fid, tx *plan9.Fcall) *plan9.Fcall {
+	if !f.open {
+		return rerror("fid not open")
+	}
+	switch f.node.kind {
+	case kCtl:
+		if err := s.ctl(f.node.id, string(tx.Data)); err != nil {
+			return rerror("%v", err)
+		}
+	case kFile:
+		if _, err := f.file.WriteAt(tx.Data, int64(tx.Offset)); err != nil {
+			return rerror("%v", err)
+		}
+	case kBody, kRootNew, kNew:
+		if f.newId != 0 {
+			return rerror("note already created")
+		}
+		end := int(tx.Offset) + len(tx.Data)
+		if end > len(f.data) {
+			f.data = append(f.data, make([]byte, end-len(f.data))...)
+		}
+		copy(f.data[tx.Offset:], tx.Data)
+		f.dirty = true
+	default:
+		return rerror("permission denied")
+	}
+	return &plan9.Fcall{Type: plan9.Rwrite, Count: uint32(len(tx.Data))}
+}
+
+// ctl carries out commands written to a note's ctl file.
+func (s *Server) ctl(id int, cmds string) error {
+	for _, line := range strings.Split(cmds, "\n") {
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if len(args) != 2 {
+			return fmt.Errorf("bad ctl command %q", line)
+		}
+		var err error
+		switch args[0] {
+		case "link", "unlink":
+			var child int
+			if child, err = s.z.ResolveNoteId(args[1]); err != nil {
+				return fmt.Errorf("no such note %v", args[1])
+			}
+			if args[0] == "link" {
+				err = s.z.LinkNote(id, child)
+			} else {
+				err = s.z.UnlinkNote(id, child)
+			}
+		case "alias":
+			err = s.z.AddAlias(id, args[1])
+		case "unalias":
+			if s.z.Aliases()[args[1]] != id {
+				return fmt.Errorf("%v is not an alias for note %d", args[1], id)
+			}
+			s.z.RemoveAlias(args[1])
+		default:
+			return fmt.Errorf("unknown ctl command %q", args[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.z.Sync()
+}
+
+// finishNew creates the note written to a "new" file, if it hasn't been already.
+func (s *Server) finishNew(f *fid) error {
+	if f.newId != 0 || !f.dirty {
+		return nil
+	}
+	parent := 0
+	if f.node.kind == kNew {
+		parent = f.node.id
+	}
+	id, err := s.z.NewNote(parent, string(f.data))
+	if err != nil {
+		return err
+	}
+	f.newId = id
+	f.dirty = false
+	return nil
+}
+
+// clunk writes back any changes made through the fid.
+func (s *Server) clunk(f *fid) (err error) {
+	if f.file != nil {
+		f.file.Close()
+	}
+	if f.tmp != "" {
+		defer os.Remove(f.tmp)
+	}
+	if !f.dirty {
+		return nil
+	}
+	switch f.node.kind {
+	case kBody:
+		err = s.z.UpdateNote(f.node.id, string(f.data))
+	case kRootNew, kNew:
+		err = s.finishNew(f)
+	case kFile:
+		err = s.z.ReplaceFile(f.node.id, f.tmp, f.node.name)
+	}
+	if err == nil {
+		err = s.z.Sync()
+	}
+	return err
+}
+
+func (s *Server) remove(n node) error {
+	switch n.kind {
+	case kSubnote:
+		child, _ := strconv.Atoi(n.name)
+		if err := s.z.UnlinkNote(n.id, child); err != nil {
+			return err
+		}
+		return s.z.Sync()
+	case kFile:
+		return s.z.RemoveFile(n.id, n.name)
+	}
+	return fmt.Errorf("permission denied")
+}
+
+func (s *Server) wstat(f *fid, tx *plan9.Fcall) *plan9.Fcall {
+	d, err := plan9.UnmarshalDir(tx.Stat)
+	if err != nil {
+		return rerror("%v", err)
+	}
+	// The only change we can make is truncation, which some
+	// clients use instead of OTRUNC. Everything else is ignored.
+	if d.Length == 0 {
+		switch f.node.kind {
+		case kBody:
+			if err := s.z.UpdateNote(f.node.id, ""); err != nil {
+				return rerror("%v", err)
+			}
+			f.data = nil
+		case kFile:
+			p, err := s.z.GetFilePath(f.node.id, f.node.name)
+			if err != nil {
+				return rerror("%v", err)
+			}
+			if err := os.Truncate(p, 0); err != nil {
+				return rerror("%v", err)
+			}
+			if f.file != nil && f.tmp != "" {
+				f.file.Truncate(0)
+			}
+		}
+	}
+	return &plan9.Fcall{Type: plan9.Rwstat}
+}
+
+// contents generates the contents of the small synthetic files.
+func (s *Server) contents(n node) []byte {
+	var b bytes.Buffer
+	switch n.kind {
+	case kTitle:
+		md, _ := s.z.GetNoteMeta(n.id)
+		fmt.Fprintf(&b, "%s\n", md.Title)
+	case kSubnote:
+		id, _ := strconv.Atoi(n.name)
+		md, _ := s.z.GetNoteMeta(id)
+		fmt.Fprintf(&b, "%s\n", md.Title)
+	case kCtl:
+		md, _ := s.z.GetNoteMeta(n.id)
+		fmt.Fprintf(&b, "id %d\nparent %d\n", md.Id, md.Parent)
+		for _, name := range s.aliasesFor(n.id) {
+			fmt.Fprintf(&b, "alias %s\n", name)
+		}
+	case kAliases:
+		aliases := s.z.Aliases()
+		var names []string
+		for name := range aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "%s %d\n", name, aliases[name])
+		}
+	}
+	return b.Bytes()
+}
+
+func (s *Server) aliasesFor(id int) []string {
+	var names []string
+	for name, aid := range s.z.Aliases() {
+		if aid == id {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) readdir(n node) ([]byte, error) {
+	var children []node
+	switch n.kind {
+	case kRoot:
+		children = append(children, node{kind: kRootNew}, node{kind: kAliases})
+		var ids []int
+		for id := range s.z.MetadataDump() {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			children = append(children, node{kind: kNote, id: id})
+		}
+	case kNote:
+		for _, k := range []int{kTitle, kBody, kCtl, kNew, kSubnotes, kFiles} {
+			children = append(children, node{kind: k, id: n.id})
+		}
+	case kSubnotes:
+		sn, err := s.z.GetSubnotes(n.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range sn {
+			children = append(children, node{kind: kSubnote, id: n.id, name: strconv.Itoa(id)})
+		}
+	case kFiles:
+		note, err := s.z.GetNote(n.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range note.Files {
+			children = append(children, node{kind: kFile, id: n.id, name: name})
+		}
+	}
+	var b []byte
+	for _, c := range children {
+		d, err := s.stat(c)
+		if err != nil {
+			continue
+		}
+		db, err := d.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, db...)
+	}
+	return b, nil
+}
+
+func (s *Server) stat(n node) (*plan9.Dir, error) {
+	d := &plan9.Dir{
+		Qid:  n.qid(),
+		Uid:  s.uid,
+		Gid:  s.uid,
+		Muid: s.uid,
+	}
+	now := uint32(time.Now().Unix())
+	d.Atime, d.Mtime = now, now
+	if n.isDir() {
+		d.Mode = plan9.DMDIR | 0555
+	} else {
+		d.Mode = 0444
+	}
+
+	names := map[int]string{
+		kRoot: "/", kRootNew: "new", kAliases: "aliases",
+		kTitle: "title", kBody: "body", kCtl: "ctl", kNew: "new",
+		kSubnotes: "subnotes", kFiles: "files",
+	}
+	d.Name = names[n.kind]
+
+	switch n.kind {
+	case kRootNew, kNew:
+		d.Mode = 0666
+	case kCtl:
+		d.Mode = 0666
+		d.Length = uint64(len(s.contents(n)))
+	case kTitle, kSubnote, kAliases:
+		d.Length = uint64(len(s.contents(n)))
+		if n.kind == kSubnote {
+			d.Name = n.name
+		}
+	case kSubnotes, kFiles:
+		d.Mode = plan9.DMDIR | 0755
+	case kNote:
+		if _, err := s.z.GetNoteMeta(n.id); err != nil {
+			return nil, err
+		}
+		d.Name = strconv.Itoa(n.id)
+		if p, err := s.z.GetNoteBodyPath(n.id); err == nil {
+			if fi, err := os.Stat(p); err == nil {
+				d.Mtime = uint32(fi.ModTime().Unix())
+			}
+		}
+	case kBody:
+		p, err := s.z.GetNoteBodyPath(n.id)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		d.Mode = 0666
+		d.Length = uint64(fi.Size())
+		d.Mtime = uint32(fi.ModTime().Unix())
+	case kFile:
+		p, err := s.z.GetFilePath(n.id, n.name)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		d.Name = n.name
+		d.Mode = 0666
+		d.Length = uint64(fi.Size())
+		d.Mtime = uint32(fi.ModTime().Unix())
+	}
+	return d, nil
+}
@@ -0,0 +1,200 @@
+package zk9p
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	zk "github.com/floren/zk/libzk"
+)
+
+// mount starts a server on a new zk and attaches a client to it over a pipe.
+func mount(t *testing.T) (*zk.ZK, *client.Fsys, func()) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zk.InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zk.NewZK(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go NewServer(z, nil).ServeConn(srv)
+	conn, err := client.NewConn(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := conn.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z, fs, func() {
+		fs.Close()
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readFile(t *testing.T, fs *client.Fsys, name string) string {
+	fid, err := fs.Open(name, plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open %v: %v", name, err)
+	}
+	defer fid.Close()
+	b, err := ioutil.ReadAll(fid)
+	if err != nil {
+		t.Fatalf("read %v: %v", name, err)
+	}
+	return string(b)
+}
+
+func writeFile(t *testing.T, fs *client.Fsys, name, data string) {
+	fid, err := fs.Open(name, plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		t.Fatalf("open %v: %v", name, err)
+	}
+	if _, err := fid.Write([]byte(data)); err != nil {
+		t.Fatalf("write %v: %v", name, err)
+	}
+	if err := fid.Close(); err != nil {
+		t.Fatalf("close %v: %v", name, err)
+	}
+}
+
+func dirNames(t *testing.T, fs *client.Fsys, name string) []string {
+	fid, err := fs.Open(name, plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open %v: %v", name, err)
+	}
+	defer fid.Close()
+	dirs, err := fid.Dirreadall()
+	if err != nil {
+		t.Fatalf("read %v: %v", name, err)
+	}
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+func TestNotes(t *testing.T) {
+	z, fs, done := mount(t)
+	defer done()
+
+	// Create a note through /new and read back its id
+	fid, err := fs.Open("/new", plan9.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fid.Write([]byte("Testing\nhello\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 32)
+	n, err := fid.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	fid.Close()
+	if string(b[:n]) != "1\n" {
+		t.Fatalf("Bad id from new: %q", b[:n])
+	}
+
+	if got := strings.Join(dirNames(t, fs, "/"), " "); got != "new aliases 0 1" {
+		t.Fatalf("Bad root directory: %v", got)
+	}
+	if got := readFile(t, fs, "/1/title"); got != "Testing\n" {
+		t.Fatalf("Bad title: %q", got)
+	}
+
+	// Rewrite the body, which should change the title
+	writeFile(t, fs, "/1/body", "Renamed\nnew body\n")
+	if md, _ := z.GetNoteMeta(1); md.Title != "Renamed" {
+		t.Fatalf("Title not updated: %+v", md)
+	}
+	if got := readFile(t, fs, "/1/body"); got != "Renamed\nnew body\n" {
+		t.Fatalf("Bad body: %q", got)
+	}
+
+	// Make a subnote, then unlink and relink it
+	writeFile(t, fs, "/1/new", "Child\n")
+	if got := strings.Join(dirNames(t, fs, "/1/subnotes"), " "); got != "2" {
+		t.Fatalf("Bad subnotes: %v", got)
+	}
+	if got := readFile(t, fs, "/1/subnotes/2"); got != "Child\n" {
+		t.Fatalf("Bad subnote entry: %q", got)
+	}
+	if err := fs.Remove("/1/subnotes/2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(z.GetOrphans()) != 1 {
+		t.Fatal("Removing the entry didn't unlink the note")
+	}
+	fid, err = fs.Create("/0/subnotes/2", plan9.OREAD, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+	if len(z.GetOrphans()) != 0 {
+		t.Fatal("Creating the entry didn't link the note")
+	}
+
+	// Aliases via ctl
+	writeFile(t, fs, "/2/ctl", "alias kid\n")
+	if got := readFile(t, fs, "/aliases"); got != "kid 2\n" {
+		t.Fatalf("Bad aliases: %q", got)
+	}
+	if got := readFile(t, fs, "/kid/title"); got != "Child\n" {
+		t.Fatalf("Couldn't walk alias: %q", got)
+	}
+	if _, err := fs.Open("/17/body", plan9.OREAD); err == nil {
+		t.Fatal("Opened a nonexistent note")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	z, fs, done := mount(t)
+	defer done()
+
+	if _, err := z.NewNote(0, "Attachments\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a file and write it in two pieces
+	fid, err := fs.Create("/1/files/data.txt", plan9.OWRITE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid.Write([]byte("first\n"))
+	fid.Write([]byte("second\n"))
+	if err := fid.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if md, _ := z.GetNoteMeta(1); len(md.Files) != 1 || md.Files[0] != "data.txt" {
+		t.Fatalf("File not attached: %+v", md)
+	}
+	if got := readFile(t, fs, "/1/files/data.txt"); got != "first\nsecond\n" {
+		t.Fatalf("Bad file contents: %q", got)
+	}
+
+	// Overwrite it
+	writeFile(t, fs, "/1/files/data.txt", "replaced\n")
+	if got := readFile(t, fs, "/1/files/data.txt"); got != "replaced\n" {
+		t.Fatalf("Bad file contents: %q", got)
+	}
+
+	if err := fs.Remove("/1/files/data.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if names := dirNames(t, fs, "/1/files"); len(names) != 0 {
+		t.Fatalf("File not removed: %v", names)
+	}
+}
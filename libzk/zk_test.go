@@ -1,9 +1,18 @@
 package zk
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewZK(t *testing.T) {
@@ -266,6 +275,42 @@ func TestFiles(t *testing.T) {
 		t.Fatalf("Couldn't get path to file: %v", err)
 	}
 
+	// Replace its contents
+	if err = z.AddFile(1, f.Name(), "foo"); err == nil {
+		t.Fatal("Added a second file named foo")
+	}
+	// An attachment named like a temporary file is left alone
+	keep, err := ioutil.TempFile("", "keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keep.Name())
+	if _, err = keep.WriteString("kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddFile(1, keep.Name(), "foo.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString("new contents"); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.ReplaceFile(1, f.Name(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"foo": "new contents", "foo.tmp": "kept"} {
+		if p, err := z.GetFilePath(1, name); err != nil {
+			t.Fatal(err)
+		} else if b, err := ioutil.ReadFile(p); err != nil || string(b) != want {
+			t.Fatalf("Got contents %q, %v for %v after replacing", b, err, name)
+		}
+	}
+	if md, err = z.GetNoteMeta(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Files) != 2 {
+		t.Fatalf("Got bad files list after replacing: %v", md.Files)
+	}
+
 	// And remove it
 	if err = z.RemoveFile(1, "foo"); err != nil {
 		t.Fatal(err)
@@ -321,3 +366,1772 @@ And xFFFF*y matches too, as does the title.`
 		t.Fatalf("Got bad results, expected 3 got %v\n", count)
 	}
 }
+
+func TestGrepFiles(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a note with a matching line in the body
+	if _, err = z.NewNote(0, "Testing\nbody xyzzy\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Attach a text file and a binary file, both containing the pattern
+	src := filepath.Join(dir, "src")
+	if err = ioutil.WriteFile(src, []byte("first line\nattached xyzzy\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddFile(1, src, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(src, []byte("\x00\x01\x02xyzzy\x00"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddFile(1, src, "blob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A regular grep should only see the body
+	var r chan *GrepResult
+	if r, err = z.Grep(`xyzzy`, []int{}); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for range r {
+		count++
+	}
+	if count != 1 {
+		t.Fatalf("Got bad results, expected 1 got %v\n", count)
+	}
+
+	// Including files should find the text attachment but not the binary
+	if r, err = z.GrepFiles(`xyzzy`, []int{}); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for res := range r {
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		files = append(files, res.File)
+	}
+	if len(files) != 2 || files[0] != "" || files[1] != "notes.txt" {
+		t.Fatalf("Got bad results: %q", files)
+	}
+
+	// Register an extractor for the binary file and try again
+	RegisterExtractor("", ExtractorFunc(func(r io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(r)
+		return bytes.NewReader(bytes.Trim(b, "\x00\x01\x02")), err
+	}))
+	defer RegisterExtractor("", nil)
+	if r, err = z.TreeGrepFiles(`xyzzy`, 0); err != nil {
+		t.Fatal(err)
+	}
+	count = 0
+	for range r {
+		count++
+	}
+	if count != 3 {
+		t.Fatalf("Got bad results, expected 3 got %v\n", count)
+	}
+}
+
+func TestSavedSearch(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tree looks like this:
+	// 0
+	// 	1 (matches)
+	// 		2 (matches)
+	// 	3
+	// plus 4, an orphan which matches
+	if _, err = z.NewNote(0, "One\nxyzzy\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = z.NewNote(1, "Two\nxyzzy\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = z.NewNote(0, "Three\nplugh\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = z.NewNote(0, "Four\nxyzzy\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.UnlinkNote(0, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ParseSearch("under:0 xyz+y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Tree || s.Root != 0 || s.Pattern != "xyz+y" {
+		t.Fatalf("Bad parsed search: %+v", s)
+	}
+	// Spacing inside the pattern is part of the regular expression
+	if s2, err := ParseSearch("  files:  a  b\tc"); err != nil {
+		t.Fatal(err)
+	} else if !s2.Files || s2.Pattern != "a  b\tc" {
+		t.Fatalf("Bad parsed search: %+v", s2)
+	}
+	id, err := z.NewSavedSearch(3, "Smart", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The smart note matches its own pattern, but shouldn't list itself
+	sn, err := z.GetSubnotes(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sn) != 2 || sn[0] != 1 || sn[1] != 2 {
+		t.Fatalf("Got bad subnotes for smart note: %v", sn)
+	}
+
+	// New matching notes show up without doing anything else
+	if _, err = z.NewNote(3, "Six\nxyzzzzy\n"); err != nil {
+		t.Fatal(err)
+	}
+	if sn, err = z.GetSubnotes(id); err != nil {
+		t.Fatal(err)
+	} else if len(sn) != 3 {
+		t.Fatalf("Got bad subnotes for smart note: %v", sn)
+	}
+
+	// And the search survives a round trip through the metadata file
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	var md NoteMeta
+	if md, err = z.GetNoteMeta(id); err != nil {
+		t.Fatal(err)
+	}
+	if md.Search == nil || md.Search.Pattern != "xyz+y" {
+		t.Fatalf("Saved search was lost: %+v", md)
+	}
+}
+
+func TestRelated(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		"Goroutines\nChannels and goroutines in the scheduler\n",
+		"Gardening\nTomatoes need plenty of sun\n",
+		"Concurrency\nUsing channels to coordinate goroutines\n",
+	} {
+		if _, err = z.NewNote(0, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rel, err := z.Related(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rel) != 1 || rel[0].Note.Id != 3 {
+		t.Fatalf("Got bad related notes: %+v", rel)
+	}
+
+	// Text which isn't a note yet should find the gardening note
+	if rel, err = z.RelatedText("Tomato seedlings\nThey need sun\n", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(rel) == 0 || rel[0].Note.Id != 2 {
+		t.Fatalf("Got bad related notes: %+v", rel)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = z.NewNote(0, "oldhost notes\nssh to oldhost.example.com\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = z.NewNote(0, "Unrelated\nnothing to see here\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run shouldn't change anything
+	changes, err := z.Replace(`oldhost(\.example)?`, "newhost$1", []int{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].New != "newhost notes\nssh to newhost.example.com\n" {
+		t.Fatalf("Bad dry run result: %+v", changes)
+	}
+	if md, _ := z.GetNoteMeta(1); md.Title != "oldhost notes" {
+		t.Fatalf("Dry run changed the note: %+v", md)
+	}
+
+	// Now really do it, and check the title got updated too
+	if _, err = z.Replace(`oldhost(\.example)?`, "newhost$1", []int{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if md, _ := z.GetNoteMeta(1); md.Title != "newhost notes" {
+		t.Fatalf("Title not updated: %+v", md)
+	}
+
+	// And undo it
+	if _, err = z.UndoReplace(); err != nil {
+		t.Fatal(err)
+	}
+	var n Note
+	if n, err = z.GetNote(1); err != nil {
+		t.Fatal(err)
+	}
+	if n.Title != "oldhost notes" || n.Body != "oldhost notes\nssh to oldhost.example.com\n" {
+		t.Fatalf("Undo failed: %+v", n)
+	}
+	if _, err = z.UndoReplace(); err != ErrNoUndo {
+		t.Fatalf("Expected ErrNoUndo, got %v", err)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = z.NewNote(0, "Target\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddAlias(1, "tgt"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := "See [[1]] and [[ tgt | the target ]], but not [[17]] or [single] or [[broken\n]]"
+	refs := ParseReferences(body)
+	if len(refs) != 3 {
+		t.Fatalf("Got bad references: %+v", refs)
+	}
+	if refs[1].Target != "tgt" || refs[1].Label != "the target" || body[refs[1].Start:refs[1].End] != "[[ tgt | the target ]]" {
+		t.Fatalf("Got bad reference: %+v", refs[1])
+	}
+	for i, want := range []int{1, 1, -1} {
+		id, err := z.ResolveReference(refs[i])
+		if want < 0 && err == nil {
+			t.Fatalf("Resolved missing reference %+v to %d", refs[i], id)
+		} else if want >= 0 && (err != nil || id != want) {
+			t.Fatalf("Bad resolution of %+v: %d %v", refs[i], id, err)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	// 1 Runbooks
+	//   2 Deploy: prod, with an attachment
+	//     4 Shared, also under 3
+	//   3 Deploy: prod
+	for _, n := range []struct {
+		parent int
+		body   string
+	}{
+		{0, "Runbooks\n"},
+		{1, "Deploy: prod\nSee [[4|the shared steps]] and ![the diagram](arch%20diagram.png), but not [[0]].\n"},
+		{1, "Deploy: prod\n"},
+		{2, "Shared\nBack to [[2]].\n"},
+	} {
+		if _, err = z.NewNote(n.parent, n.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = z.LinkNote(3, 4); err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dir, "arch diagram.png")
+	if err = ioutil.WriteFile(f, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddFile(2, f, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(p string) string {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	md := filepath.Join(dir, "md")
+	if err = z.Export(1, ExportMarkdown, md); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(filepath.Join(md, "Runbooks", "Deploy- prod", "arch diagram.png")); got != "png" {
+		t.Fatalf("Bad attachment: %q", got)
+	}
+	// The second note with the same title is renamed, and the shared
+	// note only appears under the first
+	if _, err := os.Stat(filepath.Join(md, "Runbooks", "Deploy- prod (3).md")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(md, "Runbooks", "Deploy- prod (3)")); err == nil {
+		t.Fatal("Shared note exported twice")
+	}
+	got := read(filepath.Join(md, "Runbooks", "Deploy- prod.md"))
+	for _, want := range []string{
+		"# Deploy: prod\n",
+		"[the shared steps](Deploy-%20prod/Shared.md)",
+		"![the diagram](Deploy-%20prod/arch%20diagram.png)",
+		"but not Top Level.",
+		"## Sub-notes\n\n- [Shared](Deploy-%20prod/Shared.md)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Exported note missing %q:\n%s", want, got)
+		}
+	}
+	if got := read(filepath.Join(md, "Runbooks", "Deploy- prod (3).md")); !strings.Contains(got, "- [Shared](Deploy-%20prod/Shared.md)") {
+		t.Errorf("Bad link to shared note:\n%s", got)
+	}
+	if got := read(filepath.Join(md, "Runbooks", "Deploy- prod", "Shared.md")); !strings.Contains(got, "Back to [Deploy: prod](../Deploy-%20prod.md).") {
+		t.Errorf("Bad reference:\n%s", got)
+	}
+	want := "# Runbooks\n\n- [Runbooks](Runbooks.md)\n  - [Deploy: prod](Runbooks/Deploy-%20prod.md)\n    - [Shared](Runbooks/Deploy-%20prod/Shared.md)\n  - [Deploy: prod](Runbooks/Deploy-%20prod%20%283%29.md)\n"
+	if got := read(filepath.Join(md, "index.md")); got != want {
+		t.Errorf("Bad index:\n%s", got)
+	}
+
+	// The destination has to be empty
+	if err = z.Export(1, ExportMarkdown, md); err == nil {
+		t.Fatal("Exported over an existing export")
+	}
+
+	html := filepath.Join(dir, "html")
+	if err = z.Export(1, ExportHTML, html); err != nil {
+		t.Fatal(err)
+	}
+	got = read(filepath.Join(html, "Runbooks", "Deploy- prod.html"))
+	for _, want := range []string{
+		"<title>Deploy: prod</title>",
+		`<a href="../index.html">Index</a>`,
+		`<a href="Deploy-%20prod/Shared.html">the shared steps</a>`,
+		`<img alt="the diagram" src="Deploy-%20prod/arch%20diagram.png">`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Exported page missing %q:\n%s", want, got)
+		}
+	}
+	if got := read(filepath.Join(html, "index.html")); !strings.Contains(got, `<a href="Runbooks/Deploy-%20prod/Shared.html">Shared</a>`) {
+		t.Errorf("Bad index:\n%s", got)
+	}
+}
+
+func TestImportMarkdown(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+
+	vault := filepath.Join(dir, "vault")
+	files := map[string]string{
+		"Welcome.md":             "# Welcome\nSee [[Ideas]], [the plan](Projects/Plan.md#goals) and [[plan|our plan]].\n![[diagram.png]] ![photo](assets/photo%201.jpg) [[Missing]] [web](https://example.com)\n",
+		"Ideas.md":               "---\ntags: x\n---\nBack to [[Welcome]].\n",
+		"Projects/Projects.md":   "About the projects\n",
+		"Projects/Plan.md":       "# The Plan\n![](../assets/photo 1.jpg)\n",
+		"assets/diagram.png":     "png",
+		"assets/photo 1.jpg":     "jpg",
+		".obsidian/workspace.md": "hidden",
+	}
+	for name, contents := range files {
+		p := filepath.Join(vault, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created, err := z.ImportMarkdown(vault, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ideas, Projects (from Projects.md), Plan, Welcome
+	if len(created) != 4 {
+		t.Fatalf("Created %v", created)
+	}
+	byTitle := make(map[string]Note)
+	for _, id := range created {
+		n, err := z.GetNote(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byTitle[n.Title] = n
+	}
+	ideas, projects, plan, welcome := byTitle["Ideas"], byTitle["Projects"], byTitle["The Plan"], byTitle["Welcome"]
+	if ideas.Parent != 0 || projects.Parent != 0 || plan.Parent != projects.Id || welcome.Parent != 0 {
+		t.Fatalf("Bad tree: %+v", byTitle)
+	}
+	if want := "Ideas\n\n---\ntags: x\n---\nBack to [[" + strconv.Itoa(welcome.Id) + "]].\n"; ideas.Body != want {
+		t.Fatalf("Bad body %q, wanted %q", ideas.Body, want)
+	}
+	if want := "Projects\n\nAbout the projects\n"; projects.Body != want {
+		t.Fatalf("Bad body %q, wanted %q", projects.Body, want)
+	}
+	want := fmt.Sprintf("Welcome\nSee [[%d]], [[%d|the plan]] and [[%d|our plan]].\n![diagram.png](diagram.png) ![photo](photo%%201.jpg) [[Missing]] [web](https://example.com)\n", ideas.Id, plan.Id, plan.Id)
+	if welcome.Body != want {
+		t.Fatalf("Bad body %q, wanted %q", welcome.Body, want)
+	}
+	if len(welcome.Files) != 2 || len(plan.Files) != 1 || plan.Body != "The Plan\n![](photo%201.jpg)\n" {
+		t.Fatalf("Bad attachments: %+v %+v", welcome.NoteMeta, plan)
+	}
+
+	// Importing again only brings in new files
+	if err := ioutil.WriteFile(filepath.Join(vault, "Projects", "Later.md"), []byte("See [[Welcome]]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if created, err = z.ImportMarkdown(vault, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 {
+		t.Fatalf("Re-import created %v", created)
+	}
+	if n, _ := z.GetNote(created[0]); n.Parent != projects.Id || n.Body != fmt.Sprintf("Later\n\nSee [[%d]]\n", welcome.Id) {
+		t.Fatalf("Bad re-imported note: %+v", n)
+	}
+}
+
+func TestOrg(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+
+	// org -> zk -> org gives back the same file
+	org := `#+TITLE: Emacs notes
+#+FILETAGS: :emacs:
+Some preamble.
+
+* TODO Learn org :learning:emacs:
+:PROPERTIES:
+:CREATED: 2017-01-01
+:END:
+Section text
+,* not a heading
+
+** Sub-heading
+More text
+* Second
+`
+	file := filepath.Join(dir, "notes.org")
+	if err = ioutil.WriteFile(file, []byte(org), 0644); err != nil {
+		t.Fatal(err)
+	}
+	created, err := z.ImportOrg(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 4 {
+		t.Fatalf("Created %v", created)
+	}
+	learn, err := z.GetNote(created[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "TODO Learn org\nTags: :learning:emacs:\n:PROPERTIES:\n:CREATED: 2017-01-01\n:END:\nSection text\n* not a heading\n\n"
+	if learn.Parent != created[0] || learn.Body != want {
+		t.Fatalf("Bad note %+v, wanted body %q", learn, want)
+	}
+	if md, _ := z.GetNoteMeta(created[2]); md.Title != "Sub-heading" || md.Parent != created[1] {
+		t.Fatalf("Bad sub-heading: %+v", md)
+	}
+	if md, _ := z.GetNoteMeta(created[3]); md.Title != "Second" || md.Parent != created[0] {
+		t.Fatalf("Bad second heading: %+v", md)
+	}
+	var b bytes.Buffer
+	if err = z.WriteOrg(created[0], &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != org {
+		t.Fatalf("Round trip changed the file:\n%s", b.String())
+	}
+
+	// zk -> org -> zk gives back the same notes
+	top, _ := z.NewNote(0, "Top\n")
+	a, _ := z.NewNote(top, "A\n* a Markdown list\n,* with a comma\n")
+	z.NewNote(a, "A.1\nTags: :x:\n")
+	z.NewNote(top, "B")
+	// The file from before isn't overwritten
+	if err = z.Export(top, ExportOrg, file); err == nil {
+		t.Fatal("Export overwrote an existing file")
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != org {
+		t.Fatalf("Export changed an existing file: %q, %v", b, err)
+	}
+	if err = os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.Export(top, ExportOrg, file); err != nil {
+		t.Fatal(err)
+	}
+	if created, err = z.ImportOrg(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	var tree func(id int) string
+	tree = func(id int) string {
+		n, _ := z.GetNote(id)
+		s := n.Body
+		if !strings.HasSuffix(s, "\n") {
+			s += "\n"
+		}
+		for _, sn := range n.Subnotes {
+			s += "{" + tree(sn) + "}"
+		}
+		return s
+	}
+	if got, want := tree(created[0]), tree(top); got != want {
+		t.Fatalf("Round trip gave %q, wanted %q", got, want)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+	id, err := z.NewNote(0, "Backed up\nbody text\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "attachment")
+	if err = ioutil.WriteFile(src, []byte("attached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddFile(id, src, ""); err != nil {
+		t.Fatal(err)
+	}
+	// An attachment named like a temporary file is still backed up
+	if err = z.AddFile(id, src, "draft.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddAlias(id, "backed"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = z.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	manifest, err := VerifyBackup(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Notes != 2 {
+		t.Fatalf("manifest has %d notes, expected 2", manifest.Notes)
+	}
+
+	// A restored zk matches the original
+	restored := filepath.Join(dir, "restored")
+	if _, err = Restore(bytes.NewReader(archive), restored); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewZK(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := r.GetNote(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Body != "Backed up\nbody text\n" || len(note.Files) != 2 {
+		t.Fatalf("restored note is wrong: %+v", note)
+	}
+	for _, name := range note.Files {
+		if p, err := r.GetFilePath(id, name); err != nil {
+			t.Fatal(err)
+		} else if b, err := ioutil.ReadFile(p); err != nil || string(b) != "attached" {
+			t.Fatalf("restored attachment %v is wrong: %q, %v", name, b, err)
+		}
+	}
+	if got, err := r.ResolveNoteId("backed"); err != nil || got != id {
+		t.Fatalf("alias resolves to %d, %v", got, err)
+	}
+
+	// It won't restore over an existing zk
+	if _, err = Restore(bytes.NewReader(archive), restored); err == nil {
+		t.Fatal("restored into a non-empty directory")
+	}
+
+	// Damaged or incomplete backups are refused and leave nothing
+	damaged := append([]byte(nil), archive...)
+	damaged[len(damaged)/2] ^= 0xff
+	for name, b := range map[string][]byte{"damaged": damaged, "truncated": archive[:len(archive)-100]} {
+		if _, err = VerifyBackup(bytes.NewReader(b)); err == nil {
+			t.Fatalf("%v backup verified", name)
+		}
+		dest := filepath.Join(dir, name)
+		if _, err = Restore(bytes.NewReader(b), dest); err == nil {
+			t.Fatalf("%v backup restored", name)
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Fatalf("%v backup left %v behind", name, dest)
+		}
+	}
+	if contents, _ := ioutil.ReadDir(dir); len(contents) != 3 {
+		t.Fatalf("restores left temporary files: %v", contents)
+	}
+}
+
+func TestDump(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(name string) *ZK {
+		if err := InitZK(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		z, err := NewZK(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return z
+	}
+	z := open("zk")
+	a, err := z.NewNote(0, "A\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := z.NewNote(a, fmt.Sprintf("B\nsee [[%d|A]] and [[%d]]\n", a, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "attachment")
+	if err = ioutil.WriteFile(src, []byte("attached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddFile(b, src, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddAlias(b, "bee"); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err = z.Dump(&dump, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading into an empty zk gives back the same zk, whether the
+	// files are in the dump or beside it
+	files := filepath.Join(dir, "files")
+	var referenced bytes.Buffer
+	if err = z.Dump(&referenced, files); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(referenced.Bytes(), dump.Bytes()) || !strings.Contains(referenced.String(), `"Path"`) {
+		t.Fatalf("files weren't referenced: %s", referenced.String())
+	}
+	for i, d := range []*bytes.Buffer{&dump, &referenced} {
+		c := open(fmt.Sprintf("copy%d", i))
+		if err = c.Load(bytes.NewReader(d.Bytes()), files); err != nil {
+			t.Fatal(err)
+		}
+		var again bytes.Buffer
+		if err = c.Dump(&again, ""); err != nil {
+			t.Fatal(err)
+		}
+		if again.String() != dump.String() {
+			t.Fatalf("loaded zk dumps as\n%s\nexpected\n%s", again.String(), dump.String())
+		}
+		if err = c.Load(bytes.NewReader(d.Bytes()), files); err == nil {
+			t.Fatal("loaded into a zk which wasn't empty")
+		}
+	}
+
+	// Loading under a note gives new ids
+	o := open("other")
+	under, err := o.NewNote(0, "Imports\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.AddAlias(under, "bee"); err != nil {
+		t.Fatal(err)
+	}
+	ids, renamed, err := o.LoadUnder(bytes.NewReader(dump.Bytes()), under, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || len(renamed) != 1 || renamed["bee"] != "bee-2" {
+		t.Fatalf("got ids %v, renamed %v", ids, renamed)
+	}
+	if got, err := o.ResolveNoteId("bee-2"); err != nil || got != ids[b] {
+		t.Fatalf("bee-2 resolves to %d, %v", got, err)
+	}
+	subnotes, err := o.GetSubnotes(under)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnotes) != 1 || subnotes[0] != ids[0] {
+		t.Fatalf("%d has subnotes %v, expected [%d]", under, subnotes, ids[0])
+	}
+	note, err := o.GetNote(ids[b])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Parent != ids[a] || len(note.Files) != 1 {
+		t.Fatalf("loaded note is wrong: %+v", note)
+	}
+	if want := fmt.Sprintf("B\nsee [[%d|A]] and [[%d]]\n", ids[a], ids[0]); note.Body != want {
+		t.Fatalf("loaded body is %q, expected %q", note.Body, want)
+	}
+
+	if _, _, err = o.LoadUnder(strings.NewReader("{\"note\":{}}\n"), under, ""); err == nil {
+		t.Fatal("loaded a dump with no header")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(name string) *ZK {
+		if err := InitZK(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		z, err := NewZK(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return z
+	}
+	z := open("zk")
+	mine, err := z.NewNote(0, "Mine\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddAlias(mine, "todo"); err != nil {
+		t.Fatal(err)
+	}
+
+	other := open("other")
+	// Both zks have a note 1
+	theirs, err := other.NewNote(0, "Theirs\nsee [[todo]] and [[0|the top]]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theirs != mine {
+		t.Fatalf("expected the same ids in both zks, got %d and %d", mine, theirs)
+	}
+	sub, err := other.NewNote(theirs, "Sub\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "attachment")
+	if err = ioutil.WriteFile(src, []byte("attached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = other.AddFile(sub, src, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = other.AddAlias(theirs, "todo"); err != nil {
+		t.Fatal(err)
+	}
+	if err = other.AddAlias(sub, "sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, renamed, err := z.Merge(other, mine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || len(renamed) != 1 || renamed["todo"] != "todo-2" {
+		t.Fatalf("got ids %v, renamed %v", ids, renamed)
+	}
+	if subnotes, _ := z.GetSubnotes(mine); len(subnotes) != 1 || subnotes[0] != ids[0] {
+		t.Fatalf("%d has subnotes %v, expected [%d]", mine, subnotes, ids[0])
+	}
+	for alias, id := range map[string]int{"todo": mine, "todo-2": ids[theirs], "sub": ids[sub]} {
+		if got, err := z.ResolveNoteId(alias); err != nil || got != id {
+			t.Fatalf("%v resolves to %d, %v; expected %d", alias, got, err, id)
+		}
+	}
+	note, err := z.GetNote(ids[theirs])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("Theirs\nsee [[todo-2]] and [[%d|the top]]\n", ids[0]); note.Body != want {
+		t.Fatalf("merged body is %q, expected %q", note.Body, want)
+	}
+	if note.Parent != ids[0] || len(note.Subnotes) != 1 || note.Subnotes[0] != ids[sub] {
+		t.Fatalf("merged note is wrong: %+v", note)
+	}
+	if p, err := z.GetFilePath(ids[sub], "attachment"); err != nil {
+		t.Fatal(err)
+	} else if b, err := ioutil.ReadFile(p); err != nil || string(b) != "attached" {
+		t.Fatalf("merged attachment is wrong: %q, %v", b, err)
+	}
+
+	// The other zk is untouched
+	if note, err := other.GetNote(theirs); err != nil || note.Body != "Theirs\nsee [[todo]] and [[0|the top]]\n" {
+		t.Fatalf("other zk changed: %+v, %v", note, err)
+	}
+	if _, _, err = z.Merge(z, 0); err == nil {
+		t.Fatal("merged a zk into itself")
+	}
+}
+
+func TestUniqueIds(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b := NewUID(), NewUID()
+	if len(a) != 26 || !isUID(a) || a == b {
+		t.Fatalf("bad unique ids %v and %v", a, b)
+	}
+
+	if err = InitZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+	old, err := z.NewNote(0, "Old\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md, _ := z.GetNoteMeta(old); md.UID != "" || z.RefTarget(old) != strconv.Itoa(old) {
+		t.Fatalf("note got a unique id before they were enabled: %+v", md)
+	}
+	if err = z.EnableUniqueIds(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := z.NewNote(0, "New\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, old, id} {
+		md, _ := z.GetNoteMeta(n)
+		if !isUID(md.UID) {
+			t.Fatalf("note %d has unique id %q", n, md.UID)
+		}
+		for _, s := range []string{md.UID, strings.ToLower(md.UID)} {
+			if got, err := z.ResolveNoteId(s); err != nil || got != n {
+				t.Fatalf("%v resolves to %d, %v; expected %d", s, got, err, n)
+			}
+		}
+		if got, err := z.ResolveReference(ParseReferences("[[" + z.RefTarget(n) + "]]")[0]); err != nil || got != n {
+			t.Fatalf("reference to %d resolves to %d, %v", n, got, err)
+		}
+	}
+	if _, err = z.ResolveNoteId(NewUID()); err == nil {
+		t.Fatal("resolved a unique id nothing has")
+	}
+
+	// The ids and the setting survive reopening the zk
+	if z, err = NewZK(filepath.Join(dir, "zk")); err != nil {
+		t.Fatal(err)
+	}
+	md, _ := z.GetNoteMeta(id)
+	if !z.UniqueIds() || md.UID == "" {
+		t.Fatal("unique ids were lost on reopening")
+	}
+
+	// Merging a copy of the zk gives the copies new unique ids, so each
+	// still names one note, and references follow them
+	if err = z.UpdateNote(old, fmt.Sprintf("Old\nsee [[%s]]\n", md.UID)); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err = z.Dump(&dump, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = InitZK(filepath.Join(dir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewZK(filepath.Join(dir, "copy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Load(&dump, ""); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, _ := c.GetNoteMeta(id); cmd.UID != md.UID || !c.UniqueIds() {
+		t.Fatalf("loaded note has unique id %q, expected %q", cmd.UID, md.UID)
+	}
+	ids, _, err := z.Merge(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, _ := z.GetNoteMeta(ids[id])
+	if merged.UID == "" || merged.UID == md.UID {
+		t.Fatalf("merged note has unique id %q, original %q", merged.UID, md.UID)
+	}
+	note, err := z.GetNote(ids[old])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("Old\nsee [[%s]]\n", merged.UID); note.Body != want {
+		t.Fatalf("merged body is %q, expected %q", note.Body, want)
+	}
+}
+
+func TestSync(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(filepath.Join(dir, "laptop")); err != nil {
+		t.Fatal(err)
+	}
+	var a *ZK
+	if a, err = NewZK(filepath.Join(dir, "laptop")); err != nil {
+		t.Fatal(err)
+	}
+	top, err := a.NewNote(0, "Projects\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := a.NewNote(top, "Garden\nplant beans\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.EnableUniqueIds(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The workstation starts as a copy of the laptop
+	var buf bytes.Buffer
+	if err = a.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Restore(&buf, filepath.Join(dir, "workstation")); err != nil {
+		t.Fatal(err)
+	}
+	var b *ZK
+	if b, err = NewZK(filepath.Join(dir, "workstation")); err != nil {
+		t.Fatal(err)
+	}
+	inStep := func() {
+		t.Helper()
+		as, err := a.SyncState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := b.SyncState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if as.Token != bs.Token {
+			t.Fatalf("zks differ after sync:\n%+v\n%+v", as, bs)
+		}
+	}
+	res, err := a.SyncWith(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sent != 0 || res.Received != 0 {
+		t.Fatalf("identical zks exchanged notes: %+v", res)
+	}
+	inStep()
+
+	// Changes on either side go to the other
+	if err = a.UpdateNote(top, "Projects\nfor 2017\n"); err != nil {
+		t.Fatal(err)
+	}
+	bsub, err := b.ResolveNoteId(b.RefTarget(sub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bnew, err := b.NewNote(bsub, "Tomatoes\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.UpdateNote(0, fmt.Sprintf("Top Level\nsee [[%d]]\n", bnew)); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "attachment")
+	if err = ioutil.WriteFile(src, []byte("attached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.AddFile(bsub, src, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.AddAlias(bnew, "tomatoes"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.LinkNote(0, sub); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = a.SyncWith(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %+v", res)
+	}
+	inStep()
+	anew, err := a.ResolveNoteId("tomatoes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := a.GetNote(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(note.Files) != 1 || len(note.Subnotes) != 1 || note.Subnotes[0] != anew {
+		t.Fatalf("laptop's note is wrong: %+v", note)
+	}
+	if subnotes, _ := b.GetSubnotes(0); len(subnotes) != 2 {
+		t.Fatalf("workstation's top level has subnotes %v", subnotes)
+	}
+	// The reference to the new note was numeric, and now works in both
+	root, err := a.GetNote(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := ParseReferences(root.Body)
+	if len(refs) != 1 {
+		t.Fatalf("laptop's top level is %q", root.Body)
+	}
+	if id, err := a.ResolveReference(refs[0]); err != nil || id != anew {
+		t.Fatalf("reference resolves to %d, %v; expected %d", id, err, anew)
+	}
+	// but was only rewritten in the copy sent
+	if note, _ := b.GetNote(0); note.Body != fmt.Sprintf("Top Level\nsee [[%d]]\n", bnew) {
+		t.Fatalf("workstation's top level was changed to %q", note.Body)
+	}
+	if note, _ := b.GetNote(top); note.Body != "Projects\nfor 2017\n" {
+		t.Fatalf("workstation's note is %q", note.Body)
+	}
+
+	// Changing a body on both sides makes a conflict copy
+	if err = a.UpdateNote(sub, "Garden\nplant beans and peas\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.UpdateNote(bsub, "Garden\nplant beans and corn\n"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = b.SyncWith(a); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Conflicts) != 1 {
+		t.Fatalf("expected a conflict, got %+v", res)
+	}
+	inStep()
+	note, err = b.GetNote(bsub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Body != "Garden\nplant beans and corn\n" {
+		t.Fatalf("syncing side's body was replaced by %q", note.Body)
+	}
+	c, err := b.GetNote(res.Conflicts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Body != "Garden (conflict copy)\nplant beans and peas\n" || c.Parent != bsub || c.Conflict != note.UID {
+		t.Fatalf("conflict copy is wrong: %+v", c)
+	}
+
+	// Nothing more to do
+	if res, err = a.SyncWith(b); err != nil {
+		t.Fatal(err)
+	}
+	if res.Sent != 0 || res.Received != 0 {
+		t.Fatalf("synced zks exchanged notes: %+v", res)
+	}
+	if _, err = a.SyncWith(a); err == nil {
+		t.Fatal("synced a zk with itself")
+	}
+
+	// A zk with no notes in common, such as a copy made before unique
+	// ids were enabled, would have every note duplicated
+	if err = InitZK(filepath.Join(dir, "stranger")); err != nil {
+		t.Fatal(err)
+	}
+	var stranger *ZK
+	if stranger, err = NewZK(filepath.Join(dir, "stranger")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stranger.NewNote(0, "Projects\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.SyncWith(stranger); err == nil {
+		t.Fatal("synced zks with no notes in common")
+	}
+}
+
+func TestMergeText(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+	tests := []struct {
+		ours, theirs, merged string
+		clean                bool
+	}{
+		{base, base, base, true},
+		{"one\n2\nthree\nfour\nfive\n", base, "one\n2\nthree\nfour\nfive\n", true},
+		{base, "one\ntwo\nthree\nfour\nfive\nsix\n", "one\ntwo\nthree\nfour\nfive\nsix\n", true},
+		{"one\n2\nthree\nfour\nfive\n", "one\ntwo\nthree\n4\nfive\n", "one\n2\nthree\n4\nfive\n", true},
+		{"zero\none\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nfive\nsix\n", "zero\none\ntwo\nthree\nfour\nfive\nsix\n", true},
+		{"one\ntwo\nthree\nfour\n", "one\ntwo\nthree\nfour\nfive\nsix\n", "one\ntwo\nthree\nfour\n<<<<<<< ours\n=======\nfive\nsix\n>>>>>>> theirs\n", false},
+		{"one\n2\nthree\nfour\nfive\n", "one\n2\nthree\nfour\nfive\n", "one\n2\nthree\nfour\nfive\n", true},
+		{"one\n2\nthree\nfour\nfive\n", "one\nTWO\nthree\nfour\nfive\n", "one\n<<<<<<< ours\n2\n=======\nTWO\n>>>>>>> theirs\nthree\nfour\nfive\n", false},
+		{"one\ntwo\nthree\nfour\nfive", "one\ntwo\nthree\nfour\nFIVE", "one\ntwo\nthree\nfour\n<<<<<<< ours\nfive\n=======\nFIVE\n>>>>>>> theirs\n", false},
+	}
+	for i, tt := range tests {
+		merged, clean := MergeText(base, tt.ours, tt.theirs, "ours", "theirs")
+		if merged != tt.merged || clean != tt.clean {
+			t.Errorf("%d: got %q, %v; expected %q, %v", i, merged, clean, tt.merged, tt.clean)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(filepath.Join(dir, "laptop")); err != nil {
+		t.Fatal(err)
+	}
+	var a *ZK
+	if a, err = NewZK(filepath.Join(dir, "laptop")); err != nil {
+		t.Fatal(err)
+	}
+	id, err := a.NewNote(0, "Garden\nbeans\npeas\ncorn\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.EnableUniqueIds(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = a.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Restore(&buf, filepath.Join(dir, "workstation")); err != nil {
+		t.Fatal(err)
+	}
+	var b *ZK
+	if b, err = NewZK(filepath.Join(dir, "workstation")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.SyncWith(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes to different lines are merged
+	if err = a.UpdateNote(id, "Garden\nbroad beans\npeas\ncorn\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.UpdateNote(id, "Garden\nbeans\npeas\nsweet corn\n"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := a.SyncWith(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Merged != 1 || len(res.Conflicts) != 0 {
+		t.Fatalf("expected a merge, got %+v", res)
+	}
+	for _, z := range []*ZK{a, b} {
+		if note, _ := z.GetNote(id); note.Body != "Garden\nbroad beans\npeas\nsweet corn\n" {
+			t.Fatalf("merged body is %q", note.Body)
+		}
+	}
+
+	// Changes to the same line are a conflict, which can be resolved
+	// on either side
+	if err = a.UpdateNote(id, "Garden\nbroad beans\npeas\nsweet corn\nplant in May\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.UpdateNote(id, "Garden\nbroad beans\npeas\nsweet corn\nplant in April\n"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = a.SyncWith(b); err != nil {
+		t.Fatal(err)
+	}
+	if res.Merged != 0 || len(res.Conflicts) != 1 {
+		t.Fatalf("expected a conflict, got %+v", res)
+	}
+	conflicts, err := b.Conflicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Id != id || len(conflicts[0].Copies) != 1 {
+		t.Fatalf("workstation's conflicts are %+v", conflicts)
+	}
+	merged, clean, err := b.MergeConflict(conflicts[0].Copies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("Garden\nbroad beans\npeas\nsweet corn\n<<<<<<< note %d\nplant in May\n=======\nplant in April\n>>>>>>> conflict copy %d\n", id, conflicts[0].Copies[0])
+	if clean || merged != expected {
+		t.Fatalf("merged conflict is %q, %v", merged, clean)
+	}
+	if err = b.Resolve(id, merged); err != ErrConflictMarkers {
+		t.Fatalf("resolving with conflict markers gave %v", err)
+	}
+	if again, _, err := b.MergeConflict(id); err != nil || again != merged {
+		t.Fatalf("merge so far wasn't kept: %q, %v", again, err)
+	}
+	if err = b.Resolve(id, "Garden\nbroad beans\npeas\nsweet corn\nplant in spring\n"); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts, err = b.Conflicts(); err != nil || len(conflicts) != 0 {
+		t.Fatalf("conflicts remain after resolving: %+v, %v", conflicts, err)
+	}
+	if subnotes, _ := b.GetSubnotes(id); len(subnotes) != 0 {
+		t.Fatalf("conflict copy is still linked: %v", subnotes)
+	}
+	if _, err = b.SyncWith(a); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts, err = a.Conflicts(); err != nil || len(conflicts) != 0 {
+		t.Fatalf("conflicts remain after syncing the resolution: %+v, %v", conflicts, err)
+	}
+
+	// Syncthing's version of a body is merged against the base the
+	// resolution left
+	p, err := a.GetNoteBodyPath(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(filepath.Dir(p), "body.sync-conflict-20170601-120000-ABCDEFG")
+	if err = ioutil.WriteFile(other, []byte("Gardening\nbroad beans\npeas\nsweet corn\nplant in spring\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.UpdateNote(id, "Garden\nbroad beans\npeas\nsweet corn\nplant in spring\nwater daily\n"); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts, err = a.Conflicts(); err != nil || len(conflicts) != 1 || len(conflicts[0].Files) != 1 {
+		t.Fatalf("laptop's conflicts are %+v, %v", conflicts, err)
+	}
+	if merged, clean, err = a.MergeConflict(id); err != nil {
+		t.Fatal(err)
+	}
+	if !clean || merged != "Gardening\nbroad beans\npeas\nsweet corn\nplant in spring\nwater daily\n" {
+		t.Fatalf("merged conflict is %q, %v", merged, clean)
+	}
+	if err = a.Resolve(id, merged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(other); !os.IsNotExist(err) {
+		t.Fatalf("Syncthing's version is still there: %v", err)
+	}
+
+	// As are markers left by git
+	if err = a.UpdateNote(id, "Garden\n<<<<<<< HEAD\nbeans\n=======\npeas\n>>>>>>> origin/master\n"); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts, err = a.Conflicts(); err != nil || len(conflicts) != 1 || !conflicts[0].Markers {
+		t.Fatalf("laptop's conflicts are %+v, %v", conflicts, err)
+	}
+	if _, _, err = a.MergeConflict(0); err == nil {
+		t.Fatal("merged a note without conflicts")
+	}
+}
+
+func TestGitBase(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	id, err := z.NewNote(0, "Garden\nbeans\npeas\ncorn\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(stdin string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	// Leave the note's body unmerged, as a git merge would, with its
+	// current version as the common ancestor
+	body := fmt.Sprintf("%d/body", id)
+	git("", "init", "-q")
+	sha := git("", "hash-object", "-w", body)
+	git(fmt.Sprintf("100644 %s 1\t%s\n", sha, body), "update-index", "--add", "--index-info")
+
+	// With no base file, the versions are merged against git's
+	if err = z.UpdateNote(id, "Garden\nbroad beans\npeas\ncorn\n"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := z.GetNoteBodyPath(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(filepath.Dir(p), "body.sync-conflict-20170601-120000-ABCDEFG")
+	if err = ioutil.WriteFile(other, []byte("Garden\nbeans\npeas\nsweet corn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	merged, clean, err := z.MergeConflict(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clean || merged != "Garden\nbroad beans\npeas\nsweet corn\n" {
+		t.Fatalf("merged conflict is %q, %v", merged, clean)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	id, err := z.NewNote(0, "Garden\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(w *Watcher) WatchEvent {
+		t.Helper()
+		select {
+		case ev := <-w.Events:
+			if ev.Error != nil {
+				t.Fatal(ev.Error)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return WatchEvent{}
+	}
+	var mu sync.Mutex
+	check := func(w *Watcher, title string) {
+		t.Helper()
+		defer w.Close()
+
+		// An editor changes the title
+		p, err := z.GetNoteBodyPath(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte(title+"\nbeans\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ev := next(w)
+		if ev.Op != NoteChanged || ev.Note.Id != id || ev.Note.Title != title {
+			t.Fatalf("expected a title change, got %+v", ev)
+		}
+		mu.Lock()
+		md, _ := z.GetNoteMeta(id)
+		mu.Unlock()
+		if md.Title != title {
+			t.Fatalf("title is still %q", md.Title)
+		}
+		other, err := NewZK(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md, _ := other.GetNoteMeta(id); md.Title != title {
+			t.Fatalf("state file has title %q", md.Title)
+		}
+
+		// Another program adds a note
+		added, err := other.NewNote(id, "Tomatoes\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[int]WatchOp)
+		for len(seen) < 2 {
+			ev = next(w)
+			seen[ev.Note.Id] = ev.Op
+		}
+		if seen[added] != NoteAdded || seen[id] != NoteChanged {
+			t.Fatalf("expected a new note and a new subnote, got %v", seen)
+		}
+		mu.Lock()
+		subnotes, err := z.GetSubnotes(id)
+		mu.Unlock()
+		if err != nil || len(subnotes) == 0 || subnotes[len(subnotes)-1] != added {
+			t.Fatalf("subnotes are %v, %v", subnotes, err)
+		}
+
+		// And a file
+		if err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(added), "files", "seeds.txt"), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if ev = next(w); ev.Note.Id != added || len(ev.Note.Files) != 1 {
+			t.Fatalf("expected a new file, got %+v", ev)
+		}
+
+		// Another program adds an alias, then a note; writing the
+		// new note into the state mustn't lose the alias
+		alias := strings.Replace(title, " ", "-", -1)
+		if err = other.AddAlias(added, alias); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = other.NewNote(0, "Beans\n"); err != nil {
+			t.Fatal(err)
+		}
+		for seen = make(map[int]WatchOp); len(seen) < 2; {
+			ev = next(w)
+			seen[ev.Note.Id] = ev.Op
+		}
+		if fresh, err := NewZK(dir); err != nil {
+			t.Fatal(err)
+		} else if _, err = fresh.ResolveNoteId(alias); err != nil {
+			t.Fatalf("lost the alias: %v", err)
+		}
+
+		// The note is deleted; the links and aliases to it go too
+		if err = os.RemoveAll(filepath.Join(dir, fmt.Sprint(added))); err != nil {
+			t.Fatal(err)
+		}
+		for seen = make(map[int]WatchOp); len(seen) < 2; {
+			ev = next(w)
+			seen[ev.Note.Id] = ev.Op
+		}
+		if seen[added] != NoteRemoved || seen[id] != NoteChanged {
+			t.Fatalf("expected a removed note and a lost subnote, got %v", seen)
+		}
+		mu.Lock()
+		subnotes, _ = z.GetSubnotes(id)
+		_, err = z.ResolveNoteId(alias)
+		mu.Unlock()
+		if len(subnotes) != 0 || err == nil {
+			t.Fatalf("subnotes are %v and alias %v is still there", subnotes, alias)
+		}
+	}
+	w, err := z.Watch(&mu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(w, "Vegetable Garden")
+	if w, err = z.WatchPoll(&mu, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	check(w, "Kitchen Garden")
+}
+
+func TestObservers(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var z *ZK
+	if z, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	remove := z.AddObserver(ObserverFunc(func(e Event) {
+		events = append(events, e)
+	}))
+	id, err := z.NewNote(0, "Garden\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = z.UpdateNote(id, "Vegetable Garden\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AppendNote(id, "beans\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.UnlinkNote(0, id); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.LinkNote(0, id); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddAlias(id, "garden"); err != nil {
+		t.Fatal(err)
+	}
+	z.RemoveAlias("garden")
+	src := filepath.Join(dir, "seeds.txt")
+	if err = ioutil.WriteFile(src, []byte("beans"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.AddFile(id, src, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.RemoveFile(id, "seeds.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Failed changes aren't reported
+	if err = z.UpdateNote(id+1, "nothing\n"); err == nil {
+		t.Fatal("updated a note which doesn't exist")
+	}
+
+	expected := []Event{
+		{Type: EventNew},
+		{Type: EventUpdate},
+		{Type: EventAppend},
+		{Type: EventUnlink},
+		{Type: EventLink},
+		{Type: EventAlias, Alias: "garden"},
+		{Type: EventUnalias, Alias: "garden"},
+		{Type: EventAddFile, File: "seeds.txt"},
+		{Type: EventRemoveFile, File: "seeds.txt"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("got events %+v", events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i].Type || e.Alias != expected[i].Alias || e.File != expected[i].File || e.Parent != 0 || e.Note.Id != id {
+			t.Fatalf("event %d is %+v, expected %+v", i, e, expected[i])
+		}
+	}
+	if events[2].Note.Title != "Vegetable Garden" || len(events[7].Note.Files) != 1 || len(events[8].Note.Files) != 0 {
+		t.Fatalf("events have the wrong metadata: %+v", events)
+	}
+
+	remove()
+	if err = z.AppendNote(id, "peas\n"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("removed observer saw %+v", events[len(expected):])
+	}
+
+	// Notes arriving in a sync are reported too, and reading them out
+	// of the other side changes nothing there
+	if err = InitZK(filepath.Join(dir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	var other *ZK
+	if other, err = NewZK(filepath.Join(dir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	var synced, sent []Event
+	other.AddObserver(ObserverFunc(func(e Event) {
+		synced = append(synced, e)
+	}))
+	z.AddObserver(ObserverFunc(func(e Event) {
+		sent = append(sent, e)
+	}))
+	if _, err = other.SyncWith(z); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("sending notes made events %+v", sent)
+	}
+	if len(synced) != 2 || synced[0].Type != EventNew || synced[0].Note.Title != "Vegetable Garden" || synced[1].Type != EventLink || synced[1].Parent != 0 {
+		t.Fatalf("got sync events %+v", synced)
+	}
+}
+
+func TestShared(t *testing.T) {
+	var err error
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Two programs using the zk at once
+	var a, b *ZK
+	if a, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	one, err := a.NewNote(0, "One\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := b.NewNote(0, "Two\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one == two {
+		t.Fatalf("both notes got id %d", one)
+	}
+	if err = a.AddAlias(one, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.AppendNote(two, "more\n"); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	a.Close()
+
+	// A directory the state doesn't know of is left alone
+	if err = os.Mkdir(filepath.Join(dir, "3"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	var c *ZK
+	if c, err = NewZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if id, err := c.ResolveNoteId("one"); err != nil || id != one {
+		t.Fatalf("alias one: got %v, %v", id, err)
+	}
+	for id, title := range map[int]string{one: "One", two: "Two"} {
+		md, err := c.GetNoteMeta(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Title != title {
+			t.Fatalf("note %d: got title %q, want %q", id, md.Title, title)
+		}
+	}
+	if sn, _ := c.GetSubnotes(0); len(sn) != 2 {
+		t.Fatalf("got subnotes %v", sn)
+	}
+	three, err := c.NewNote(0, "Three\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if three == 3 {
+		t.Fatalf("new note took the existing directory 3")
+	}
+	if err = c.makeNote(3, 0, "Three\n"); err == nil {
+		t.Fatalf("made a note over the existing directory 3")
+	}
+}
@@ -0,0 +1,661 @@
+// Package zkdav serves a zk over WebDAV, so notes can be opened and
+// edited from desktop editors and file managers. The note tree becomes
+// a hierarchy of folders:
+//
+//	/body.md                  the body of note 0
+//	/<attachment>             note 0's attachments
+//	/<title> (<id>)/          a folder for each subnote of note 0, laid out
+//	                          the same way, with its own body.md, attachments
+//	                          and subnote folders
+//
+// Writing body.md updates the note with UpdateNote and writing any other
+// file attaches it with AddFile. Making a folder creates a new note
+// whose title is the folder name; the new folder can be reached by that
+// name as well as by its "<title> (<id>)" name. Notes are never deleted:
+// deleting a folder only unlinks the note from its parent, and deleting
+// body.md does nothing. Moving a folder relinks the note, and retitles it
+// if the folder's name changed.
+package zkdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	zk "github.com/floren/zk/libzk"
+	"golang.org/x/net/webdav"
+)
+
+// BodyName is the name of the file holding each note's body.
+const BodyName = "body.md"
+
+// Kinds of location in the tree
+const (
+	lMissing = iota
+	lNew     // doesn't exist, but could be created in the note
+	lDir
+	lBody
+	lFile
+)
+
+// A loc is a resolved path.
+type loc struct {
+	kind   int
+	id     int    // the note, or for lBody/lFile/lNew, the note containing it
+	parent int    // for lDir, the note whose folder contains this one; -1 at the root
+	name   string // attachment name
+}
+
+// FS implements webdav.FileSystem on top of a ZK.
+type FS struct {
+	z  *zk.ZK
+	mu sync.Locker
+}
+
+// NewFS returns a FileSystem for the given zk. Every operation holds mu
+// while it uses the ZK; pass the same Locker to anything else using the
+// ZK concurrently.
+func NewFS(z *zk.ZK, mu sync.Locker) *FS {
+	if mu == nil {
+		mu = &sync.Mutex{}
+	}
+	return &FS{z: z, mu: mu}
+}
+
+// NewHandler returns a WebDAV handler serving the zk. prefix is the
+// URL path at which it is mounted, if any.
+func NewHandler(z *zk.ZK, mu sync.Locker, prefix string) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: NewFS(z, mu),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+var suffixRe = regexp.MustCompile(`\((\d+)\)$`)
+
+// DirName returns the name of the folder for the given note.
+func DirName(md zk.NoteMeta) string {
+	return fmt.Sprintf("%s (%d)", zk.SafeFileName(md.Title), md.Id)
+}
+
+// child finds the subnote of id named by a path element. seen holds the
+// notes already on the path, which are never entered again. Unless
+// exact is set, the id suffix alone is enough to find the note, since
+// clients hang on to the folder name after the note's title changes.
+func (fs *FS) child(id int, elem string, seen map[int]bool, exact bool) (int, bool) {
+	subnotes, _ := fs.z.GetSubnotes(id)
+	if m := suffixRe.FindStringSubmatch(elem); m != nil {
+		want, _ := strconv.Atoi(m[1])
+		for _, sn := range subnotes {
+			md, _ := fs.z.GetNoteMeta(sn)
+			if sn == want && !seen[sn] && (!exact || elem == DirName(md)) {
+				return sn, true
+			}
+		}
+	}
+	for _, sn := range subnotes {
+		if md, err := fs.z.GetNoteMeta(sn); err == nil && !seen[sn] && zk.SafeFileName(md.Title) == elem {
+			return sn, true
+		}
+	}
+	return 0, false
+}
+
+func hasFile(md zk.NoteMeta, name string) bool {
+	for _, f := range md.Files {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve maps a path to its place in the tree. If only the last
+// element is missing, it returns a loc of kind lNew along with
+// os.ErrNotExist. The last element must name a folder exactly, so
+// renaming a folder doesn't find the folder already in place.
+func (fs *FS) resolve(name string) (loc, error) {
+	l := loc{kind: lDir, parent: -1}
+	seen := map[int]bool{0: true}
+	elems := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if elems[0] == "" {
+		return l, nil
+	}
+	for i, elem := range elems {
+		if l.kind != lDir {
+			return loc{}, os.ErrNotExist
+		}
+		md, err := fs.z.GetNoteMeta(l.id)
+		if err != nil {
+			return loc{}, os.ErrNotExist
+		}
+		if sn, ok := fs.child(l.id, elem, seen, i == len(elems)-1); ok {
+			l = loc{kind: lDir, id: sn, parent: l.id}
+			seen[sn] = true
+		} else if elem == BodyName {
+			l = loc{kind: lBody, id: l.id}
+		} else if hasFile(md, elem) {
+			l = loc{kind: lFile, id: l.id, name: elem}
+		} else if i == len(elems)-1 {
+			return loc{kind: lNew, id: l.id, name: elem}, os.ErrNotExist
+		} else {
+			return loc{}, os.ErrNotExist
+		}
+	}
+	return l, nil
+}
+
+// split resolves the folder containing name, returning it and the last
+// element of name.
+func (fs *FS) split(name string) (loc, string, error) {
+	dir, base := path.Split(path.Clean("/" + name))
+	l, err := fs.resolve(dir)
+	if err != nil {
+		return l, base, err
+	}
+	if l.kind != lDir || base == "" {
+		return l, base, os.ErrInvalid
+	}
+	return l, base, nil
+}
+
+// fileInfo describes an entry in the tree.
+type fileInfo struct {
+	name string
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mod }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType implements webdav.ContentTyper, so bodies are served as
+// Markdown rather than sniffed.
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.name == BodyName {
+		return "text/markdown; charset=utf-8", nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+func (fs *FS) stat(l loc) (os.FileInfo, error) {
+	md, err := fs.z.GetNoteMeta(l.id)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	p, err := fs.z.GetNoteBodyPath(l.id)
+	if err != nil {
+		return nil, err
+	}
+	switch l.kind {
+	case lFile:
+		p, err = fs.z.GetFilePath(l.id, l.name)
+		if err != nil {
+			return nil, err
+		}
+	case lNew:
+		return nil, os.ErrNotExist
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	fi := &fileInfo{size: st.Size(), mod: st.ModTime()}
+	switch l.kind {
+	case lDir:
+		fi.name, fi.size, fi.dir = DirName(md), 0, true
+		if l.parent < 0 {
+			fi.name = "/"
+		}
+	case lBody:
+		fi.name = BodyName
+	case lFile:
+		fi.name = l.name
+	}
+	return fi, nil
+}
+
+// list returns the contents of a note's folder: the body, the subnote
+// folders, then the attachments. Attachments whose names clash with
+// anything else are hidden.
+func (fs *FS) list(l loc, seen map[int]bool) ([]os.FileInfo, error) {
+	md, err := fs.z.GetNoteMeta(l.id)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	var fis []os.FileInfo
+	taken := map[string]bool{BodyName: true}
+	if fi, err := fs.stat(loc{kind: lBody, id: l.id}); err == nil {
+		fis = append(fis, fi)
+	}
+	subnotes, _ := fs.z.GetSubnotes(l.id)
+	for _, sn := range subnotes {
+		if seen[sn] {
+			continue
+		}
+		if fi, err := fs.stat(loc{kind: lDir, id: sn, parent: l.id}); err == nil {
+			fis = append(fis, fi)
+			md, _ := fs.z.GetNoteMeta(sn)
+			taken[fi.Name()] = true
+			taken[zk.SafeFileName(md.Title)] = true
+		}
+	}
+	for _, f := range md.Files {
+		if taken[f] {
+			continue
+		}
+		if fi, err := fs.stat(loc{kind: lFile, id: l.id, name: f}); err == nil {
+			fis = append(fis, fi)
+		}
+	}
+	return fis, nil
+}
+
+// ancestors returns the notes on the path to name, which its folder
+// listing must leave out.
+func (fs *FS) ancestors(name string) map[int]bool {
+	seen := map[int]bool{0: true}
+	id := 0
+	for _, elem := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if elem == "" {
+			break
+		}
+		sn, ok := fs.child(id, elem, seen, false)
+		if !ok {
+			break
+		}
+		seen[sn] = true
+		id = sn
+	}
+	return seen
+}
+
+func (fs *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.z.Reload(); err != nil {
+		return nil, err
+	}
+	l, err := fs.resolve(name)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return fs.stat(l)
+}
+
+func (fs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.z.Reload(); err != nil {
+		return err
+	}
+	if _, err := fs.resolve(name); err == nil {
+		return os.ErrExist
+	}
+	parent, title, err := fs.split(name)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.z.NewNote(parent.id, title+"\n"); err != nil {
+		return err
+	}
+	return fs.z.Sync()
+}
+
+func (fs *FS) RemoveAll(ctx context.Context, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.z.Reload(); err != nil {
+		return err
+	}
+	l, err := fs.resolve(name)
+	if err != nil {
+		// Like os.RemoveAll, removing nothing succeeds
+		return nil
+	}
+	switch l.kind {
+	case lDir:
+		if l.parent < 0 {
+			return os.ErrPermission
+		}
+		// Notes are never deleted, just unlinked
+		err = fs.z.UnlinkNote(l.parent, l.id)
+	case lFile:
+		err = fs.z.RemoveFile(l.id, l.name)
+	default:
+		// Every note has a body. Removing it does nothing, so that
+		// editors can save by moving a new version over it.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fs.z.Sync()
+}
+
+func (fs *FS) Rename(ctx context.Context, oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.z.Reload(); err != nil {
+		return err
+	}
+	src, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	dst, base, err := fs.split(newName)
+	if err != nil {
+		return err
+	}
+	switch src.kind {
+	case lDir:
+		err = fs.moveNote(src, dst.id, base)
+	case lFile:
+		err = fs.moveFile(src, dst.id, base)
+	default:
+		return os.ErrPermission
+	}
+	if err != nil {
+		return err
+	}
+	return fs.z.Sync()
+}
+
+// moveNote moves a note's folder to the folder of note parent, and
+// retitles it if the folder name no longer matches the title.
+func (fs *FS) moveNote(src loc, parent int, base string) error {
+	if src.parent < 0 {
+		return os.ErrPermission
+	}
+	if parent != src.parent {
+		sub, err := fs.z.Subtree(src.id)
+		if err != nil {
+			return err
+		}
+		for _, id := range sub {
+			if id == parent {
+				return fmt.Errorf("cannot move note %d beneath itself", src.id)
+			}
+		}
+		if err := fs.z.LinkNote(parent, src.id); err != nil {
+			return err
+		}
+		if err := fs.z.UnlinkNote(src.parent, src.id); err != nil {
+			return err
+		}
+	}
+
+	md, err := fs.z.GetNoteMeta(src.id)
+	if err != nil {
+		return err
+	}
+	title := base
+	if base == DirName(md) {
+		return nil
+	} else if m := suffixRe.FindStringSubmatchIndex(base); m != nil && base[m[2]:m[3]] == strconv.Itoa(src.id) {
+		title = strings.TrimSpace(base[:m[0]])
+	}
+	if title == zk.SafeFileName(md.Title) {
+		return nil
+	}
+	note, err := fs.z.GetNote(src.id)
+	if err != nil {
+		return err
+	}
+	body := title + "\n"
+	if i := strings.IndexByte(note.Body, '\n'); i >= 0 {
+		body += note.Body[i+1:]
+	}
+	return fs.z.UpdateNote(src.id, body)
+}
+
+// moveFile moves an attachment to the note id. Moving a file onto
+// body.md replaces the note's body with it, which is how many editors
+// save.
+func (fs *FS) moveFile(src loc, id int, base string) error {
+	if src.id == id && src.name == base {
+		return nil
+	}
+	p, err := fs.z.GetFilePath(src.id, src.name)
+	if err != nil {
+		return err
+	}
+	if base == BodyName {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := fs.z.UpdateNote(id, string(b)); err != nil {
+			return err
+		}
+	} else if err := fs.z.AddFile(id, p, base); err != nil {
+		return err
+	}
+	return fs.z.RemoveFile(src.id, src.name)
+}
+
+func (fs *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.z.Reload(); err != nil {
+		return nil, err
+	}
+	l, err := fs.resolve(name)
+	if err != nil && !(l.kind == lNew && flag&os.O_CREATE != 0) {
+		return nil, os.ErrNotExist
+	}
+	if err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+
+	switch {
+	case l.kind == lDir:
+		if write {
+			return nil, os.ErrPermission
+		}
+		fi, err := fs.stat(l)
+		if err != nil {
+			return nil, err
+		}
+		fis, err := fs.list(l, fs.ancestors(name))
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{info: fi, entries: fis}, nil
+	case write:
+		return fs.openWriter(l, flag)
+	}
+
+	fi, err := fs.stat(l)
+	if err != nil {
+		return nil, err
+	}
+	if l.kind == lBody {
+		note, err := fs.z.GetNote(l.id)
+		if err != nil {
+			return nil, err
+		}
+		return &readFile{ReadSeeker: strings.NewReader(note.Body), info: fi}, nil
+	}
+	p, err := fs.z.GetFilePath(l.id, l.name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &readFile{ReadSeeker: f, Closer: f, info: fi}, nil
+}
+
+// openWriter returns a file which collects writes to a body or
+// attachment in a temporary file, and applies them when it is closed.
+func (fs *FS) openWriter(l loc, flag int) (webdav.File, error) {
+	tmp, err := ioutil.TempFile("", "zkdav")
+	if err != nil {
+		return nil, err
+	}
+	w := &writeFile{File: tmp, fs: fs, loc: l, name: l.name}
+	if l.kind == lBody {
+		w.name = BodyName
+	}
+	if flag&os.O_TRUNC == 0 && l.kind != lNew {
+		// Start from the current contents
+		var r io.Reader
+		if l.kind == lBody {
+			var note zk.Note
+			if note, err = fs.z.GetNote(l.id); err == nil {
+				r = strings.NewReader(note.Body)
+			}
+		} else {
+			r, err = fs.z.GetFileReader(l.id, l.name)
+			if c, ok := r.(io.Closer); ok {
+				defer c.Close()
+			}
+		}
+		if err == nil {
+			_, err = io.Copy(tmp, r)
+		}
+		if err == nil && flag&os.O_APPEND == 0 {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// writeFile is a body or attachment open for writing.
+type writeFile struct {
+	*os.File
+	fs   *FS
+	loc  loc
+	name string
+}
+
+func (w *writeFile) Stat() (os.FileInfo, error) {
+	st, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: w.name, size: st.Size(), mod: st.ModTime()}, nil
+}
+
+func (w *writeFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// Close writes the new contents back into the zk.
+func (w *writeFile) Close() error {
+	defer os.Remove(w.File.Name())
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	z := w.fs.z
+	switch w.loc.kind {
+	case lBody:
+		b, err := ioutil.ReadFile(w.File.Name())
+		if err != nil {
+			return err
+		}
+		if err := z.UpdateNote(w.loc.id, string(b)); err != nil {
+			return err
+		}
+	default:
+		if err := z.ReplaceFile(w.loc.id, w.File.Name(), w.name); err != nil {
+			return err
+		}
+	}
+	return z.Sync()
+}
+
+// readFile is a body or attachment open for reading.
+type readFile struct {
+	io.ReadSeeker
+	io.Closer
+	info os.FileInfo
+}
+
+func (r *readFile) Stat() (os.FileInfo, error) { return r.info, nil }
+
+func (r *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (r *readFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (r *readFile) Close() error {
+	if r.Closer != nil {
+		return r.Closer.Close()
+	}
+	return nil
+}
+
+// dirFile is a note's folder. Its contents are read when it is opened.
+type dirFile struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+	pos     int
+}
+
+func (d *dirFile) Stat() (os.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *dirFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *dirFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		d.pos = 0
+		return 0, nil
+	}
+	return 0, os.ErrInvalid
+}
+
+func (d *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.entries[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.pos += count
+	return rest[:count], nil
+}
@@ -0,0 +1,157 @@
+package zkdav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+func newTestServer(t *testing.T) (*zk.ZK, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zk.InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zk.NewZK(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(z, nil, ""))
+	return z, srv, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func do(t *testing.T, method, url, body string, hdr map[string]string, code int) string {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != code {
+		t.Fatalf("%v %v: expected status %d, got %d: %s", method, url, code, resp.StatusCode, b)
+	}
+	return string(b)
+}
+
+var hrefRe = regexp.MustCompile(`<D:href>([^<]*)</D:href>`)
+
+// list returns the hrefs in a depth 1 PROPFIND of the url.
+func list(t *testing.T, url string) []string {
+	var hrefs []string
+	b := do(t, "PROPFIND", url, "", map[string]string{"Depth": "1"}, http.StatusMultiStatus)
+	for _, m := range hrefRe.FindAllStringSubmatch(b, -1) {
+		hrefs = append(hrefs, m[1])
+	}
+	return hrefs
+}
+
+func TestNotes(t *testing.T) {
+	z, srv, done := newTestServer(t)
+	defer done()
+
+	// MKCOL creates a note, reachable by its title or full folder name
+	do(t, "MKCOL", srv.URL+"/Groceries", "", nil, http.StatusCreated)
+	if md, err := z.GetNoteMeta(1); err != nil || md.Title != "Groceries" || md.Parent != 0 {
+		t.Fatalf("Bad new note: %+v %v", md, err)
+	}
+	if got := do(t, "GET", srv.URL+"/Groceries/body.md", "", nil, http.StatusOK); got != "Groceries\n" {
+		t.Fatalf("Bad body: %q", got)
+	}
+
+	// Writing the body updates the note, including its title
+	do(t, "PUT", srv.URL+"/Groceries%20(1)/body.md", "Shopping\neggs\n", nil, http.StatusCreated)
+	if md, _ := z.GetNoteMeta(1); md.Title != "Shopping" {
+		t.Fatalf("Title not updated: %+v", md)
+	}
+	want := []string{"/", "/body.md", "/Shopping%20%281%29/"}
+	if got := list(t, srv.URL+"/"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("Bad listing: %v", got)
+	}
+
+	// The old folder name still works thanks to the id suffix
+	if got := do(t, "GET", srv.URL+"/Groceries%20(1)/body.md", "", nil, http.StatusOK); got != "Shopping\neggs\n" {
+		t.Fatalf("Bad body: %q", got)
+	}
+
+	// Renaming the folder retitles the note
+	do(t, "MOVE", srv.URL+"/Shopping%20(1)/", "", map[string]string{"Destination": srv.URL + "/Errands%20(1)/"}, http.StatusCreated)
+	if note, _ := z.GetNote(1); note.Body != "Errands\neggs\n" {
+		t.Fatalf("Bad body after rename: %q", note.Body)
+	}
+
+	// Moving it under another note relinks it
+	do(t, "MKCOL", srv.URL+"/Projects", "", nil, http.StatusCreated)
+	do(t, "MOVE", srv.URL+"/Errands%20(1)", "", map[string]string{"Destination": srv.URL + "/Projects%20(2)/Errands%20(1)"}, http.StatusCreated)
+	if md, _ := z.GetNoteMeta(2); len(md.Subnotes) != 1 || md.Subnotes[0] != 1 {
+		t.Fatalf("Note not linked: %+v", md)
+	}
+	if md, _ := z.GetNoteMeta(0); len(md.Subnotes) != 1 || md.Subnotes[0] != 2 {
+		t.Fatalf("Note not unlinked: %+v", md)
+	}
+
+	// Deleting a folder only unlinks the note
+	do(t, "DELETE", srv.URL+"/Projects%20(2)/Errands%20(1)", "", nil, http.StatusNoContent)
+	if len(z.GetOrphans()) != 1 {
+		t.Fatal("Note not unlinked")
+	}
+	if _, err := z.GetNote(1); err != nil {
+		t.Fatal(err)
+	}
+	do(t, "GET", srv.URL+"/Nothing%20(17)/body.md", "", nil, http.StatusNotFound)
+}
+
+func TestFiles(t *testing.T) {
+	z, srv, done := newTestServer(t)
+	defer done()
+	if _, err := z.NewNote(0, "Attachments\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	do(t, "PUT", srv.URL+"/Attachments%20(1)/data.txt", "first\n", nil, http.StatusCreated)
+	if md, _ := z.GetNoteMeta(1); len(md.Files) != 1 || md.Files[0] != "data.txt" {
+		t.Fatalf("File not attached: %+v", md)
+	}
+	do(t, "PUT", srv.URL+"/Attachments%20(1)/data.txt", "second\n", nil, http.StatusCreated)
+	if got := do(t, "GET", srv.URL+"/Attachments%20(1)/data.txt", "", nil, http.StatusOK); got != "second\n" {
+		t.Fatalf("Bad file contents: %q", got)
+	}
+	want := []string{"/Attachments%20%281%29/", "/Attachments%20%281%29/body.md", "/Attachments%20%281%29/data.txt"}
+	if got := list(t, srv.URL+"/Attachments%20(1)/"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("Bad listing: %v", got)
+	}
+
+	// Editors often save by writing a temporary file and moving it over the original
+	do(t, "PUT", srv.URL+"/Attachments%20(1)/.body.md.swp", "Attachments\nsaved\n", nil, http.StatusCreated)
+	do(t, "MOVE", srv.URL+"/Attachments%20(1)/.body.md.swp", "", map[string]string{"Destination": srv.URL + "/Attachments%20(1)/body.md", "Overwrite": "T"}, http.StatusNoContent)
+	note, _ := z.GetNote(1)
+	if note.Body != "Attachments\nsaved\n" || len(note.Files) != 1 {
+		t.Fatalf("Bad note after save: %+v", note)
+	}
+
+	do(t, "DELETE", srv.URL+"/Attachments%20(1)/data.txt", "", nil, http.StatusNoContent)
+	if md, _ := z.GetNoteMeta(1); len(md.Files) != 0 {
+		t.Fatalf("File not removed: %+v", md)
+	}
+	do(t, "DELETE", srv.URL+"/Attachments%20(1)/body.md", "", nil, http.StatusNoContent)
+	if got := do(t, "GET", srv.URL+"/Attachments%20(1)/body.md", "", nil, http.StatusOK); got != note.Body {
+		t.Fatalf("Body was removed: %q", got)
+	}
+}
@@ -0,0 +1,97 @@
+package zkhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+// SyncClient is a zk.SyncPeer for a zk served by a Handler, so a local
+// zk can be synced with one on another machine.
+type SyncClient struct {
+	// URL is the root of the API, e.g. http://host:8080/api.
+	URL    string
+	Client *http.Client
+}
+
+// NewSyncClient returns a SyncClient for the API at the given URL. A
+// URL with no path is taken to be a zk serve, with the API at /api.
+func NewSyncClient(rawurl string) (*SyncClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%v isn't an http URL", rawurl)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/api"
+	}
+	return &SyncClient{URL: strings.TrimSuffix(u.String(), "/"), Client: http.DefaultClient}, nil
+}
+
+// SyncState implements zk.SyncPeer.
+func (c *SyncClient) SyncState() (s zk.SyncState, err error) {
+	err = c.do(http.MethodGet, "/sync", nil, &s)
+	return s, err
+}
+
+// SyncNotes implements zk.SyncPeer.
+func (c *SyncClient) SyncNotes(keys []string) (notes []zk.SyncNote, err error) {
+	if keys == nil {
+		keys = []string{}
+	}
+	err = c.do(http.MethodPost, "/sync/notes", keys, &notes)
+	return notes, err
+}
+
+// SyncApply implements zk.SyncPeer.
+func (c *SyncClient) SyncApply(changes zk.SyncChanges) error {
+	return c.do(http.MethodPost, "/sync/apply", changes, nil)
+}
+
+func (c *SyncClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e Error
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			return fmt.Errorf("%v %v: %v", method, c.URL+path, resp.Status)
+		}
+		switch {
+		case e.Error == zk.ErrNoUniqueIds.Error():
+			return zk.ErrNoUniqueIds
+		case resp.StatusCode == http.StatusConflict:
+			return zk.ErrSyncChanged
+		}
+		return fmt.Errorf("%v", e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,546 @@
+// Package zkhttp serves a zk over HTTP as a JSON REST API.
+//
+// All note resources live under /notes/:
+//
+//	GET    /notes                         all notes' metadata
+//	POST   /notes?parent=<id>             create a note; the request body is the note body
+//	GET    /notes/<id>                    metadata and body
+//	PUT    /notes/<id>                    replace the body
+//	GET    /notes/<id>/meta               metadata only
+//	GET    /notes/<id>/body               body as text/plain
+//	PUT    /notes/<id>/body               replace the body
+//	POST   /notes/<id>/append             append the request body to the note
+//	GET    /notes/<id>/subnotes           subnotes' metadata
+//	PUT    /notes/<id>/subnotes/<child>   link child under the note
+//	DELETE /notes/<id>/subnotes/<child>   unlink child from the note
+//	GET    /notes/<id>/files              names of attached files
+//	GET    /notes/<id>/files/<name>       download an attachment
+//	PUT    /notes/<id>/files/<name>       upload an attachment
+//	DELETE /notes/<id>/files/<name>       remove an attachment
+//	GET    /aliases                       map of alias names to note ids
+//	PUT    /aliases/<name>                point an alias at the note id in the request body
+//	DELETE /aliases/<name>                remove an alias
+//	GET    /grep?q=<re>[&root=<id>][&files=1]  search note bodies
+//	GET    /orphans                       notes with no parents
+//	GET    /sync                          zk.SyncState, for syncing; 409 if the zk has no unique ids
+//	POST   /sync/notes                    zk.SyncNotes for the JSON list of keys in the request body
+//	POST   /sync/apply                    zk.SyncApply for the JSON zk.SyncChanges in the request body
+//
+// Wherever a note id is expected, an alias may be used instead.
+//
+// The /sync resources let another zk sync with this one; see
+// zk.SyncWith and SyncClient.
+//
+// Responses describing a note carry an ETag which changes whenever the
+// note's body or metadata do. Requests which modify a note honor
+// If-Match, failing with 412 Precondition Failed if the note has changed.
+//
+// Requests other than GET which a browser says came from another site
+// fail with 403 Forbidden, so other web pages can't change the zk.
+package zkhttp
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	zk "github.com/floren/zk/libzk"
+	"github.com/floren/zk/libzk/internal/origin"
+)
+
+// Version is the API version; it is returned in the X-Zk-Api-Version header.
+const Version = 1
+
+// Handler serves the REST API for a single ZK. The ZK type is not safe
+// for concurrent use, so Handler serializes all requests; to use the ZK
+// elsewhere while the Handler is serving, hold the Handler's lock.
+type Handler struct {
+	z  *zk.ZK
+	mu sync.Mutex
+}
+
+// NewHandler returns an http.Handler serving the given zk.
+func NewHandler(z *zk.ZK) *Handler {
+	return &Handler{z: z}
+}
+
+// Error is the body of every unsuccessful response.
+type Error struct {
+	Error string
+}
+
+// GrepResult is the JSON form of zk.GrepResult.
+type GrepResult struct {
+	Note  zk.NoteMeta
+	File  string `json:",omitempty"`
+	Line  string
+	Error string `json:",omitempty"`
+}
+
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &httpError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// Lock locks the Handler, making it safe to use its ZK. Handler
+// implements sync.Locker so it can be shared with other users of the ZK.
+func (h *Handler) Lock() {
+	h.mu.Lock()
+}
+
+// Unlock unlocks the Handler.
+func (h *Handler) Unlock() {
+	h.mu.Unlock()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Zk-Api-Version", strconv.Itoa(Version))
+	if !origin.Safe(r) && !origin.Same(r) {
+		writeJSON(w, http.StatusForbidden, Error{Error: "cross-site request refused"})
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// Catch up with anyone else using the zk
+	if err := h.z.Reload(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, Error{Error: err.Error()})
+		return
+	}
+	var err error
+	switch parts[0] {
+	case "notes":
+		err = h.notes(w, r, parts[1:])
+	case "aliases":
+		err = h.aliases(w, r, parts[1:])
+	case "grep":
+		err = h.grep(w, r)
+	case "sync":
+		err = h.sync(w, r, parts[1:])
+	case "orphans":
+		if r.Method != http.MethodGet {
+			err = errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+		} else {
+			writeJSON(w, http.StatusOK, h.z.GetOrphans())
+		}
+	default:
+		err = errorf(http.StatusNotFound, "no such resource %v", r.URL.Path)
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if he, ok := err.(*httpError); ok {
+			code = he.code
+		}
+		writeJSON(w, code, Error{Error: err.Error()})
+		return
+	}
+	// Don't let the state file fall behind while we run
+	h.z.Sync()
+}
+
+func (h *Handler) notes(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) == 0 || parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			var notes []zk.NoteMeta
+			for _, md := range h.z.MetadataDump() {
+				notes = append(notes, md)
+			}
+			sort.Slice(notes, func(i, j int) bool { return notes[i].Id < notes[j].Id })
+			writeJSON(w, http.StatusOK, notes)
+			return nil
+		case http.MethodPost:
+			return h.newNote(w, r)
+		}
+		return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+	}
+
+	id, err := h.resolve(parts[0])
+	if err != nil {
+		return err
+	}
+	var sub string
+	if len(parts) > 1 {
+		sub = parts[1]
+	}
+	switch sub {
+	case "", "meta", "body":
+		return h.note(w, r, id, sub)
+	case "append":
+		if r.Method != http.MethodPost {
+			return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+		}
+		if err := h.checkMatch(r, id); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "couldn't read request: %v", err)
+		}
+		if err := h.z.AppendNote(id, string(b)); err != nil {
+			return err
+		}
+		return h.writeNote(w, id, "", http.StatusOK)
+	case "subnotes":
+		return h.subnotes(w, r, id, parts[2:])
+	case "files":
+		return h.files(w, r, id, parts[2:])
+	}
+	return errorf(http.StatusNotFound, "no such resource %v", r.URL.Path)
+}
+
+func (h *Handler) newNote(w http.ResponseWriter, r *http.Request) error {
+	parent := 0
+	if p := r.URL.Query().Get("parent"); p != "" {
+		var err error
+		if parent, err = h.resolve(p); err != nil {
+			return err
+		}
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "couldn't read request: %v", err)
+	}
+	id, err := h.z.NewNote(parent, string(b))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", fmt.Sprintf("/notes/%d", id))
+	return h.writeNote(w, id, "", http.StatusCreated)
+}
+
+func (h *Handler) note(w http.ResponseWriter, r *http.Request, id int, sub string) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			if note, err := h.z.GetNote(id); err == nil && match == etag(note) {
+				w.Header().Set("ETag", match)
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+		return h.writeNote(w, id, sub, http.StatusOK)
+	case http.MethodPut:
+		if sub == "meta" {
+			break
+		}
+		if err := h.checkMatch(r, id); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "couldn't read request: %v", err)
+		}
+		if err := h.z.UpdateNote(id, string(b)); err != nil {
+			return err
+		}
+		return h.writeNote(w, id, sub, http.StatusOK)
+	}
+	return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+}
+
+// writeNote writes the note, or just its body or metadata, along with its ETag.
+func (h *Handler) writeNote(w http.ResponseWriter, id int, sub string, code int) error {
+	note, err := h.z.GetNote(id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag(note))
+	switch sub {
+	case "meta":
+		writeJSON(w, code, note.NoteMeta)
+	case "body":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		io.WriteString(w, note.Body)
+	default:
+		writeJSON(w, code, note)
+	}
+	return nil
+}
+
+func (h *Handler) subnotes(w http.ResponseWriter, r *http.Request, id int, parts []string) error {
+	if len(parts) == 0 || parts[0] == "" {
+		if r.Method != http.MethodGet {
+			return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+		}
+		ids, err := h.z.GetSubnotes(id)
+		if err != nil {
+			return err
+		}
+		subnotes := []zk.NoteMeta{}
+		for _, sn := range ids {
+			if md, err := h.z.GetNoteMeta(sn); err == nil {
+				subnotes = append(subnotes, md)
+			}
+		}
+		writeJSON(w, http.StatusOK, subnotes)
+		return nil
+	}
+
+	child, err := h.resolve(parts[0])
+	if err != nil {
+		return err
+	}
+	if err := h.checkMatch(r, id); err != nil {
+		return err
+	}
+	switch r.Method {
+	case http.MethodPut:
+		err = h.z.LinkNote(id, child)
+	case http.MethodDelete:
+		err = h.z.UnlinkNote(id, child)
+	default:
+		return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+	}
+	if err != nil {
+		return err
+	}
+	return h.writeNote(w, id, "meta", http.StatusOK)
+}
+
+func (h *Handler) files(w http.ResponseWriter, r *http.Request, id int, parts []string) error {
+	if len(parts) == 0 || parts[0] == "" {
+		if r.Method != http.MethodGet {
+			return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+		}
+		note, err := h.z.GetNote(id)
+		if err != nil {
+			return err
+		}
+		files := note.Files
+		if files == nil {
+			files = []string{}
+		}
+		writeJSON(w, http.StatusOK, files)
+		return nil
+	}
+	name := strings.Join(parts, "/")
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return errorf(http.StatusBadRequest, "bad file name %q", name)
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		p, err := h.z.GetFilePath(id, name)
+		if err != nil {
+			return errorf(http.StatusNotFound, "%v", err)
+		}
+		// ServeFile handles ranges and streams the file for us
+		http.ServeFile(w, r, p)
+		return nil
+	case http.MethodPut:
+		if err := h.checkMatch(r, id); err != nil {
+			return err
+		}
+		// AddFile wants a path, so spool the upload to a temporary file
+		tmp, err := ioutil.TempFile("", "zkupload")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, r.Body)
+		tmp.Close()
+		if err != nil {
+			return errorf(http.StatusBadRequest, "couldn't read upload: %v", err)
+		}
+		if err := h.z.ReplaceFile(id, tmp.Name(), filepath.Base(name)); err != nil {
+			return err
+		}
+		return h.writeNote(w, id, "meta", http.StatusCreated)
+	case http.MethodDelete:
+		if err := h.checkMatch(r, id); err != nil {
+			return err
+		}
+		if err := h.z.RemoveFile(id, name); err != nil {
+			return errorf(http.StatusNotFound, "%v", err)
+		}
+		return h.writeNote(w, id, "meta", http.StatusOK)
+	}
+	return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+}
+
+func (h *Handler) aliases(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) == 0 || parts[0] == "" {
+		if r.Method != http.MethodGet {
+			return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+		}
+		writeJSON(w, http.StatusOK, h.z.Aliases())
+		return nil
+	}
+	name := parts[0]
+	switch r.Method {
+	case http.MethodGet:
+		id, ok := h.z.Aliases()[name]
+		if !ok {
+			return errorf(http.StatusNotFound, "no such alias %v", name)
+		}
+		writeJSON(w, http.StatusOK, id)
+	case http.MethodPut:
+		var id int
+		if err := json.NewDecoder(r.Body).Decode(&id); err != nil {
+			return errorf(http.StatusBadRequest, "request body must be a note id: %v", err)
+		}
+		if _, err := h.z.GetNoteMeta(id); err != nil {
+			return errorf(http.StatusNotFound, "%v", err)
+		}
+		if err := h.z.AddAlias(id, name); err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, id)
+	case http.MethodDelete:
+		if _, ok := h.z.Aliases()[name]; !ok {
+			return errorf(http.StatusNotFound, "no such alias %v", name)
+		}
+		h.z.RemoveAlias(name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+	}
+	return nil
+}
+
+func (h *Handler) grep(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+	}
+	q := r.URL.Query()
+	files := q.Get("files") != "" && q.Get("files") != "0"
+	var c chan *zk.GrepResult
+	var err error
+	if root := q.Get("root"); root != "" {
+		var id int
+		if id, err = h.resolve(root); err != nil {
+			return err
+		}
+		if files {
+			c, err = h.z.TreeGrepFiles(q.Get("q"), id)
+		} else {
+			c, err = h.z.TreeGrep(q.Get("q"), id)
+		}
+	} else if files {
+		c, err = h.z.GrepFiles(q.Get("q"), []int{})
+	} else {
+		c, err = h.z.Grep(q.Get("q"), []int{})
+	}
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	results := []GrepResult{}
+	for res := range c {
+		gr := GrepResult{Note: res.Note, File: res.File, Line: res.Line}
+		if res.Error != nil {
+			gr.Error = res.Error.Error()
+		}
+		results = append(results, gr)
+	}
+	writeJSON(w, http.StatusOK, results)
+	return nil
+}
+
+func (h *Handler) sync(w http.ResponseWriter, r *http.Request, parts []string) error {
+	var sub string
+	if len(parts) > 0 {
+		sub = parts[0]
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		s, err := h.z.SyncState()
+		if err == zk.ErrNoUniqueIds {
+			return errorf(http.StatusConflict, "%v", err)
+		} else if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, s)
+	case sub == "notes" && r.Method == http.MethodPost:
+		var keys []string
+		if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+			return errorf(http.StatusBadRequest, "request body must be a list of keys: %v", err)
+		}
+		notes, err := h.z.SyncNotes(keys)
+		if err != nil {
+			return errorf(http.StatusNotFound, "%v", err)
+		}
+		if notes == nil {
+			notes = []zk.SyncNote{}
+		}
+		writeJSON(w, http.StatusOK, notes)
+	case sub == "apply" && r.Method == http.MethodPost:
+		var c zk.SyncChanges
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			return errorf(http.StatusBadRequest, "request body must be changes: %v", err)
+		}
+		if err := h.z.SyncApply(c); err == zk.ErrSyncChanged {
+			return errorf(http.StatusConflict, "%v", err)
+		} else if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case sub == "" || sub == "notes" || sub == "apply":
+		return errorf(http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+	default:
+		return errorf(http.StatusNotFound, "no such resource %v", r.URL.Path)
+	}
+	return nil
+}
+
+func (h *Handler) resolve(name string) (int, error) {
+	id, err := h.z.ResolveNoteId(name)
+	if err != nil {
+		return 0, errorf(http.StatusNotFound, "no such note %v", name)
+	}
+	if _, err := h.z.GetNoteMeta(id); err != nil {
+		return 0, errorf(http.StatusNotFound, "%v", err)
+	}
+	return id, nil
+}
+
+// checkMatch enforces an If-Match header, if the client sent one.
+func (h *Handler) checkMatch(r *http.Request, id int) error {
+	match := r.Header.Get("If-Match")
+	if match == "" || match == "*" {
+		return nil
+	}
+	note, err := h.z.GetNote(id)
+	if err != nil {
+		return err
+	}
+	for _, tag := range strings.Split(match, ",") {
+		if strings.TrimSpace(tag) == etag(note) {
+			return nil
+		}
+	}
+	return errorf(http.StatusPreconditionFailed, "note %d has been modified", id)
+}
+
+// etag derives an entity tag from everything about a note.
+func etag(note zk.Note) string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(note)
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
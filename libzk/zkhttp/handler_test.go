@@ -0,0 +1,242 @@
+package zkhttp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zk.InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zk.NewZK(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(z))
+	return srv, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func do(t *testing.T, method, url, body string, hdr map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func decode(t *testing.T, resp *http.Response, code int, v interface{}) {
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("Expected status %d, got %d: %s", code, resp.StatusCode, b)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNotes(t *testing.T) {
+	srv, done := newTestServer(t)
+	defer done()
+
+	// Create a note under 0
+	var note zk.Note
+	decode(t, do(t, "POST", srv.URL+"/notes?parent=0", "Testing\nhello\n", nil), http.StatusCreated, &note)
+	if note.Id != 1 || note.Title != "Testing" {
+		t.Fatalf("Bad new note: %+v", note)
+	}
+
+	// But not by another web page
+	decode(t, do(t, "POST", srv.URL+"/notes?parent=0", "Forged\n", map[string]string{"Sec-Fetch-Site": "cross-site"}), http.StatusForbidden, nil)
+
+	// It should be a subnote of 0
+	var subnotes []zk.NoteMeta
+	decode(t, do(t, "GET", srv.URL+"/notes/0/subnotes", "", nil), http.StatusOK, &subnotes)
+	if len(subnotes) != 1 || subnotes[0].Id != 1 {
+		t.Fatalf("Bad subnotes: %+v", subnotes)
+	}
+
+	// Get the ETag, then update with it
+	resp := do(t, "GET", srv.URL+"/notes/1", "", nil)
+	tag := resp.Header.Get("ETag")
+	decode(t, resp, http.StatusOK, nil)
+	if tag == "" {
+		t.Fatal("No ETag")
+	}
+	decode(t, do(t, "GET", srv.URL+"/notes/1", "", map[string]string{"If-None-Match": tag}), http.StatusNotModified, nil)
+	decode(t, do(t, "PUT", srv.URL+"/notes/1", "Updated\n", map[string]string{"If-Match": tag}), http.StatusOK, &note)
+	if note.Title != "Updated" {
+		t.Fatalf("Bad updated note: %+v", note)
+	}
+
+	// The old ETag should now be rejected
+	decode(t, do(t, "POST", srv.URL+"/notes/1/append", "more\n", map[string]string{"If-Match": tag}), http.StatusPreconditionFailed, nil)
+	decode(t, do(t, "POST", srv.URL+"/notes/1/append", "more\n", nil), http.StatusOK, &note)
+	if note.Body != "Updated\nmore\n" {
+		t.Fatalf("Bad appended body: %q", note.Body)
+	}
+
+	// Unlink and check for orphans
+	decode(t, do(t, "DELETE", srv.URL+"/notes/0/subnotes/1", "", nil), http.StatusOK, nil)
+	var orphans []zk.NoteMeta
+	decode(t, do(t, "GET", srv.URL+"/orphans", "", nil), http.StatusOK, &orphans)
+	if len(orphans) != 1 || orphans[0].Id != 1 {
+		t.Fatalf("Bad orphans: %+v", orphans)
+	}
+
+	decode(t, do(t, "GET", srv.URL+"/notes/17", "", nil), http.StatusNotFound, nil)
+}
+
+func TestAliasesFilesGrep(t *testing.T) {
+	srv, done := newTestServer(t)
+	defer done()
+
+	decode(t, do(t, "POST", srv.URL+"/notes", "Todo\nbuy milk\n", nil), http.StatusCreated, nil)
+	decode(t, do(t, "PUT", srv.URL+"/aliases/todo", "1", nil), http.StatusOK, nil)
+
+	// Aliases work in place of ids
+	var note zk.Note
+	decode(t, do(t, "GET", srv.URL+"/notes/todo", "", nil), http.StatusOK, &note)
+	if note.Id != 1 {
+		t.Fatalf("Alias resolved to the wrong note: %+v", note)
+	}
+
+	// Upload, list and download a file
+	decode(t, do(t, "PUT", srv.URL+"/notes/todo/files/list.txt", "eggs\nmilk\n", nil), http.StatusCreated, nil)
+	var files []string
+	decode(t, do(t, "GET", srv.URL+"/notes/1/files", "", nil), http.StatusOK, &files)
+	if len(files) != 1 || files[0] != "list.txt" {
+		t.Fatalf("Bad file list: %v", files)
+	}
+	resp := do(t, "GET", srv.URL+"/notes/1/files/list.txt", "", nil)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "eggs\nmilk\n" {
+		t.Fatalf("Bad file contents: %q", b)
+	}
+
+	// Grep should find the body, and the file if asked
+	var results []GrepResult
+	decode(t, do(t, "GET", srv.URL+"/grep?q=milk&files=1", "", nil), http.StatusOK, &results)
+	if len(results) != 2 || results[1].File != "list.txt" {
+		t.Fatalf("Bad grep results: %+v", results)
+	}
+	decode(t, do(t, "GET", srv.URL+"/grep?q=(", "", nil), http.StatusBadRequest, nil)
+
+	decode(t, do(t, "DELETE", srv.URL+"/notes/1/files/list.txt", "", nil), http.StatusOK, nil)
+	decode(t, do(t, "DELETE", srv.URL+"/aliases/todo", "", nil), http.StatusNoContent, nil)
+	decode(t, do(t, "GET", srv.URL+"/notes/todo", "", nil), http.StatusNotFound, nil)
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	served := filepath.Join(dir, "served")
+	if err := zk.InitZK(served); err != nil {
+		t.Fatal(err)
+	}
+	sz, err := zk.NewZK(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(sz)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	decode(t, do(t, "POST", srv.URL+"/notes?parent=0", "Served\n", nil), http.StatusCreated, nil)
+
+	// Reading the sync state doesn't change the zk, so it can't give
+	// the notes unique ids
+	decode(t, do(t, "GET", srv.URL+"/sync", "", nil), http.StatusConflict, nil)
+	h.Lock()
+	err = sz.EnableUniqueIds()
+	h.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(dir, "local")
+	if err := zk.InitZK(local); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zk.NewZK(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server serves the API at its root, not /api
+	if c, err := NewSyncClient(srv.URL); err != nil || c.URL != srv.URL+"/api" {
+		t.Fatalf("Bad client for %v: %+v, %v", srv.URL, c, err)
+	}
+	c := &SyncClient{URL: srv.URL, Client: http.DefaultClient}
+	// The new zk starts as a copy of the served one
+	if _, err := z.SyncWith(c); err != nil {
+		t.Fatal(err)
+	}
+	id, err := z.NewNote(0, "Local\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "attachment")
+	if err := ioutil.WriteFile(src, []byte("attached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.AddFile(id, src, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := z.SyncWith(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sent != 2 || res.Received != 0 {
+		t.Fatalf("Bad sync result: %+v", res)
+	}
+
+	// Each now has the other's note
+	if subnotes, _ := z.GetSubnotes(0); len(subnotes) != 2 {
+		t.Fatalf("Bad local subnotes: %v", subnotes)
+	}
+	var subnotes []zk.NoteMeta
+	decode(t, do(t, "GET", srv.URL+"/notes/0/subnotes", "", nil), http.StatusOK, &subnotes)
+	if len(subnotes) != 2 || subnotes[1].Title != "Local" || len(subnotes[1].Files) != 1 {
+		t.Fatalf("Bad served subnotes: %+v", subnotes)
+	}
+
+	// Changes after the state was read are refused
+	s, err := c.SyncState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, do(t, "POST", srv.URL+"/notes?parent=0", "Meanwhile\n", nil), http.StatusCreated, nil)
+	if err := c.SyncApply(zk.SyncChanges{From: s.Replica, Token: s.Token}); err != zk.ErrSyncChanged {
+		t.Fatalf("Expected %v, got %v", zk.ErrSyncChanged, err)
+	}
+}
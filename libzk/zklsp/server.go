@@ -0,0 +1,525 @@
+// Package zklsp implements a Language Server Protocol server for editing
+// note bodies. It understands [[target]] references (see
+// zk.ParseReferences) and provides:
+//
+//   - completion of note IDs, aliases and titles inside [[...]]
+//   - go to definition, opening the referenced note's body file
+//   - hover previews of referenced notes
+//   - diagnostics for references to notes which don't exist
+//   - workspace symbol search over note titles
+//
+// The server speaks JSON-RPC over any reader and writer, typically an
+// editor's pipes to the zk lsp command.
+package zklsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+// maxResults caps the number of completions and symbols returned.
+const maxResults = 200
+
+// Server is a language server for a single ZK.
+type Server struct {
+	z    *zk.ZK
+	w    io.Writer
+	docs map[string]string // open documents, by URI
+}
+
+// NewServer returns a language server for the given zk.
+func NewServer(z *zk.ZK) *Server {
+	return &Server{z: z, docs: map[string]string{}}
+}
+
+type request struct {
+	ID     *json.RawMessage `json:"id,omitempty"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes
+const (
+	codeInternalError  = -32603
+	codeInvalidParams  = -32602
+	codeMethodNotFound = -32601
+)
+
+// Serve reads requests from r and writes responses to w until the
+// client sends exit or r is closed.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.w = w
+	tp := textproto.NewReader(bufio.NewReader(r))
+	for {
+		hdr, err := tp.ReadMIMEHeader()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n, err := strconv.Atoi(hdr.Get("Content-Length"))
+		if err != nil {
+			return fmt.Errorf("bad Content-Length: %v", err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(tp.R, b); err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, rerr := s.handle(req)
+		if req.ID == nil {
+			// A notification, which gets no response
+			continue
+		}
+		resp := response{JSONRPC: "2.0", ID: req.ID, Error: rerr}
+		if rerr == nil {
+			if resp.Result, err = json.Marshal(result); err != nil {
+				return err
+			}
+		}
+		if err := s.send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) send(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(b), b)
+	return err
+}
+
+func (s *Server) handle(req request) (interface{}, *rpcError) {
+	// Catch up with notes and aliases made by other programs
+	if err := s.z.Reload(); err != nil {
+		return nil, &rpcError{codeInternalError, err.Error()}
+	}
+	var err error
+	var result interface{}
+	switch req.Method {
+	case "initialize":
+		result = map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    1, // the full text
+					"save":      true,
+				},
+				"completionProvider":      map[string]interface{}{"triggerCharacters": []string{"["}},
+				"definitionProvider":      true,
+				"hoverProvider":           true,
+				"workspaceSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "zk"},
+		}
+	case "initialized", "shutdown", "$/cancelRequest", "workspace/didChangeConfiguration":
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			s.docs[p.TextDocument.URI] = p.TextDocument.Text
+			err = s.publish(p.TextDocument.URI)
+		}
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument   textDocument `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil && len(p.ContentChanges) > 0 {
+			s.docs[p.TextDocument.URI] = p.ContentChanges[len(p.ContentChanges)-1].Text
+			err = s.publish(p.TextDocument.URI)
+		}
+	case "textDocument/didSave":
+		var p struct {
+			TextDocument textDocument `json:"textDocument"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			err = s.saved(p.TextDocument.URI)
+		}
+	case "textDocument/didClose":
+		var p struct {
+			TextDocument textDocument `json:"textDocument"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			delete(s.docs, p.TextDocument.URI)
+			err = s.send(notification{"2.0", "textDocument/publishDiagnostics", publishParams{p.TextDocument.URI, []diagnostic{}}})
+		}
+	case "textDocument/completion":
+		var p positionParams
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result = s.complete(p)
+		}
+	case "textDocument/definition":
+		var p positionParams
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result = s.definition(p)
+		}
+	case "textDocument/hover":
+		var p positionParams
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result = s.hover(p)
+		}
+	case "workspace/symbol":
+		var p struct {
+			Query string `json:"query"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result = s.symbols(p.Query)
+		}
+	default:
+		return nil, &rpcError{codeMethodNotFound, "method not supported: " + req.Method}
+	}
+	if err != nil {
+		return nil, &rpcError{codeInvalidParams, err.Error()}
+	}
+	return result, nil
+}
+
+type textDocument struct {
+	URI string `json:"uri"`
+}
+
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type rng struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	URI   string `json:"uri"`
+	Range rng    `json:"range"`
+}
+
+type positionParams struct {
+	TextDocument textDocument `json:"textDocument"`
+	Position     position     `json:"position"`
+}
+
+type diagnostic struct {
+	Range    rng    `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+type publishParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// publish sends the diagnostics for an open document.
+func (s *Server) publish(uri string) error {
+	text := s.docs[uri]
+	diags := []diagnostic{}
+	for _, r := range zk.ParseReferences(text) {
+		if _, err := s.z.ResolveReference(r); err != nil {
+			diags = append(diags, diagnostic{
+				Range:    rng{toPosition(text, r.Start), toPosition(text, r.End)},
+				Severity: 2, // warning
+				Source:   "zk",
+				Message:  fmt.Sprintf("no note %q", r.Target),
+			})
+		}
+	}
+	return s.send(notification{"2.0", "textDocument/publishDiagnostics", publishParams{uri, diags}})
+}
+
+// saved re-reads a note after its body is saved, in case its title
+// changed, then refreshes the diagnostics of every open document.
+func (s *Server) saved(uri string) error {
+	if id, ok := s.noteForURI(uri); ok {
+		s.z.GetNote(id)
+	}
+	var uris []string
+	for u := range s.docs {
+		uris = append(uris, u)
+	}
+	sort.Strings(uris)
+	for _, u := range uris {
+		if err := s.publish(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noteForURI returns the note whose body file a document is.
+func (s *Server) noteForURI(uri string) (int, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return 0, false
+	}
+	id, err := strconv.Atoi(filepath.Base(filepath.Dir(u.Path)))
+	if err != nil {
+		return 0, false
+	}
+	if p, err := s.z.GetNoteBodyPath(id); err != nil || p != filepath.Clean(u.Path) {
+		return 0, false
+	}
+	return id, true
+}
+
+func bodyURI(z *zk.ZK, id int) (string, error) {
+	p, err := z.GetNoteBodyPath(id)
+	if err != nil {
+		return "", err
+	}
+	if p, err = filepath.Abs(p); err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(p)}).String(), nil
+}
+
+// reference returns the reference at a position in a document, if any.
+func (s *Server) reference(p positionParams) (zk.Reference, string, bool) {
+	text := s.docs[p.TextDocument.URI]
+	off := toOffset(text, p.Position)
+	for _, r := range zk.ParseReferences(text) {
+		if off >= r.Start && off <= r.End {
+			return r, text, true
+		}
+	}
+	return zk.Reference{}, text, false
+}
+
+func (s *Server) definition(p positionParams) interface{} {
+	r, _, ok := s.reference(p)
+	if !ok {
+		return nil
+	}
+	id, err := s.z.ResolveReference(r)
+	if err != nil {
+		return nil
+	}
+	uri, err := bodyURI(s.z, id)
+	if err != nil {
+		return nil
+	}
+	return location{URI: uri}
+}
+
+// previewLines is how much of a note's body a hover shows.
+const previewLines = 10
+
+func (s *Server) hover(p positionParams) interface{} {
+	r, text, ok := s.reference(p)
+	if !ok {
+		return nil
+	}
+	var value string
+	if id, err := s.z.ResolveReference(r); err != nil {
+		value = fmt.Sprintf("No note %q", r.Target)
+	} else if note, err := s.z.GetNote(id); err != nil {
+		return nil
+	} else {
+		lines := strings.Split(strings.TrimRight(note.Body, "\n"), "\n")
+		value = fmt.Sprintf("**%s** (note %d)", note.Title, id)
+		if len(lines) > previewLines+1 {
+			lines = append(lines[:previewLines+1], "…")
+		}
+		if len(lines) > 1 {
+			value += "\n\n" + strings.Join(lines[1:], "\n")
+		}
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": value},
+		"range":    rng{toPosition(text, r.Start), toPosition(text, r.End)},
+	}
+}
+
+type completionItem struct {
+	Label      string   `json:"label"`
+	Kind       int      `json:"kind"`
+	Detail     string   `json:"detail,omitempty"`
+	FilterText string   `json:"filterText"`
+	SortText   string   `json:"sortText"`
+	TextEdit   textEdit `json:"textEdit"`
+}
+
+type textEdit struct {
+	Range   rng    `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// complete offers the notes and aliases matching whatever has been
+// typed after an unclosed [[ on the current line. Choosing a note
+// inserts its ID, or its unique ID if it has one, whether it was
+// matched by ID or by title.
+func (s *Server) complete(p positionParams) interface{} {
+	text := s.docs[p.TextDocument.URI]
+	off := toOffset(text, p.Position)
+	line := text[strings.LastIndexByte(text[:off], '\n')+1 : off]
+	open := strings.LastIndex(line, "[[")
+	if open < 0 || strings.Contains(line[open:], "]]") || strings.Contains(line[open:], "|") {
+		return map[string]interface{}{"isIncomplete": false, "items": []completionItem{}}
+	}
+	prefix := line[open+2:]
+	start := toPosition(text, off-len(prefix))
+	want := strings.ToLower(strings.TrimSpace(prefix))
+
+	items := []completionItem{}
+	add := func(label, detail, filter, insert string, kind int) {
+		if len(items) >= maxResults || !strings.Contains(strings.ToLower(filter), want) {
+			return
+		}
+		items = append(items, completionItem{
+			Label:      label,
+			Kind:       kind,
+			Detail:     detail,
+			FilterText: prefix + " " + filter,
+			SortText:   fmt.Sprintf("%06d", len(items)),
+			TextEdit:   textEdit{rng{start, p.Position}, insert},
+		})
+	}
+
+	aliases := s.z.Aliases()
+	var names []string
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		md, err := s.z.GetNoteMeta(aliases[name])
+		if err != nil {
+			continue
+		}
+		add(name, fmt.Sprintf("alias for %d: %s", md.Id, md.Title), name, name, 18) // reference
+	}
+
+	var ids []int
+	for id := range s.z.MetadataDump() {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		md, _ := s.z.GetNoteMeta(id)
+		add(md.Title, fmt.Sprintf("note %d", id), fmt.Sprintf("%d %s", id, md.Title), s.z.RefTarget(id), 17) // file
+	}
+	return map[string]interface{}{
+		"isIncomplete": len(items) >= maxResults,
+		"items":        items,
+	}
+}
+
+type symbolInformation struct {
+	Name          string   `json:"name"`
+	Kind          int      `json:"kind"`
+	Location      location `json:"location"`
+	ContainerName string   `json:"containerName"`
+}
+
+// symbols returns the notes whose titles contain the query.
+func (s *Server) symbols(query string) []symbolInformation {
+	query = strings.ToLower(query)
+	var ids []int
+	for id, md := range s.z.MetadataDump() {
+		if strings.Contains(strings.ToLower(md.Title), query) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	syms := []symbolInformation{}
+	for _, id := range ids {
+		if len(syms) >= maxResults {
+			break
+		}
+		md, _ := s.z.GetNoteMeta(id)
+		uri, err := bodyURI(s.z, id)
+		if err != nil {
+			continue
+		}
+		syms = append(syms, symbolInformation{
+			Name:          md.Title,
+			Kind:          1, // file
+			Location:      location{URI: uri},
+			ContainerName: fmt.Sprintf("note %d", id),
+		})
+	}
+	return syms
+}
+
+// toOffset converts an LSP position, counted in UTF-16 code units, to a
+// byte offset in text.
+func toOffset(text string, p position) int {
+	off := 0
+	for line := 0; line < p.Line; line++ {
+		i := strings.IndexByte(text[off:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		off += i + 1
+	}
+	for units := 0; off < len(text) && text[off] != '\n'; {
+		r, size := utf8.DecodeRuneInString(text[off:])
+		units += len(utf16.Encode([]rune{r}))
+		if units > p.Character {
+			break
+		}
+		off += size
+	}
+	return off
+}
+
+// toPosition converts a byte offset in text to an LSP position.
+func toPosition(text string, off int) position {
+	if off > len(text) {
+		off = len(text)
+	}
+	start := strings.LastIndexByte(text[:off], '\n') + 1
+	var p position
+	p.Line = strings.Count(text[:start], "\n")
+	for _, r := range text[start:off] {
+		p.Character += len(utf16.Encode([]rune{r}))
+	}
+	return p
+}
@@ -0,0 +1,242 @@
+package zklsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+// client talks to a Server over pipes.
+type client struct {
+	t    *testing.T
+	w    io.WriteCloser
+	r    *textproto.Reader
+	id   int
+	note []json.RawMessage // notifications received while waiting for responses
+}
+
+func newClient(t *testing.T) (*zk.ZK, *client, func()) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zk.InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zk.NewZK(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() {
+		NewServer(z).Serve(inR, outW)
+		outW.Close()
+	}()
+	c := &client{t: t, w: inW, r: textproto.NewReader(bufio.NewReader(outR))}
+	return z, c, func() {
+		inW.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (c *client) write(v interface{}) {
+	b, _ := json.Marshal(v)
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(b), b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) read() map[string]json.RawMessage {
+	hdr, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(hdr.Get("Content-Length"))
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r.R, b); err != nil {
+		c.t.Fatal(err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// call makes a request and decodes its result into v.
+func (c *client) call(method string, params, v interface{}) {
+	c.id++
+	c.write(map[string]interface{}{"jsonrpc": "2.0", "id": c.id, "method": method, "params": params})
+	for {
+		m := c.read()
+		if _, ok := m["id"]; !ok {
+			c.note = append(c.note, m["params"])
+			continue
+		}
+		if e, ok := m["error"]; ok {
+			c.t.Fatalf("%v: %s", method, e)
+		}
+		if err := json.Unmarshal(m["result"], v); err != nil {
+			c.t.Fatal(err)
+		}
+		return
+	}
+}
+
+func (c *client) diagnostics() publishParams {
+	var p publishParams
+	m := c.read()
+	if err := json.Unmarshal(m["params"], &p); err != nil {
+		c.t.Fatal(err)
+	}
+	return p
+}
+
+func at(line, char int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": "file:///tmp/doc"},
+		"position":     map[string]int{"line": line, "character": char},
+	}
+}
+
+func TestServer(t *testing.T) {
+	z, c, done := newClient(t)
+	defer done()
+	if _, err := z.NewNote(0, "Groceries\neggs\nmilk\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.NewNote(0, "Garden\n"); err != nil {
+		t.Fatal(err)
+	}
+	z.AddAlias(1, "shop")
+
+	var init struct {
+		Capabilities map[string]interface{}
+	}
+	c.call("initialize", map[string]interface{}{}, &init)
+	if init.Capabilities["hoverProvider"] != true {
+		t.Fatalf("Bad capabilities: %+v", init)
+	}
+	c.notify("initialized", map[string]interface{}{})
+
+	// Opening a document reports the missing note
+	text := "Plans\nbuy [[shop]] stuff, plant [[17]]\n[[gr"
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": "file:///tmp/doc", "languageId": "markdown", "version": 1, "text": text},
+	})
+	diags := c.diagnostics()
+	if len(diags.Diagnostics) != 1 || diags.Diagnostics[0].Message != `no note "17"` {
+		t.Fatalf("Bad diagnostics: %+v", diags)
+	}
+	if r := diags.Diagnostics[0].Range; r.Start != (position{1, 26}) || r.End != (position{1, 32}) {
+		t.Fatalf("Bad diagnostic range: %+v", r)
+	}
+
+	// Completing "gr" finds Groceries by title and inserts its id
+	var list struct {
+		Items []completionItem
+	}
+	c.call("textDocument/completion", at(2, 4), &list)
+	if len(list.Items) != 1 || list.Items[0].Label != "Groceries" || list.Items[0].TextEdit.NewText != "1" {
+		t.Fatalf("Bad completions: %+v", list)
+	}
+	if r := list.Items[0].TextEdit.Range; r.Start != (position{2, 2}) || r.End != (position{2, 4}) {
+		t.Fatalf("Bad completion range: %+v", r)
+	}
+	// Outside a reference there's nothing to complete
+	c.call("textDocument/completion", at(0, 3), &list)
+	if len(list.Items) != 0 {
+		t.Fatalf("Bad completions: %+v", list)
+	}
+
+	// Definition and hover for the alias
+	var loc location
+	c.call("textDocument/definition", at(1, 8), &loc)
+	if want, _ := bodyURI(z, 1); loc.URI != want {
+		t.Fatalf("Bad definition: %+v, wanted %v", loc, want)
+	}
+	var hover struct {
+		Contents struct{ Value string }
+	}
+	c.call("textDocument/hover", at(1, 8), &hover)
+	if hover.Contents.Value != "**Groceries** (note 1)\n\neggs\nmilk" {
+		t.Fatalf("Bad hover: %q", hover.Contents.Value)
+	}
+
+	var syms []symbolInformation
+	c.call("workspace/symbol", map[string]string{"query": "gar"}, &syms)
+	if len(syms) != 1 || syms[0].Name != "Garden" {
+		t.Fatalf("Bad symbols: %+v", syms)
+	}
+
+	// Fixing the reference clears the diagnostic
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": "file:///tmp/doc", "version": 2},
+		"contentChanges": []map[string]string{{"text": strings.Replace(text, "17", "2", 1)}},
+	})
+	if diags := c.diagnostics(); len(diags.Diagnostics) != 0 {
+		t.Fatalf("Bad diagnostics: %+v", diags)
+	}
+
+	// A note made by another program is found too
+	p, err := z.GetNoteBodyPath(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := zk.NewZK(filepath.Dir(filepath.Dir(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := other.NewNote(0, "Greenhouse\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": "file:///tmp/doc", "version": 3},
+		"contentChanges": []map[string]string{{"text": strings.Replace(text, "17", strconv.Itoa(id), 1)}},
+	})
+	if diags := c.diagnostics(); len(diags.Diagnostics) != 0 {
+		t.Fatalf("Bad diagnostics: %+v", diags)
+	}
+
+	var null interface{}
+	c.call("shutdown", nil, &null)
+	c.notify("exit", nil)
+}
+
+func TestPositions(t *testing.T) {
+	text := "héllo\n𝄞x\n"
+	for _, tc := range []struct {
+		off int
+		pos position
+	}{
+		{0, position{0, 0}},
+		{3, position{0, 2}},
+		{7, position{1, 0}},
+		{11, position{1, 2}},
+		{12, position{1, 3}},
+	} {
+		if got := toPosition(text, tc.off); got != tc.pos {
+			t.Errorf("toPosition(%d) = %+v, want %+v", tc.off, got, tc.pos)
+		}
+		if got := toOffset(text, tc.pos); got != tc.off {
+			t.Errorf("toOffset(%+v) = %d, want %d", tc.pos, got, tc.off)
+		}
+	}
+}
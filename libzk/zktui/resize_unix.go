@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package zktui
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// onResize calls fn whenever the terminal changes size, until the
+// returned function is called.
+func onResize(fn func()) func() {
+	c := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		for {
+			select {
+			case <-c:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
@@ -0,0 +1,7 @@
+package zktui
+
+// onResize does nothing on Windows, which has no SIGWINCH; the screen
+// is redrawn at the new size after the next key.
+func onResize(fn func()) func() {
+	return func() {}
+}
@@ -0,0 +1,148 @@
+package zktui
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	zk "github.com/floren/zk/libzk"
+	"golang.org/x/term"
+)
+
+// Run takes over the terminal and runs the interface until the user
+// quits, starting with the current note selected. Notes are edited by
+// running editor on their body files. It returns the note selected at
+// the end.
+func Run(z *zk.ZK, current int, editor string) (int, error) {
+	in, out := os.Stdin, os.Stdout
+	fd := int(in.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return current, err
+	}
+	restore := func() {
+		io.WriteString(out, "\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}
+	setup := func() {
+		term.MakeRaw(fd)
+		io.WriteString(out, "\x1b[?1049h\x1b[?25l")
+	}
+	setup()
+	defer restore()
+
+	var mu sync.Mutex
+	u := newUI(z, current, func(path string) error {
+		restore()
+		defer setup()
+		cmd := exec.Command(editor, path)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, os.Stderr
+		return cmd.Run()
+	})
+	draw := func() {
+		if w, h, err := term.GetSize(int(out.Fd())); err == nil {
+			u.width, u.height = w, h
+		}
+		var b strings.Builder
+		b.WriteString("\x1b[H")
+		for i, line := range u.render() {
+			if i > 0 {
+				b.WriteString("\r\n")
+			}
+			b.WriteString(line + "\x1b[K")
+		}
+		io.WriteString(out, b.String())
+	}
+	stop := onResize(func() {
+		mu.Lock()
+		draw()
+		mu.Unlock()
+	})
+	defer stop()
+
+	keys := bufio.NewReader(in)
+	mu.Lock()
+	defer mu.Unlock()
+	for {
+		draw()
+		// Don't hold the lock while waiting, so resizes can redraw
+		mu.Unlock()
+		k, err := readKey(keys)
+		mu.Lock()
+		if err != nil {
+			return current, err
+		}
+		if u.handle(k) {
+			break
+		}
+	}
+	if r, ok := u.selected(); ok {
+		current = r.id
+	}
+	return current, nil
+}
+
+// readKey reads one keypress, decoding the escape sequences for the
+// arrow and paging keys.
+func readKey(r *bufio.Reader) (rune, error) {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch c {
+	case '\r', '\n':
+		return keyEnter, nil
+	case 0x7f, 0x08:
+		return keyBackspace, nil
+	case '\t':
+		return keyTab, nil
+	case 0x03:
+		return keyCtrlC, nil
+	case 0x1b:
+	default:
+		if c == utf8.RuneError || c < ' ' {
+			return keyNone, nil
+		}
+		return c, nil
+	}
+
+	// An escape on its own is the Esc key; otherwise it starts a sequence
+	if r.Buffered() == 0 {
+		return keyEsc, nil
+	}
+	b, _ := r.ReadByte()
+	if b != '[' && b != 'O' {
+		return keyEsc, nil
+	}
+	var seq []byte
+	for r.Buffered() > 0 {
+		b, _ := r.ReadByte()
+		seq = append(seq, b)
+		if b >= 0x40 && b <= 0x7e {
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return keyUp, nil
+	case "B":
+		return keyDown, nil
+	case "C":
+		return keyRight, nil
+	case "D":
+		return keyLeft, nil
+	case "H", "1~", "7~":
+		return keyHome, nil
+	case "F", "4~", "8~":
+		return keyEnd, nil
+	case "5~":
+		return keyPgUp, nil
+	case "6~":
+		return keyPgDown, nil
+	}
+	return keyNone, nil
+}
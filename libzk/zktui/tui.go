@@ -0,0 +1,599 @@
+// Package zktui is a full-screen terminal interface to a zk: a
+// collapsible tree of notes on the left, a preview of the selected note
+// on the right, and a status line at the bottom. Everything is done
+// through libzk, and the zk is reloaded before each key is handled, so
+// notes and aliases made by the CLI or a server show up, and changes
+// made here are merged with theirs rather than overwriting them.
+package zktui
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+const help = "j/k move  l/h open/close  / search  n new  e edit  + link  - unlink  a alias  f attach  q quit"
+
+// Keys which aren't printable characters
+const (
+	keyNone = -iota - 1
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyPgUp
+	keyPgDown
+	keyHome
+	keyEnd
+	keyEnter
+	keyEsc
+	keyBackspace
+	keyTab
+	keyCtrlC
+)
+
+// A row is one line of the tree pane.
+type row struct {
+	id       int
+	depth    int
+	path     string // ids from the root, e.g. "0/3/5"
+	children bool
+}
+
+// parent returns the id of the note above the row in the tree, or -1.
+func (r row) parent() int {
+	elems := strings.Split(r.path, "/")
+	if len(elems) < 2 {
+		return -1
+	}
+	id, _ := strconv.Atoi(elems[len(elems)-2])
+	return id
+}
+
+// UI holds the state of the interface. It knows nothing of terminals;
+// see Run for that.
+type UI struct {
+	z    *zk.ZK
+	edit func(path string) error // runs the editor on a file
+
+	width, height int
+
+	rows     []row
+	expanded map[string]bool
+	cursor   int
+	top      int // first row shown
+
+	searching bool
+	query     string
+	saved     int // the tree cursor to go back to when a search is cancelled
+
+	prompt   string // set while asking a question on the status line
+	answer   string
+	onAnswer func(string) error
+
+	status string // a message, shown until the next key
+}
+
+// newUI returns a UI for z with the tree opened up to the current note.
+func newUI(z *zk.ZK, current int, edit func(string) error) *UI {
+	u := &UI{z: z, edit: edit, width: 80, height: 24, expanded: map[string]bool{"0": true}}
+	u.refresh()
+	u.reveal(current)
+	return u
+}
+
+// refresh rebuilds the rows, keeping the cursor on the same entry if it
+// is still there.
+func (u *UI) refresh() {
+	var path string
+	if u.cursor < len(u.rows) {
+		path = u.rows[u.cursor].path
+	}
+	if u.searching {
+		u.rows = u.search(u.query)
+	} else {
+		u.rows = u.rows[:0]
+		u.walk(0, 0, "0", map[int]bool{})
+	}
+	u.cursor = 0
+	for i, r := range u.rows {
+		if r.path == path {
+			u.cursor = i
+		}
+	}
+}
+
+// walk adds the rows for id and, if it's expanded, its subnotes.
+func (u *UI) walk(id, depth int, path string, seen map[int]bool) {
+	subnotes, _ := u.z.GetSubnotes(id)
+	if seen[id] {
+		// Don't go round a cycle
+		subnotes = nil
+	}
+	u.rows = append(u.rows, row{id: id, depth: depth, path: path, children: len(subnotes) > 0})
+	if !u.expanded[path] {
+		return
+	}
+	seen[id] = true
+	for _, sn := range subnotes {
+		u.walk(sn, depth+1, fmt.Sprintf("%s/%d", path, sn), seen)
+	}
+	delete(seen, id)
+}
+
+// search returns a row for each note whose ID, alias, title or body
+// matches the query: titles first, then bodies.
+func (u *UI) search(q string) []row {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return nil
+	}
+	lower := strings.ToLower(q)
+	found := map[int]bool{}
+	var titles, bodies []int
+	if id, err := u.z.ResolveNoteId(q); err == nil {
+		if _, err := u.z.GetNoteMeta(id); err == nil {
+			found[id] = true
+			titles = append(titles, id)
+		}
+	}
+	var ids []int
+	for id := range u.z.MetadataDump() {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		md, _ := u.z.GetNoteMeta(id)
+		if !found[id] && strings.Contains(strings.ToLower(md.Title), lower) {
+			found[id] = true
+			titles = append(titles, id)
+		}
+	}
+	if c, err := u.z.Grep("(?i)"+regexp.QuoteMeta(q), []int{}); err == nil {
+		for res := range c {
+			if res.Error == nil && !found[res.Note.Id] {
+				found[res.Note.Id] = true
+				bodies = append(bodies, res.Note.Id)
+			}
+		}
+	}
+	sort.Ints(bodies)
+	var rows []row
+	for _, id := range append(titles, bodies...) {
+		rows = append(rows, row{id: id, path: strconv.Itoa(id)})
+	}
+	return rows
+}
+
+// reveal expands the tree down to a note and moves the cursor to it,
+// following the notes' parents.
+func (u *UI) reveal(id int) bool {
+	chain := []int{id}
+	for cur := id; cur != 0; {
+		md, err := u.z.GetNoteMeta(cur)
+		if err != nil || len(chain) > len(u.z.MetadataDump()) {
+			return false
+		}
+		cur = md.Parent
+		chain = append([]int{cur}, chain...)
+	}
+	path := "0"
+	for _, id := range chain[1:] {
+		u.expanded[path] = true
+		path += "/" + strconv.Itoa(id)
+	}
+	u.refresh()
+	for i, r := range u.rows {
+		if r.path == path {
+			u.cursor = i
+			return true
+		}
+	}
+	return false
+}
+
+// selected returns the row under the cursor.
+func (u *UI) selected() (row, bool) {
+	if u.cursor < len(u.rows) {
+		return u.rows[u.cursor], true
+	}
+	return row{}, false
+}
+
+// handle acts on a key, returning true when it's time to quit.
+func (u *UI) handle(k rune) bool {
+	u.status = ""
+	// Catch up with anyone else using the zk
+	if err := u.z.Reload(); err != nil {
+		u.status = "Error: " + err.Error()
+	} else {
+		u.refresh()
+	}
+	switch {
+	case u.prompt != "":
+		u.handlePrompt(k)
+	case u.searching:
+		u.handleSearch(k)
+	default:
+		return u.handleTree(k)
+	}
+	return false
+}
+
+// move moves the cursor by n rows, staying within the tree.
+func (u *UI) move(n int) {
+	u.cursor += n
+	if u.cursor >= len(u.rows) {
+		u.cursor = len(u.rows) - 1
+	}
+	if u.cursor < 0 {
+		u.cursor = 0
+	}
+}
+
+// page is the number of rows shown at once.
+func (u *UI) page() int {
+	if u.height < 3 {
+		return 1
+	}
+	return u.height - 1
+}
+
+func (u *UI) handleTree(k rune) bool {
+	r, ok := u.selected()
+	switch k {
+	case 'q', keyCtrlC:
+		return true
+	case 'j', keyDown:
+		u.move(1)
+	case 'k', keyUp:
+		u.move(-1)
+	case keyPgDown:
+		u.move(u.page())
+	case keyPgUp:
+		u.move(-u.page())
+	case 'g', keyHome:
+		u.cursor = 0
+	case 'G', keyEnd:
+		u.move(len(u.rows))
+	case 'l', keyRight, keyEnter:
+		if ok && r.children {
+			u.expanded[r.path] = true
+			u.refresh()
+		}
+	case 'h', keyLeft:
+		if ok && u.expanded[r.path] && r.children {
+			u.expanded[r.path] = false
+			u.refresh()
+		} else if i := strings.LastIndexByte(r.path, '/'); ok && i > 0 {
+			// Go to the parent instead
+			for j := range u.rows {
+				if u.rows[j].path == r.path[:i] {
+					u.cursor = j
+				}
+			}
+		}
+	case ' ':
+		if ok && r.children {
+			u.expanded[r.path] = !u.expanded[r.path]
+			u.refresh()
+		}
+	case '/':
+		u.searching, u.query, u.saved = true, "", u.cursor
+		u.rows, u.cursor = nil, 0
+	case 'n':
+		u.ask("New note title: ", func(title string) error {
+			if strings.TrimSpace(title) == "" {
+				return nil
+			}
+			id, err := u.z.NewNote(r.id, title+"\n")
+			if err != nil {
+				return err
+			}
+			u.reveal(id)
+			return nil
+		})
+	case 'e':
+		if ok {
+			u.editNote(r.id)
+		}
+	case '+':
+		u.ask(fmt.Sprintf("Link which note under %d? ", r.id), func(s string) error {
+			id, err := u.resolve(s)
+			if err != nil {
+				return err
+			}
+			if err := u.z.LinkNote(r.id, id); err != nil {
+				return err
+			}
+			u.expanded[r.path] = true
+			u.refresh()
+			return nil
+		})
+	case '-':
+		p := r.parent()
+		if !ok || p < 0 {
+			u.status = "Can't unlink the top note"
+			break
+		}
+		u.ask(fmt.Sprintf("Unlink note %d from %d? (y/n) ", r.id, p), func(s string) error {
+			if s != "y" && s != "yes" {
+				return nil
+			}
+			if err := u.z.UnlinkNote(p, r.id); err != nil {
+				return err
+			}
+			u.refresh()
+			return nil
+		})
+	case 'a':
+		u.ask(fmt.Sprintf("Alias for note %d: ", r.id), func(name string) error {
+			if name = strings.TrimSpace(name); name == "" {
+				return nil
+			}
+			return u.z.AddAlias(r.id, name)
+		})
+	case 'f':
+		u.ask(fmt.Sprintf("Attach file to note %d: ", r.id), func(path string) error {
+			if path = strings.TrimSpace(path); path == "" {
+				return nil
+			}
+			return u.z.AddFile(r.id, path, "")
+		})
+	default:
+		u.status = help
+	}
+	return false
+}
+
+func (u *UI) handleSearch(k rune) {
+	switch k {
+	case keyEsc, keyCtrlC:
+		u.searching, u.query = false, ""
+		u.refresh()
+		u.cursor = u.saved
+		u.move(0)
+	case keyEnter:
+		r, ok := u.selected()
+		u.searching, u.query = false, ""
+		u.refresh()
+		u.cursor = u.saved
+		u.move(0)
+		if ok && !u.reveal(r.id) {
+			u.status = fmt.Sprintf("Note %d is not in the tree; see zk orphans", r.id)
+		}
+	case keyDown, keyTab:
+		u.move(1)
+	case keyUp:
+		u.move(-1)
+	case keyBackspace:
+		if q := []rune(u.query); len(q) > 0 {
+			u.query = string(q[:len(q)-1])
+			u.refresh()
+		}
+	default:
+		if k >= ' ' {
+			u.query += string(k)
+			u.refresh()
+		}
+	}
+}
+
+// ask prompts for an answer on the status line and passes it to fn.
+func (u *UI) ask(prompt string, fn func(string) error) {
+	u.prompt, u.answer, u.onAnswer = prompt, "", fn
+}
+
+func (u *UI) handlePrompt(k rune) {
+	switch k {
+	case keyEsc, keyCtrlC:
+		u.prompt = ""
+	case keyEnter:
+		u.prompt = ""
+		if err := u.onAnswer(u.answer); err != nil {
+			u.status = "Error: " + err.Error()
+		} else {
+			u.z.Sync()
+		}
+	case keyBackspace:
+		if a := []rune(u.answer); len(a) > 0 {
+			u.answer = string(a[:len(a)-1])
+		}
+	default:
+		if k >= ' ' {
+			u.answer += string(k)
+		}
+	}
+}
+
+// resolve turns a note ID or alias typed by the user into an ID.
+func (u *UI) resolve(s string) (int, error) {
+	id, err := u.z.ResolveNoteId(strings.TrimSpace(s))
+	if err == nil {
+		_, err = u.z.GetNoteMeta(id)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("no note %q", s)
+	}
+	return id, nil
+}
+
+func (u *UI) editNote(id int) {
+	before, err := u.z.GetNote(id)
+	var p string
+	if err == nil {
+		p, err = u.z.GetNoteBodyPath(id)
+	}
+	if err == nil {
+		err = u.edit(p)
+	}
+	if err != nil {
+		u.status = "Error: " + err.Error()
+		return
+	}
+	// Save the edited body through the zk, which picks up any change
+	// to the title and lets observers know
+	if after, err := u.z.GetNote(id); err != nil {
+		u.status = "Error: " + err.Error()
+	} else if after.Body != before.Body {
+		if err := u.z.UpdateNote(id, after.Body); err != nil {
+			u.status = "Error: " + err.Error()
+		}
+	}
+	u.z.Sync()
+	u.refresh()
+}
+
+// render draws the whole screen, one string per line.
+func (u *UI) render() []string {
+	treeWidth := u.width * 2 / 5
+	if treeWidth < 20 {
+		treeWidth = u.width
+	}
+	lines := u.page()
+	if u.cursor < u.top {
+		u.top = u.cursor
+	}
+	if u.cursor >= u.top+lines {
+		u.top = u.cursor - lines + 1
+	}
+
+	var preview []string
+	if r, ok := u.selected(); ok && treeWidth < u.width {
+		preview = u.preview(r.id, u.width-treeWidth-3)
+	}
+
+	screen := make([]string, 0, u.height)
+	for i := 0; i < lines; i++ {
+		var left string
+		if n := u.top + i; n < len(u.rows) {
+			left = fit(u.rowText(u.rows[n]), treeWidth)
+			if n == u.cursor {
+				left = "\x1b[7m" + left + "\x1b[0m"
+			}
+		} else {
+			left = fit("", treeWidth)
+		}
+		if treeWidth < u.width {
+			left += " │ "
+			if i < len(preview) {
+				left += preview[i]
+			}
+		}
+		screen = append(screen, left)
+	}
+	screen = append(screen, "\x1b[7m"+fit(u.statusText(), u.width)+"\x1b[0m")
+	return screen
+}
+
+func (u *UI) rowText(r row) string {
+	md, _ := u.z.GetNoteMeta(r.id)
+	marker := "  "
+	if r.children && u.expanded[r.path] {
+		marker = "▾ "
+	} else if r.children {
+		marker = "▸ "
+	}
+	return fmt.Sprintf("%s%s%s (%d)", strings.Repeat("  ", r.depth), marker, clean(md.Title), r.id)
+}
+
+func (u *UI) statusText() string {
+	switch {
+	case u.prompt != "":
+		return u.prompt + u.answer + "_"
+	case u.searching:
+		return fmt.Sprintf("/%s_  (%d found; enter to go, esc to cancel)", u.query, len(u.rows))
+	case u.status != "":
+		return u.status
+	}
+	return help
+}
+
+// preview returns the lines describing a note, wrapped to width.
+func (u *UI) preview(id, width int) []string {
+	if width < 1 {
+		return nil
+	}
+	note, err := u.z.GetNote(id)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	out := []string{"\x1b[1m" + fit(clean(note.Title), width) + "\x1b[0m"}
+	info := fmt.Sprintf("Note %d, parent %d", id, note.Parent)
+	var aliases []string
+	for name, aid := range u.z.Aliases() {
+		if aid == id {
+			aliases = append(aliases, name)
+		}
+	}
+	sort.Strings(aliases)
+	if len(aliases) > 0 {
+		info += ", aliases " + strings.Join(aliases, " ")
+	}
+	out = append(out, wrap(info, width)...)
+	if len(note.Files) > 0 {
+		out = append(out, wrap("Files: "+strings.Join(note.Files, " "), width)...)
+	}
+	out = append(out, "")
+	body := note.Body
+	if i := strings.IndexByte(body, '\n'); i >= 0 {
+		body = body[i+1:]
+	}
+	for _, line := range strings.Split(strings.TrimRight(body, "\n"), "\n") {
+		out = append(out, wrap(clean(line), width)...)
+		if len(out) >= u.height {
+			break
+		}
+	}
+	return out
+}
+
+// clean makes text safe to print: tabs become spaces and other control
+// characters are dropped.
+func clean(s string) string {
+	s = strings.Replace(s, "\t", "    ", -1)
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// fit truncates or pads s to exactly width characters.
+func fit(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		if width > 0 {
+			return string(r[:width-1]) + "…"
+		}
+		return ""
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
+
+// wrap breaks s into lines of at most width characters.
+func wrap(s string, width int) []string {
+	r := []rune(s)
+	if len(r) == 0 {
+		return []string{""}
+	}
+	var lines []string
+	for len(r) > width {
+		cut := width
+		// Break at a space if there's one on the line
+		for i := width; i > width/2; i-- {
+			if r[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		lines = append(lines, string(r[:cut]))
+		r = []rune(strings.TrimLeft(string(r[cut:]), " "))
+	}
+	return append(lines, string(r))
+}
@@ -0,0 +1,216 @@
+package zktui
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+func newTestUI(t *testing.T, edit func(string) error) (*zk.ZK, *UI, func()) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zk.InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zk.NewZK(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []struct {
+		parent int
+		body   string
+	}{
+		{0, "Projects\n"},
+		{1, "zk\nA note taking tool\n"},
+		{1, "Website\n"},
+		{0, "Recipes\nbread and soup\n"},
+	} {
+		if _, err := z.NewNote(n.parent, n.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return z, newUI(z, 0, edit), func() { os.RemoveAll(dir) }
+}
+
+// keys feeds a string of keys to the UI; each rune is a key.
+func keys(u *UI, s string) {
+	for _, k := range s {
+		u.handle(k)
+	}
+}
+
+func (u *UI) titles() string {
+	var s []string
+	for _, r := range u.rows {
+		md, _ := u.z.GetNoteMeta(r.id)
+		s = append(s, strings.Repeat(" ", r.depth)+md.Title)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestNavigation(t *testing.T) {
+	_, u, done := newTestUI(t, nil)
+	defer done()
+
+	if got := u.titles(); got != "Top Level, Projects, Recipes" {
+		t.Fatalf("Bad tree: %q", got)
+	}
+	// Down to Projects and open it
+	keys(u, "jl")
+	if got := u.titles(); got != "Top Level, Projects,  zk,  Website, Recipes" {
+		t.Fatalf("Bad tree: %q", got)
+	}
+	// Down to zk, then h goes back to the parent, and h again closes it
+	keys(u, "jh")
+	if r, _ := u.selected(); r.id != 1 {
+		t.Fatalf("Cursor on %+v", r)
+	}
+	keys(u, "h")
+	if got := u.titles(); got != "Top Level, Projects, Recipes" {
+		t.Fatalf("Bad tree: %q", got)
+	}
+
+	// The preview shows the selected note
+	u.width, u.height = 80, 10
+	keys(u, "G")
+	screen := strings.Join(u.render(), "\n")
+	if !strings.Contains(screen, "bread and soup") || !strings.Contains(screen, "Note 4, parent 0") {
+		t.Fatalf("Bad screen:\n%s", screen)
+	}
+
+	// Opening the UI on a note reveals it
+	u = newUI(u.z, 3, nil)
+	if r, _ := u.selected(); r.id != 3 || r.path != "0/1/3" {
+		t.Fatalf("Cursor on %+v", r)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	_, u, done := newTestUI(t, nil)
+	defer done()
+
+	// Titles match first, then bodies
+	keys(u, "/o")
+	if got := u.titles(); got != "Top Level,Projects,zk,Recipes" {
+		t.Fatalf("Bad results: %q", got)
+	}
+	keys(u, "ol")
+	if got := u.titles(); got != "zk" {
+		t.Fatalf("Bad results: %q", got)
+	}
+	// Enter jumps to the note in the tree
+	u.handle(keyEnter)
+	if r, _ := u.selected(); r.id != 2 || r.path != "0/1/2" || u.searching {
+		t.Fatalf("Cursor on %+v", r)
+	}
+
+	// Escape goes back to where we were
+	keys(u, "/bread")
+	u.handle(keyBackspace)
+	if got := u.titles(); got != "Recipes" {
+		t.Fatalf("Bad results: %q", got)
+	}
+	u.handle(keyEsc)
+	if r, _ := u.selected(); r.id != 2 {
+		t.Fatalf("Cursor on %+v", r)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var edited string
+	z, u, done := newTestUI(t, func(path string) error {
+		edited = path
+		return ioutil.WriteFile(path, []byte("Cookbook\n"), 0600)
+	})
+	defer done()
+
+	// Create a note under Recipes
+	keys(u, "Gnsoup")
+	u.handle(keyEnter)
+	if r, _ := u.selected(); r.id != 5 || r.path != "0/4/5" {
+		t.Fatalf("Cursor on %+v", r)
+	}
+	// Alias it, link zk under it, then unlink it from Recipes
+	keys(u, "asoup")
+	u.handle(keyEnter)
+	keys(u, "+2")
+	u.handle(keyEnter)
+	if md, _ := z.GetNoteMeta(5); len(md.Subnotes) != 1 || md.Subnotes[0] != 2 {
+		t.Fatalf("Not linked: %+v", md)
+	}
+	keys(u, "-y")
+	u.handle(keyEnter)
+	if md, _ := z.GetNoteMeta(4); len(md.Subnotes) != 0 {
+		t.Fatalf("Not unlinked: %+v", md)
+	}
+	if id, _ := z.ResolveNoteId("soup"); id != 5 {
+		t.Fatalf("Bad alias: %v", id)
+	}
+
+	// Errors show on the status line
+	keys(u, "g+nothing")
+	u.handle(keyEnter)
+	if !strings.HasPrefix(u.statusText(), "Error: no note") {
+		t.Fatalf("Bad status: %q", u.statusText())
+	}
+
+	// Editing updates the title, and observers hear of it
+	var updated []int
+	remove := z.AddObserver(zk.ObserverFunc(func(e zk.Event) {
+		if e.Type == zk.EventUpdate {
+			updated = append(updated, e.Note.Id)
+		}
+	}))
+	keys(u, "Ge")
+	remove()
+	if md, _ := z.GetNoteMeta(4); md.Title != "Cookbook" || !strings.HasSuffix(edited, "body") {
+		t.Fatalf("Edit didn't update the note: %+v", md)
+	}
+	if len(updated) != 1 || updated[0] != 4 {
+		t.Fatalf("Edit sent update events for %v", updated)
+	}
+
+	// Changes made by another program show up, and aren't undone
+	p, _ := z.GetNoteBodyPath(0)
+	other, err := zk.NewZK(filepath.Dir(filepath.Dir(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := other.NewNote(0, "Garden\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AddAlias(id, "garden"); err != nil {
+		t.Fatal(err)
+	}
+	keys(u, "g")
+	if got := u.titles(); !strings.HasSuffix(got, " Garden") {
+		t.Fatalf("New note not shown: %q", got)
+	}
+	keys(u, "Gabeds")
+	u.handle(keyEnter)
+	z.Close()
+	if other, err = zk.NewZK(filepath.Dir(filepath.Dir(p))); err != nil {
+		t.Fatal(err)
+	}
+	aliases := other.Aliases()
+	if aliases["garden"] != id || aliases["beds"] != id {
+		t.Fatalf("Bad aliases: %v", aliases)
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("a\x1b[A\x1b[6~\r\x7fé"))
+	for _, want := range []rune{'a', keyUp, keyPgDown, keyEnter, keyBackspace, 'é'} {
+		if k, err := readKey(r); err != nil || k != want {
+			t.Fatalf("Got key %v (%v), wanted %v", k, err, want)
+		}
+	}
+}
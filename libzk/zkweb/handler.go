@@ -0,0 +1,350 @@
+// Package zkweb serves a browser-based interface to a zk. Pages are
+// rendered on the server using only embedded templates and stylesheets,
+// so it works without any network access and without JavaScript.
+package zkweb
+
+import (
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	zk "github.com/floren/zk/libzk"
+	"github.com/floren/zk/libzk/internal/markdown"
+	"github.com/floren/zk/libzk/internal/origin"
+)
+
+//go:embed templates static
+var content embed.FS
+
+var pages = map[string]*template.Template{}
+
+func init() {
+	for _, p := range []string{"note", "edit", "search"} {
+		pages[p] = template.Must(template.ParseFS(content, "templates/layout.html", "templates/"+p+".html"))
+	}
+}
+
+// Handler serves the web interface for a single ZK.
+type Handler struct {
+	z      *zk.ZK
+	mu     sync.Locker
+	static http.Handler
+}
+
+// NewHandler returns an http.Handler serving the web interface for
+// the given zk. Every request holds mu while it uses the ZK; pass the
+// same Locker to anything else using the ZK concurrently, e.g. a
+// zkhttp.Handler.
+func NewHandler(z *zk.ZK, mu sync.Locker) *Handler {
+	if mu == nil {
+		mu = &sync.Mutex{}
+	}
+	return &Handler{z: z, mu: mu, static: http.FileServer(http.FS(content))}
+}
+
+// treeNode is one entry in the navigation tree.
+type treeNode struct {
+	Note     zk.NoteMeta
+	Current  bool
+	Children []treeNode
+}
+
+// page holds everything any of the templates might need.
+type page struct {
+	Title   string
+	Error   string
+	Tree    treeNode
+	Query   string
+	Files   bool
+	Note    zk.NoteMeta
+	Parent  zk.NoteMeta
+	Aliases []string
+	Body    template.HTML
+	Raw     string
+	Orig    string
+	Results []zk.GrepResult
+
+	Subnotes []zk.NoteMeta
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/static/") {
+		h.static.ServeHTTP(w, r)
+		return
+	}
+
+	if !origin.Safe(r) && !origin.Same(r) {
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Catch up with anyone else using the zk
+	if err := h.z.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 3)
+	switch parts[0] {
+	case "":
+		http.Redirect(w, r, "/note/0", http.StatusFound)
+		return
+	case "search":
+		h.search(w, r)
+		return
+	}
+
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := h.z.ResolveNoteId(parts[1])
+	if err == nil {
+		_, err = h.z.GetNoteMeta(id)
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := h.post(w, r, parts[0], id); err != nil {
+			h.showNote(w, id, err.Error())
+		}
+		// Don't let the state file fall behind while we run
+		h.z.Sync()
+		return
+	}
+
+	switch parts[0] {
+	case "note":
+		h.showNote(w, id, "")
+	case "edit":
+		h.edit(w, id, "", "")
+	case "file":
+		if len(parts) != 3 {
+			http.NotFound(w, r)
+			return
+		}
+		p, err := h.z.GetFilePath(id, parts[2])
+		if err != nil || strings.Contains(parts[2], "/") {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// post carries out a form submission, then redirects back to the note.
+func (h *Handler) post(w http.ResponseWriter, r *http.Request, action string, id int) error {
+	var err error
+	switch action {
+	case "new":
+		var nid int
+		body := normalize(r.FormValue("body"))
+		if strings.TrimSpace(body) == "" {
+			return fmt.Errorf("the new note is empty")
+		}
+		if nid, err = h.z.NewNote(id, body); err == nil {
+			id = nid
+		}
+	case "edit":
+		note, err := h.z.GetNote(id)
+		if err != nil {
+			return err
+		}
+		body := normalize(r.FormValue("body"))
+		if r.FormValue("orig") != hash(note.Body) {
+			h.edit(w, id, body, "The note was changed by somebody else while you were editing it. Your version is below; saving it again will overwrite their changes.")
+			return nil
+		}
+		if err := h.z.UpdateNote(id, body); err != nil {
+			return err
+		}
+	case "append":
+		text := normalize(r.FormValue("body"))
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		err = h.z.AppendNote(id, text)
+	case "link", "unlink":
+		var child int
+		if child, err = h.z.ResolveNoteId(strings.TrimSpace(r.FormValue("child"))); err != nil {
+			return fmt.Errorf("no such note %q", r.FormValue("child"))
+		}
+		if action == "link" {
+			err = h.z.LinkNote(id, child)
+		} else {
+			err = h.z.UnlinkNote(id, child)
+		}
+	case "alias":
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			return fmt.Errorf("alias name is empty")
+		}
+		err = h.z.AddAlias(id, name)
+	case "unalias":
+		h.z.RemoveAlias(r.FormValue("name"))
+	case "attach":
+		err = h.attach(r, id)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, fmt.Sprintf("/note/%d", id), http.StatusSeeOther)
+	return nil
+}
+
+func (h *Handler) attach(r *http.Request, id int) error {
+	f, hdr, err := r.FormFile("file")
+	if err != nil {
+		return fmt.Errorf("no file uploaded: %v", err)
+	}
+	defer f.Close()
+	// AddFile wants a path, so spool the upload to a temporary file
+	tmp, err := ioutil.TempFile("", "zkupload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, f)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return h.z.AddFile(id, tmp.Name(), filepath.Base(hdr.Filename))
+}
+
+func (h *Handler) showNote(w http.ResponseWriter, id int, errMsg string) {
+	note, err := h.z.GetNote(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := h.newPage(note.NoteMeta, note.Title)
+	p.Error = errMsg
+	p.Body = template.HTML(markdown.Render(note.Body, func(u string) string {
+		// Relative links refer to the note's attachments
+		if strings.HasPrefix(u, "/") || strings.HasPrefix(u, "#") {
+			return u
+		}
+		return fmt.Sprintf("/file/%d/%s", id, (&url.URL{Path: u}).EscapedPath())
+	}))
+	p.Parent, _ = h.z.GetNoteMeta(note.Parent)
+	for name, aid := range h.z.Aliases() {
+		if aid == id {
+			p.Aliases = append(p.Aliases, name)
+		}
+	}
+	sort.Strings(p.Aliases)
+	if ids, err := h.z.GetSubnotes(id); err == nil {
+		for _, sn := range ids {
+			if md, err := h.z.GetNoteMeta(sn); err == nil {
+				p.Subnotes = append(p.Subnotes, md)
+			}
+		}
+	}
+	render(w, "note", p)
+}
+
+func (h *Handler) edit(w http.ResponseWriter, id int, body, errMsg string) {
+	note, err := h.z.GetNote(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := h.newPage(note.NoteMeta, "Edit "+note.Title)
+	p.Error = errMsg
+	p.Raw = note.Body
+	if body != "" {
+		p.Raw = body
+	}
+	p.Orig = hash(note.Body)
+	render(w, "edit", p)
+}
+
+func (h *Handler) search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	p := h.newPage(zk.NoteMeta{Id: -1}, "Search")
+	p.Query = q
+	p.Files = r.URL.Query().Get("files") != ""
+	if q == "" {
+		render(w, "search", p)
+		return
+	}
+	var c chan *zk.GrepResult
+	var err error
+	if p.Files {
+		c, err = h.z.GrepFiles(q, []int{})
+	} else {
+		c, err = h.z.Grep(q, []int{})
+	}
+	if err != nil {
+		p.Error = err.Error()
+	} else {
+		for res := range c {
+			if res.Error == nil {
+				p.Results = append(p.Results, *res)
+			}
+		}
+	}
+	render(w, "search", p)
+}
+
+func (h *Handler) newPage(current zk.NoteMeta, title string) *page {
+	return &page{
+		Title: title,
+		Note:  current,
+		Tree:  h.tree(0, current.Id, map[int]bool{}),
+	}
+}
+
+// tree builds the navigation tree below id, refusing to descend into a
+// note which is already above it.
+func (h *Handler) tree(id, current int, path map[int]bool) treeNode {
+	md, _ := h.z.GetNoteMeta(id)
+	t := treeNode{Note: md, Current: id == current}
+	if path[id] {
+		return t
+	}
+	path[id] = true
+	if ids, err := h.z.GetSubnotes(id); err == nil {
+		for _, sn := range ids {
+			t.Children = append(t.Children, h.tree(sn, current, path))
+		}
+	}
+	delete(path, id)
+	return t
+}
+
+func render(w http.ResponseWriter, name string, p *page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pages[name].ExecuteTemplate(w, "layout", p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// normalize converts browser line endings to Unix ones.
+func normalize(s string) string {
+	return strings.Replace(s, "\r\n", "\n", -1)
+}
+
+func hash(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
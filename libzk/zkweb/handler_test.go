@@ -0,0 +1,120 @@
+package zkweb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	zk "github.com/floren/zk/libzk"
+)
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := zk.InitZK(dir); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zk.NewZK(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(z, nil))
+	defer srv.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %v: %v", path, resp.Status)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+	post := func(path string, v url.Values) {
+		resp, err := http.PostForm(srv.URL+path, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST %v: %v", path, resp.Status)
+		}
+	}
+
+	if page := get("/"); !strings.Contains(page, "Top Level") {
+		t.Fatalf("Root page doesn't show note 0:\n%s", page)
+	}
+	if !strings.Contains(get("/static/style.css"), "body") {
+		t.Fatal("Stylesheet not served")
+	}
+
+	// Create a note, alias it, and append to it
+	post("/new/0", url.Values{"body": {"Groceries\r\n* milk\r\n"}})
+	post("/alias/1", url.Values{"name": {"shop"}})
+	post("/append/shop", url.Values{"body": {"* eggs"}})
+	note, err := z.GetNote(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Body != "Groceries\n* milk\n* eggs\n" {
+		t.Fatalf("Bad body: %q", note.Body)
+	}
+	if page := get("/note/1"); !strings.Contains(page, "<li>eggs</li>") || !strings.Contains(page, "shop") {
+		t.Fatalf("Note page is missing content:\n%s", page)
+	}
+
+	// Edit it, with and without a stale original
+	post("/edit/1", url.Values{"body": {"Shopping\n"}, "orig": {"stale"}})
+	if note, _ = z.GetNote(1); note.Title != "Groceries" {
+		t.Fatal("Stale edit was saved")
+	}
+	edit := get("/edit/1")
+	i := strings.Index(edit, `name="orig" value="`) + len(`name="orig" value="`)
+	post("/edit/1", url.Values{"body": {"Shopping\n"}, "orig": {edit[i : i+64]}})
+	if note, _ = z.GetNote(1); note.Title != "Shopping" {
+		t.Fatalf("Edit wasn't saved: %+v", note)
+	}
+
+	// Unlink and relink
+	post("/unlink/0", url.Values{"child": {"1"}})
+	if len(z.GetOrphans()) != 1 {
+		t.Fatal("Note wasn't unlinked")
+	}
+	post("/link/0", url.Values{"child": {"shop"}})
+	if len(z.GetOrphans()) != 0 {
+		t.Fatal("Note wasn't linked")
+	}
+
+	if page := get("/search?q=Shop"); !strings.Contains(page, `href="/note/1"`) {
+		t.Fatalf("Search didn't find the note:\n%s", page)
+	}
+
+	// A form on another site can't change anything
+	req, err := http.NewRequest("POST", srv.URL+"/new/0", strings.NewReader("body=Forged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Cross-site POST: %v", resp.Status)
+	}
+	if subnotes, _ := z.GetSubnotes(0); len(subnotes) != 1 {
+		t.Fatalf("Cross-site POST made a note: %v", subnotes)
+	}
+}
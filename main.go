@@ -12,19 +12,24 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	zk "github.com/floren/zk/libzk"
+	"github.com/floren/zk/libzk/zkhttp"
+	"github.com/floren/zk/libzk/zklsp"
+	"github.com/floren/zk/libzk/zktui"
 	"io"
 )
 
 var (
 	configFile = flag.String("config", "", "Path to alternate config file")
+	noHooks    = flag.Bool("nohooks", false, "Don't run the zk's hook scripts")
 
 	cfg Config
 	z   *zk.ZK
@@ -93,6 +98,7 @@ func readConfig() error {
 
 func main() {
 	var err error
+	flag.Usage = func() { printUsage(os.Stderr) }
 	flag.Parse()
 
 	// All commands take the form "zk <command> <command args>"
@@ -106,101 +112,91 @@ func main() {
 		args = flag.Args()[1:]
 	}
 
-	// If the command was "init", we actually handle that *before* reading the
-	// config file, because we're going to re-write a new config.
-	if cmd == "init" {
-		// Make sure we have a single argument
-		if len(args) != 1 {
-			log.Fatalf("Usage: zk init <path>")
-		}
-		root := args[0]
-		// First we attempt to open an existing ZK if it's pre-populated
-		if z, err = zk.NewZK(root); err != nil {
-			// NewZK failed, we better call init
-			if err := zk.InitZK(root); err != nil {
-				// If both calls failed, something bad has happened
-				log.Fatalf("Couldn't initialize new zk: %v", err)
-			}
-		}
-		// If we got this far, one of the calls succeeded.
-		cfg.ZKRoot = root
-		if err := writeConfig(); err != nil {
-			log.Fatalf("Couldn't write-back config: %v", err)
-		}
+	// Some commands, like init, run before the config is read
+	if c := findCommand(cmd); c != nil && c.noZK {
+		c.exec(args)
 		return
 	}
 
 	if err := readConfig(); err != nil {
-		log.Fatalf("Failed to read config: %v", err)
+		fatalf("Failed to read config: %v", err)
 	}
 
 	if z, err = zk.NewZK(cfg.ZKRoot); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	defer z.Close()
+	if !*noHooks {
+		z.AddObserver(zk.ObserverFunc(runHook))
+	}
 
-	switch cmd {
-	case "show", "s":
-		showNote(args)
-	case "new", "n":
-		newNote(args)
-	case "up", "u":
-		if cfg.CurrentNoteId != 0 {
-			if md, err := z.GetNoteMeta(cfg.CurrentNoteId); err != nil {
-				log.Fatalf("Couldn't get info about current note: %v", err)
-			} else {
-				changeLevel(md.Parent)
-				showNote([]string{})
-			}
+	run(cmd, args)
+	writeConfig()
+}
+
+// run carries out a single command. A lone note id or alias in place
+// of the command changes to that note.
+func run(cmd string, args []string) {
+	if c := findCommand(cmd); c != nil {
+		c.exec(args)
+		return
+	}
+	if cmd == "" {
+		// just show the current note
+		showNote([]string{})
+		return
+	}
+	id, _, err := getNoteId([]string{cmd})
+	if err != nil || len(args) > 0 {
+		fatalf("unknown command %q; run \"zk help\" for a list", cmd)
+	}
+	// we've been given an argument, try to change to the specified note
+	changeLevel(id)
+	showNote([]string{})
+}
+
+// initZK makes the zk at a path the current one, creating it if need
+// be. It runs *before* reading the config file, because we're going to
+// re-write a new config.
+func initZK(args []string) {
+	if inShell {
+		fatalf("init can't be run from the shell")
+	}
+	root := args[0]
+	// First we attempt to open an existing ZK if it's pre-populated
+	if _, err := zk.NewZK(root); err != nil {
+		// NewZK failed, we better call init
+		if err := zk.InitZK(root); err != nil {
+			// If both calls failed, something bad has happened
+			fatalf("Couldn't initialize new zk: %v", err)
 		}
-	case "edit", "e":
-		editNote(args)
-	case "append", "a":
-		appendNote(args)
-	case "print", "p":
-		printNote(args)
-	case "tree", "t":
-		printTree(args)
-	case "link":
-		linkNote(args)
-	case "unlink":
-		unlinkNote(args)
-	case "addfile":
-		addFile(args)
-	case "listfiles", "ls":
-		listFiles(args)
-	case "grep":
-		grep(args)
-	case "tgrep":
-		tgrep(args)
-	case "rescan":
-		z.Rescan()
-	case "orphans":
-		orphans(args)
-	case "alias":
-		alias(args)
-	case "unalias":
-		unalias(args)
-	case "aliases":
-		aliases()
-	default:
-		if flag.NArg() == 1 {
-			id, _, err := getNoteId(flag.Args())
-			if err != nil {
-				log.Fatalf("couldn't parse %v as a note id: %v", flag.Arg(0), err)
-			}
-			// we've been given an argument, try to change to the specified note
-			changeLevel(id)
-			showNote([]string{})
-		} else if flag.NArg() == 0 {
-			// just show the current note
-			showNote([]string{})
+	}
+	// If we got this far, one of the calls succeeded.
+	cfg.ZKRoot = root
+	if err := writeConfig(); err != nil {
+		fatalf("Couldn't write-back config: %v", err)
+	}
+}
+
+func up(args []string) {
+	if cfg.CurrentNoteId != 0 {
+		if md, err := z.GetNoteMeta(cfg.CurrentNoteId); err != nil {
+			fatalf("Couldn't get info about current note: %v", err)
 		} else {
-			log.Fatalf("Invalid command")
+			changeLevel(md.Parent)
+			showNote([]string{})
 		}
 	}
+}
 
-	writeConfig()
+func rescan(args []string) {
+	z.Rescan()
+}
+
+func lsp(args []string) {
+	if err := zklsp.NewServer(z).Serve(stdin(), os.Stdout); err != nil {
+		fatal(err)
+	}
 }
 
 // getNoteId takes a slice of arguments and, assuming the first
@@ -228,49 +224,65 @@ func newNote(args []string) {
 
 	targetNote, args, err = getNoteId(args)
 	if err != nil {
-		log.Fatalf("failed to parse specified note %v: %v", args[0], err)
-	}
-	// You're not allowed to specify any arguments after the (optional) parent ID
-	if len(args) != 0 {
-		log.Fatalf("usage: zk new [parent]")
+		fatalf("failed to parse specified note %v: %v", args[0], err)
 	}
 	// read in a body
+	in := stdin()
 	fmt.Fprintf(os.Stderr, "Enter note; the first line will be the title. Ctrl-D when done.\n")
-	body, err := io.ReadAll(os.Stdin)
+	body, err := io.ReadAll(in)
 	if err != nil {
-		log.Fatalf("couldn't read body text: %v", err)
+		fatalf("couldn't read body text: %v", err)
+	}
+
+	// Look for related notes before the new one exists, so it doesn't find itself
+	var rel []zk.Relation
+	if newSuggest {
+		if rel, err = z.RelatedText(string(body), 5); err != nil {
+			fatalf("couldn't find related notes: %v", err)
+		}
 	}
 
 	newId, err := z.NewNote(targetNote, string(body))
 	if err != nil {
-		log.Fatalf("couldn't create note: %v", err)
+		fatalf("couldn't create note: %v", err)
 	}
 	fmt.Fprintf(os.Stderr, "Created new note %v\n", newId)
+	if jsonMode() {
+		md, _ := z.GetNoteMeta(newId)
+		emitJSON(jsonNote{Version: jsonVersion, Note: md})
+	}
+
+	if len(rel) > 0 {
+		fmt.Fprintf(os.Stderr, "Related notes; use \"zk link %d <id>\" to file the new note under one:\n", newId)
+		for _, r := range rel {
+			fmt.Fprintf(os.Stderr, "	%s\n", formatNoteSummary(r.Note))
+		}
+	}
 }
 
 func showNote(args []string) {
 	var targetNote int
 	var err error
 
-	targetNote, args, err = getNoteId(args)
+	targetNote, _, err = getNoteId(args)
 	if err != nil {
-		log.Fatalf("failed to parse specified note %v: %v", args[0], err)
-	}
-	// You're not allowed to specify any arguments after the (optional) note ID
-	if len(args) != 0 {
-		log.Fatalf("usage: zk show [note]")
+		fatalf("failed to parse specified note %v: %v", args[0], err)
 	}
 
 	note, err := z.GetNoteMeta(targetNote)
 	if err != nil {
-		log.Fatalf("couldn't read note: %v", err)
+		fatalf("couldn't read note: %v", err)
 	}
 
+	ids, err := z.GetSubnotes(targetNote)
+	if err != nil {
+		fatalf("couldn't get subnotes: %v", err)
+	}
 	var subnotes []zk.NoteMeta
-	for _, n := range note.Subnotes {
+	for _, n := range ids {
 		sn, err := z.GetNoteMeta(n)
 		if err != nil {
-			log.Fatalf("failed to read subnote %v: %v", n, err)
+			fatalf("failed to read subnote %v: %v", n, err)
 		}
 		subnotes = append(subnotes, sn)
 	}
@@ -278,6 +290,13 @@ func showNote(args []string) {
 	// Sort the subnotes by ID
 	sort.Slice(subnotes, func(i, j int) bool { return subnotes[i].Id < subnotes[j].Id })
 
+	if jsonMode() {
+		if subnotes == nil {
+			subnotes = []zk.NoteMeta{}
+		}
+		emitJSON(jsonShow{Version: jsonVersion, Note: note, Subnotes: subnotes})
+		return
+	}
 	fmt.Printf("%d %s\n", note.Id, note.Title)
 	for _, sn := range subnotes {
 		fmt.Printf("	%d %s\n", sn.Id, sn.Title)
@@ -286,7 +305,7 @@ func showNote(args []string) {
 
 func changeLevel(id int) {
 	if _, err := z.GetNoteMeta(id); err != nil {
-		log.Fatalf("invalid note id %v", id)
+		fatalf("invalid note id %v", id)
 	}
 
 	cfg.CurrentNoteId = id
@@ -304,27 +323,43 @@ func addFile(args []string) {
 		// note number followed by filename
 		target, args, err = getNoteId(args)
 		if err != nil {
-			log.Fatalf("failed to parse specified note %v: %v", args[0], err)
+			fatalf("failed to parse specified note %v: %v", args[0], err)
 		}
 		srcPath = args[0]
-	default:
-		log.Fatalf("usage: zk addfile [note id] <filename>")
 	}
 	// Add the file
 	// TODO: allow the user to specify an alternate name
 	if err := z.AddFile(target, srcPath, ""); err != nil {
-		log.Fatalf("Failed to add file: %v", err)
+		fatalf("Failed to add file: %v", err)
 	}
 
 	// Re-read the note to update the metadata
 	n, err := z.GetNote(target)
 	if err != nil {
-		log.Fatalf("Failed to read note %v: %v", target, err)
+		fatalf("Failed to read note %v: %v", target, err)
 	}
-	fmt.Printf("Files for [%d] %v:\n", n.Id, n.Title)
-	for _, f := range n.Files {
-		fmt.Printf("	%v\n", f)
+	printFiles(n.NoteMeta)
+}
+
+func rmFile(args []string) {
+	var err error
+	target := cfg.CurrentNoteId
+	switch len(args) {
+	case 1:
+	case 2:
+		target, args, err = getNoteId(args)
+		if err != nil {
+			fatalf("failed to parse specified note %v: %v", args[0], err)
+		}
 	}
+	if err := z.RemoveFile(target, args[0]); err != nil {
+		fatalf("Failed to remove file: %v", err)
+	}
+	md, err := z.GetNoteMeta(target)
+	if err != nil {
+		fatalf("Failed to read note %v: %v", target, err)
+	}
+	printFiles(md)
 }
 
 func listFiles(args []string) {
@@ -333,13 +368,25 @@ func listFiles(args []string) {
 	if len(args) == 1 {
 		target, _, err = getNoteId(args)
 		if err != nil {
-			log.Fatalf("failed to parse specified note %v: %v", args[0], err)
+			fatalf("failed to parse specified note %v: %v", args[0], err)
 		}
 	}
 	// Re-read the note to update the metadata
 	n, err := z.GetNote(target)
 	if err != nil {
-		log.Fatalf("Failed to read note %v: %v", target, err)
+		fatalf("Failed to read note %v: %v", target, err)
+	}
+	printFiles(n.NoteMeta)
+}
+
+func printFiles(n zk.NoteMeta) {
+	if jsonMode() {
+		files := n.Files
+		if files == nil {
+			files = []string{}
+		}
+		emitJSON(jsonFiles{Version: jsonVersion, Note: n, Files: files})
+		return
 	}
 	fmt.Printf("Files for [%d] %v:\n", n.Id, n.Title)
 	for _, f := range n.Files {
@@ -347,13 +394,27 @@ func listFiles(args []string) {
 	}
 }
 
+// tui runs the full-screen interface, leaving the note selected on
+// exit as the current note.
+func tui(args []string) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vim"
+	}
+	id, err := zktui.Run(z, cfg.CurrentNoteId, editor)
+	if err != nil {
+		fatal(err)
+	}
+	changeLevel(id)
+}
+
 func editNote(args []string) {
 	var err error
 	target := cfg.CurrentNoteId
 	if len(args) == 1 {
 		target, _, err = getNoteId(args)
 		if err != nil {
-			log.Fatalf("failed to parse specified note %v: %v", args[0], err)
+			fatalf("failed to parse specified note %v: %v", args[0], err)
 		}
 	}
 	// TODO: add editor to config
@@ -363,14 +424,29 @@ func editNote(args []string) {
 	}
 	p, err := z.GetNoteBodyPath(target)
 	if err != nil {
-		log.Fatalf("Couldn't get path to note body: %v", err)
+		fatalf("Couldn't get path to note body: %v", err)
+	}
+	before, err := z.GetNote(target)
+	if err != nil {
+		fatalf("Couldn't read note: %v", err)
 	}
 	cmd := exec.Command(editor, p)
-	cmd.Stdin = os.Stdin
+	cmd.Stdin = stdin()
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Start()
 	cmd.Wait()
+
+	// Save the edited body through the zk, so hooks see the change
+	after, err := z.GetNote(target)
+	if err != nil {
+		fatalf("Couldn't read edited note: %v", err)
+	}
+	if after.Body != before.Body {
+		if err := z.UpdateNote(target, after.Body); err != nil {
+			fatalf("Couldn't update note: %v", err)
+		}
+	}
 }
 
 func appendNote(args []string) {
@@ -379,27 +455,23 @@ func appendNote(args []string) {
 	if len(args) == 1 {
 		target, _, err = getNoteId(args)
 		if err != nil {
-			log.Fatalf("failed to parse specified note %v: %v", args[0], err)
+			fatalf("failed to parse specified note %v: %v", args[0], err)
 		}
 	}
-	p, err := z.GetNoteBodyPath(target)
-	if err != nil {
-		log.Fatalf("Couldn't get path to note body: %v", err)
-	}
-	w, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Couldn't open note body: %v", err)
+	if _, err := z.GetNoteMeta(target); err != nil {
+		fatal(err)
 	}
-	defer w.Close()
 
 	// Now read from stdin
+	in := stdin()
 	fmt.Fprintf(os.Stderr, "Ctrl-D when done.\n")
-	body, err := io.ReadAll(os.Stdin)
+	body, err := io.ReadAll(in)
 	if err != nil {
-		log.Fatalf("couldn't read body text: %v", err)
+		fatalf("couldn't read body text: %v", err)
+	}
+	if err := z.AppendNote(target, string(body)); err != nil {
+		fatalf("Couldn't append to note: %v", err)
 	}
-	w.Write(body)
-	w.Sync()
 }
 
 func printNote(args []string) {
@@ -408,62 +480,49 @@ func printNote(args []string) {
 	if len(args) == 1 {
 		target, _, err = getNoteId(args)
 		if err != nil {
-			log.Fatalf("failed to parse specified note %v: %v", args[0], err)
+			fatalf("failed to parse specified note %v: %v", args[0], err)
 		}
 	}
-	if note, err := z.GetNote(target); err == nil {
+	if note, err := z.GetNote(target); err == nil && jsonMode() {
+		emitJSON(jsonBody{Version: jsonVersion, Note: note.NoteMeta, Body: note.Body})
+	} else if err == nil {
 		fmt.Print(note.Body)
 	} else {
-		log.Fatalf("couldn't read note: %v", err)
+		fatalf("couldn't read note: %v", err)
 	}
 }
 
 // Arg 0: source
 // Arg 1: target
 func linkNote(args []string) {
-	var src, dst int
-	var err error
-	if len(args) == 2 {
-		src, args, err = getNoteId(args)
-		if err != nil {
-			log.Fatalf("failed to parse source note %v: %v", args[0], err)
-		}
-		dst, args, err = getNoteId(args)
-		if err != nil {
-			log.Fatalf("failed to parse destination note %v: %v", args[0], err)
-		}
-	} else {
-		log.Fatalf("must specify source (note to be linked) and destination (note into which it will be linked)")
+	src, args, err := getNoteId(args)
+	if err != nil {
+		fatalf("failed to parse source note %v: %v", args[0], err)
+	}
+	dst, args, err := getNoteId(args)
+	if err != nil {
+		fatalf("failed to parse destination note %v: %v", args[0], err)
 	}
 	if err := z.LinkNote(dst, src); err != nil {
-		log.Fatalf("Failed to link %d to %d: %v", src, dst, err)
+		fatalf("Failed to link %d to %d: %v", src, dst, err)
 	}
 }
 
 // Unlink the specified note from the current note
 func unlinkNote(args []string) {
-	var err error
 	target := cfg.CurrentNoteId
-	var child int
+	child, args, err := getNoteId(args)
+	if err != nil {
+		fatalf("failed to parse child note %v: %v", args[0], err)
+	}
 	if len(args) == 1 {
-		child, args, err = getNoteId(args)
-		if err != nil {
-			log.Fatalf("failed to parse child note %v: %v", args[0], err)
-		}
-	} else if len(args) == 2 {
-		child, args, err = getNoteId(args)
-		if err != nil {
-			log.Fatalf("failed to parse child note %v: %v", args[0], err)
-		}
 		target, args, err = getNoteId(args)
 		if err != nil {
-			log.Fatalf("failed to parse child note %v: %v", args[0], err)
+			fatalf("failed to parse parent note %v: %v", args[0], err)
 		}
-	} else {
-		log.Fatal("usage: zk unlink <child> [parent] ")
 	}
 	if err := z.UnlinkNote(target, child); err != nil {
-		log.Fatalf("Failed to unlink %d from %d: %v", child, target, err)
+		fatalf("Failed to unlink %d from %d: %v", child, target, err)
 	}
 }
 
@@ -473,23 +532,67 @@ func printTree(args []string) {
 	if len(args) == 1 {
 		target, _, err = getNoteId(args)
 		if err != nil {
-			log.Fatalf("failed to parse specified note %v: %v", args[0], err)
+			fatalf("failed to parse specified note %v: %v", args[0], err)
 		}
 	}
-	printTreeRecursive(0, target)
+	if *jsonOutput && !*jsonlOutput {
+		tree := buildTree(target, map[int]bool{})
+		tree.Version = jsonVersion
+		emitJSON(tree)
+		return
+	}
+	printTreeRecursive(0, target, map[int]bool{})
 }
 
-func printTreeRecursive(depth, id int) {
+// buildTree is the JSON equivalent of printTreeRecursive.
+func buildTree(id int, path map[int]bool) jsonTree {
+	note, err := z.GetNoteMeta(id)
+	if err != nil {
+		fatalf("Problem getting note %d in recursive tree print: %v", id, err)
+	}
+	t := jsonTree{Note: note, Children: []jsonTree{}}
+	if path[id] {
+		return t
+	}
+	subnotes, err := z.GetSubnotes(id)
+	if err != nil {
+		fatalf("Problem getting subnotes of %d in recursive tree print: %v", id, err)
+	}
+	path[id] = true
+	for _, sn := range subnotes {
+		t.Children = append(t.Children, buildTree(sn, path))
+	}
+	delete(path, id)
+	return t
+}
+
+// printTreeRecursive prints the tree below id. The path map tracks the notes
+// above us, so a note linked (or found by a saved search) beneath one of its
+// own descendants is printed but not descended into again.
+func printTreeRecursive(depth, id int, path map[int]bool) {
 	if note, err := z.GetNoteMeta(id); err == nil {
-		for i := 0; i < depth; i++ {
-			fmt.Printf("	")
+		if *jsonlOutput {
+			emitJSON(jsonTreeLine{Version: jsonVersion, Depth: depth, Note: note})
+		} else {
+			for i := 0; i < depth; i++ {
+				fmt.Printf("	")
+			}
+			fmt.Printf("%s\n", formatNoteSummary(note))
 		}
-		fmt.Printf("%s\n", formatNoteSummary(note))
-		for _, sn := range note.Subnotes {
-			printTreeRecursive(depth+1, sn)
+		if path[id] {
+			return
 		}
+		subnotes, err := z.GetSubnotes(id)
+		if err != nil {
+			fatalf("Problem getting subnotes of %d in recursive tree print: %v", id, err)
+		}
+		path[id] = true
+		for _, sn := range subnotes {
+			printTreeRecursive(depth+1, sn, path)
+		}
+		delete(path, id)
 	} else {
-		log.Fatalf("Problem getting note %d in recursive tree print: %v", id, err)
+		fatalf("Problem getting note %d in recursive tree print: %v", id, err)
 	}
 }
 
@@ -498,25 +601,23 @@ func formatNoteSummary(note zk.NoteMeta) string {
 }
 
 func grep(args []string) {
-	if len(args) == 0 {
-		log.Fatalf("Must give a pattern to grep for")
-	}
 	// Just in case somebody leaves off quotes, we'll just join all args by space
 	pattern := strings.Join(args, " ")
 
-	if c, err := z.Grep(pattern, []int{}); err != nil {
-		log.Fatal(err)
+	var c chan *zk.GrepResult
+	var err error
+	if grepFiles {
+		c, err = z.GrepFiles(pattern, []int{})
 	} else {
-		for r := range c {
-			fmt.Printf("%d [%v]: %s\n", r.Note.Id, r.Note.Title, r.Line)
-		}
+		c, err = z.Grep(pattern, []int{})
+	}
+	if err != nil {
+		fatal(err)
 	}
+	printGrepResults(c)
 }
 
 func tgrep(args []string) {
-	if len(args) == 0 {
-		log.Fatalf("usage: zk tgrep [root id] <pattern>")
-	}
 	// Root ID is optional (current note is implied) so let's check
 	root := cfg.CurrentNoteId
 	if len(args) >= 2 {
@@ -529,22 +630,553 @@ func tgrep(args []string) {
 	// Just in case somebody leaves off quotes, we'll just join all args by space
 	pattern := strings.Join(args, " ")
 
-	if c, err := z.TreeGrep(pattern, root); err != nil {
-		log.Fatal(err)
+	var c chan *zk.GrepResult
+	var err error
+	if grepFiles {
+		c, err = z.TreeGrepFiles(pattern, root)
 	} else {
+		c, err = z.TreeGrep(pattern, root)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	printGrepResults(c)
+}
+
+func printGrepResults(c chan *zk.GrepResult) {
+	if *jsonOutput && !*jsonlOutput {
+		res := jsonGrep{Version: jsonVersion, Results: []jsonGrepResult{}}
 		for r := range c {
+			res.Results = append(res.Results, newJSONGrepResult(r))
+		}
+		emitJSON(res)
+		return
+	}
+	for r := range c {
+		if *jsonlOutput {
+			jr := newJSONGrepResult(r)
+			jr.Version = jsonVersion
+			emitJSON(jr)
+		} else if r.Error != nil {
+			fmt.Fprintf(os.Stderr, "%d [%v]: %v\n", r.Note.Id, r.Note.Title, r.Error)
+		} else if r.File != "" {
+			fmt.Printf("%d [%v] %v: %s\n", r.Note.Id, r.Note.Title, r.File, r.Line)
+		} else {
 			fmt.Printf("%d [%v]: %s\n", r.Note.Id, r.Note.Title, r.Line)
 		}
 	}
 }
 
-func orphans(args []string) {
-	if len(args) != 0 {
-		log.Fatalf("orphans command takes no arguments")
+func sed(args []string) {
+	var notes []int
+	if sedTree != "" {
+		root, _, err := getNoteId([]string{sedTree})
+		if err != nil {
+			fatalf("failed to parse specified note %v: %v", sedTree, err)
+		}
+		if notes, err = z.Subtree(root); err != nil {
+			fatal(err)
+		}
+	}
+
+	var changes []zk.Replacement
+	var err error
+	if sedUndo {
+		if len(args) != 0 {
+			findCommand("sed").usageError("-undo takes no expression")
+		}
+		changes, err = z.UndoReplace()
+	} else {
+		if len(args) != 1 {
+			findCommand("sed").usageError("")
+		}
+		var pattern, replacement string
+		if pattern, replacement, err = parseSubstitution(args[0]); err != nil {
+			fatal(err)
+		}
+		changes, err = z.Replace(pattern, replacement, notes, sedDryRun)
+	}
+	for _, c := range changes {
+		fmt.Printf("--- %s\n", formatNoteSummary(c.Note))
+		printDiff(c.Old, c.New)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if sedDryRun {
+		fmt.Fprintf(os.Stderr, "%d notes would be changed\n", len(changes))
+	} else if sedUndo {
+		fmt.Fprintf(os.Stderr, "Restored %d notes\n", len(changes))
+	} else if len(changes) > 0 {
+		fmt.Fprintf(os.Stderr, "Changed %d notes; run \"zk sed --undo\" to revert\n", len(changes))
+	}
+}
+
+// parseSubstitution splits a sed-style s/old/new/ expression. Any character
+// may be used as the delimiter, and may be escaped with a backslash. The
+// only flags accepted are "g", which is implied, and "i", which makes the
+// match case-insensitive.
+func parseSubstitution(expr string) (pattern, replacement string, err error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		err = fmt.Errorf("bad substitution %q, expected s/old/new/", expr)
+		return
+	}
+	delim := expr[1]
+	var parts []string
+	var cur []byte
+	for i := 2; i < len(expr); i++ {
+		if expr[i] == '\\' && i+1 < len(expr) && expr[i+1] == delim {
+			cur = append(cur, delim)
+			i++
+		} else if expr[i] == delim {
+			parts = append(parts, string(cur))
+			cur = nil
+		} else {
+			cur = append(cur, expr[i])
+		}
+	}
+	if len(parts) != 2 {
+		err = fmt.Errorf("bad substitution %q, expected s/old/new/", expr)
+		return
+	}
+	pattern, replacement = parts[0], parts[1]
+	for _, f := range string(cur) {
+		switch f {
+		case 'g':
+		case 'i':
+			pattern = "(?i)" + pattern
+		default:
+			err = fmt.Errorf("unknown substitution flag %q", f)
+			return
+		}
+	}
+	return
+}
+
+// printDiff prints the lines which differ between two versions of a note.
+func printDiff(a, b string) {
+	al := strings.Split(a, "\n")
+	bl := strings.Split(b, "\n")
+	// Longest common subsequence, the classic way
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			i++
+			j++
+		case j == len(bl) || (i < len(al) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Printf("-%d: %s\n", i+1, al[i])
+			i++
+		default:
+			fmt.Printf("+%d: %s\n", j+1, bl[j])
+			j++
+		}
+	}
+}
+
+func related(args []string) {
+	var err error
+	target := cfg.CurrentNoteId
+	n := 10
+	switch len(args) {
+	case 2:
+		if n, err = strconv.Atoi(args[1]); err != nil {
+			fatalf("failed to parse count %v: %v", args[1], err)
+		}
+		fallthrough
+	case 1:
+		target, _, err = getNoteId(args)
+		if err != nil {
+			fatalf("failed to parse specified note %v: %v", args[0], err)
+		}
+	}
+	rel, err := z.Related(target, n)
+	if err != nil {
+		fatalf("couldn't find related notes: %v", err)
+	}
+	for _, r := range rel {
+		fmt.Printf("%.3f %s\n", r.Score, formatNoteSummary(r.Note))
+	}
+}
+
+func saveSearch(args []string) {
+	// As with grep, join the rest of the args in case the query wasn't quoted
+	search, err := zk.ParseSearch(strings.Join(args[1:], " "))
+	if err != nil {
+		fatalf("bad query: %v", err)
+	}
+	id, err := z.NewSavedSearch(cfg.CurrentNoteId, args[0], search)
+	if err != nil {
+		fatalf("couldn't create saved search: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Created saved search %v\n", id)
+}
+
+func export(args []string) {
+	root, args, err := getNoteId(args)
+	if err != nil {
+		fatalf("failed to parse specified note %v: %v", args[0], err)
+	}
+	if len(args) == 0 {
+		if exportFormat != zk.ExportOrg {
+			findCommand("export").usageError("only org-mode can go to standard output")
+		}
+		if err := z.WriteOrg(root, os.Stdout); err != nil {
+			fatalf("Export failed: %v", err)
+		}
+		return
+	}
+	if err := z.Export(root, exportFormat, args[0]); err != nil {
+		fatalf("Export failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported to %v\n", args[0])
+}
+
+// importFormats are the kinds of file zk import understands.
+var importFormats = []string{"markdown", "org"}
+
+func importNotes(args []string) {
+	var imp func(dir string, parent int) ([]int, error)
+	switch args[0] {
+	case "markdown":
+		imp = z.ImportMarkdown
+	case "org":
+		imp = z.ImportOrg
+	default:
+		fatalf("can't import %q; try %v", args[0], strings.Join(importFormats, " or "))
+	}
+	parent := cfg.CurrentNoteId
+	if len(args) == 3 {
+		var err error
+		if parent, _, err = getNoteId(args[2:]); err != nil {
+			fatalf("failed to parse specified note %v: %v", args[2], err)
+		}
+	}
+	created, err := imp(args[1], parent)
+	if err != nil {
+		fatalf("Import failed, after creating %d notes: %v", len(created), err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d new notes\n", len(created))
+}
+
+func dump(args []string) {
+	w := io.Writer(os.Stdout)
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Create(args[0])
+		if err != nil {
+			fatalf("Dump failed: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := z.Dump(w, dumpFiles); err != nil {
+		fatalf("Dump failed: %v", err)
+	}
+}
+
+func load(args []string) {
+	var r io.Reader
+	if args[0] == "-" {
+		r = stdin()
+	} else {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fatalf("Load failed: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	if len(args) == 1 && z.Empty() {
+		if err := z.Load(r, dumpFiles); err != nil {
+			fatalf("Load failed: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Loaded %d notes\n", len(z.MetadataDump()))
+		return
+	}
+	parent := cfg.CurrentNoteId
+	if len(args) == 2 {
+		var err error
+		if parent, _, err = getNoteId(args[1:]); err != nil {
+			fatalf("failed to parse specified note %v: %v", args[1], err)
+		}
+	}
+	ids, renamed, err := z.LoadUnder(r, parent, dumpFiles)
+	if err != nil {
+		fatalf("Load failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Loaded %d notes under %d\n", len(ids), parent)
+	printRenamed(renamed)
+}
+
+func mergeRepo(args []string) {
+	other, err := zk.NewZK(args[0])
+	if err != nil {
+		fatalf("Couldn't open %v: %v", args[0], err)
+	}
+	parent := cfg.CurrentNoteId
+	if len(args) == 2 {
+		if parent, _, err = getNoteId(args[1:]); err != nil {
+			fatalf("failed to parse specified note %v: %v", args[1], err)
+		}
+	}
+	ids, renamed, err := z.Merge(other, parent)
+	if err != nil {
+		fatalf("Merge failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Merged %d notes under %d; %v's top level is now note %d\n", len(ids), parent, args[0], ids[0])
+	printRenamed(renamed)
+}
+
+// printRenamed lists the aliases a load or merge had to rename.
+func printRenamed(renamed map[string]string) {
+	var names []string
+	for name := range renamed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "Alias %q was taken; renamed it %q\n", name, renamed[name])
+	}
+}
+
+func syncZK(args []string) {
+	var peer zk.SyncPeer
+	if strings.HasPrefix(args[0], "http://") || strings.HasPrefix(args[0], "https://") {
+		c, err := zkhttp.NewSyncClient(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		peer = c
+	} else {
+		other, err := zk.NewZK(args[0])
+		if err != nil {
+			fatalf("Couldn't open %v: %v", args[0], err)
+		}
+		defer other.Close()
+		peer = other
+	}
+	res, err := z.SyncWith(peer)
+	if err == zk.ErrNoUniqueIds {
+		fatalf("Sync failed: %v; run \"zk uid -enable\" on %v", err, args[0])
+	} else if err != nil {
+		fatalf("Sync failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Synced with %v: %d notes received, %d sent, %d merged\n", args[0], res.Received, res.Sent, res.Merged)
+	for _, id := range res.Conflicts {
+		md, _ := z.GetNoteMeta(id)
+		fmt.Fprintf(os.Stderr, "Conflict: %s\n", formatNoteSummary(md))
 	}
+	if len(res.Conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "Use zk resolve to merge them\n")
+	}
+}
+
+func conflicts(args []string) {
+	conflicts, err := z.Conflicts()
+	if err != nil {
+		fatal(err)
+	}
+	for _, c := range conflicts {
+		md, err := z.GetNoteMeta(c.Id)
+		if err != nil {
+			fatal(err)
+		}
+		var what []string
+		for _, cp := range c.Copies {
+			what = append(what, fmt.Sprintf("conflict copy %d", cp))
+		}
+		what = append(what, c.Files...)
+		if c.Markers {
+			what = append(what, "conflict markers")
+		}
+		fmt.Printf("%s (%s)\n", formatNoteSummary(md), strings.Join(what, ", "))
+	}
+}
+
+func resolve(args []string) {
+	id, _, err := getNoteId(args)
+	if err != nil {
+		fatalf("failed to parse specified note %v: %v", args[0], err)
+	}
+	merged, _, err := z.MergeConflict(id)
+	if err != nil {
+		fatal(err)
+	}
+	f, err := ioutil.TempFile("", "zk-resolve-")
+	if err != nil {
+		fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(merged)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fatal(err)
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vim"
+	}
+	cmd := exec.Command(editor, f.Name())
+	cmd.Stdin = stdin()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("%v failed, leaving the note as it was: %v", editor, err)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		fatal(err)
+	}
+	if len(b) == 0 {
+		fatalf("Merge is empty, leaving the note as it was")
+	}
+	if err := z.Resolve(id, string(b)); err == zk.ErrConflictMarkers {
+		fatalf("Conflict markers remain; saved the merge so far, run zk resolve %d again to finish", id)
+	} else if err != nil {
+		fatal(err)
+	}
+}
+
+func backup(args []string) {
+	if args[0] == "-" {
+		if err := z.Backup(os.Stdout); err != nil {
+			fatalf("Backup failed: %v", err)
+		}
+		return
+	}
+	// Write to a temporary file, so a failed backup can't replace a
+	// good one
+	tmp := args[0] + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		fatalf("Backup failed: %v", err)
+	}
+	err = z.Backup(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = verifyBackup(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, args[0])
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fatalf("Backup failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Backed up %v to %v\n", cfg.ZKRoot, args[0])
+}
+
+func verifyBackup(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = zk.VerifyBackup(f)
+	return err
+}
+
+func restore(args []string) {
+	f, err := os.Open(args[0])
+	if err != nil {
+		fatalf("Restore failed: %v", err)
+	}
+	defer f.Close()
+	manifest, err := zk.Restore(f, args[1])
+	if err != nil {
+		fatalf("Restore failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d notes from %v; run \"zk init %v\" to use them\n", manifest.Notes, manifest.Created.Local().Format("2006-01-02 15:04"), args[1])
+}
+
+func uid(args []string) {
+	if uidEnable {
+		if err := z.EnableUniqueIds(); err != nil {
+			fatalf("Couldn't enable unique ids: %v", err)
+		}
+		if len(args) == 0 {
+			fmt.Fprintf(os.Stderr, "Notes now have unique ids\n")
+			return
+		}
+	}
+	id, _, err := getNoteId(args)
+	if err != nil {
+		fatalf("failed to parse specified note %v: %v", args[0], err)
+	}
+	md, err := z.GetNoteMeta(id)
+	if err != nil {
+		fatalf("couldn't read note: %v", err)
+	}
+	if md.UID == "" {
+		fatalf("note %d has no unique id; run \"zk uid -enable\" to give notes them", id)
+	}
+	fmt.Println(md.UID)
+}
+
+func watch(args []string) {
+	var w *zk.Watcher
+	var err error
+	if watchPoll != 0 {
+		w, err = z.WatchPoll(nil, watchPoll)
+	} else {
+		w, err = z.Watch(nil)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	defer w.Close()
+	fmt.Fprintf(os.Stderr, "Watching %v\n", cfg.ZKRoot)
+	for ev := range w.Events {
+		switch {
+		case jsonMode():
+			e := jsonWatchEvent{Version: jsonVersion, Op: ev.Op.String(), Note: ev.Note}
+			if ev.Error != nil {
+				e.Op, e.Error = "error", ev.Error.Error()
+			}
+			emitJSON(e)
+		case ev.Error != nil:
+			fmt.Fprintf(os.Stderr, "%v\n", ev.Error)
+		default:
+			fmt.Printf("%s (%v)\n", formatNoteSummary(ev.Note), ev.Op)
+		}
+	}
+}
+
+func orphans(args []string) {
 	orphans := z.GetOrphans()
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Id < orphans[j].Id })
+	if *jsonOutput && !*jsonlOutput {
+		if orphans == nil {
+			orphans = []zk.NoteMeta{}
+		}
+		emitJSON(jsonNotes{Version: jsonVersion, Notes: orphans})
+		return
+	}
 	for _, o := range orphans {
-		fmt.Println(formatNoteSummary(o))
+		if *jsonlOutput {
+			emitJSON(jsonNote{Version: jsonVersion, Note: o})
+		} else {
+			fmt.Println(formatNoteSummary(o))
+		}
 	}
 }
 
@@ -552,31 +1184,39 @@ func alias(args []string) {
 	var targetNote int
 	var err error
 
-	if len(args) != 2 {
-		log.Fatalf("usage: zk alias <id> <name>")
-	}
 	targetNote, args, err = getNoteId(args)
 	if err != nil {
-		log.Fatalf("failed to parse specified note %v: %v", args[0], err)
+		fatalf("failed to parse specified note %v: %v", args[0], err)
 	}
 	z.AddAlias(targetNote, args[0])
 }
 
 func unalias(args []string) {
-	if len(args) != 1 {
-		log.Fatalf("usage: zk unalias <name>")
-	}
 	z.RemoveAlias(args[0])
 }
 
-func aliases() {
+func aliases(args []string) {
 	aliases := z.Aliases()
-	for name, id := range aliases {
+	var names []string
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := jsonAliases{Version: jsonVersion, Aliases: []jsonAlias{}}
+	for _, name := range names {
+		id := aliases[name]
 		if note, err := z.GetNoteMeta(id); err != nil {
 			fmt.Fprintf(os.Stderr, "%v: points to note %v, whose metadata cannot be retrieved: %v", name, id, err)
 			continue
+		} else if *jsonlOutput {
+			emitJSON(jsonAlias{Version: jsonVersion, Name: name, Note: note})
+		} else if *jsonOutput {
+			res.Aliases = append(res.Aliases, jsonAlias{Name: name, Note: note})
 		} else {
 			fmt.Printf("%v → %v\n", name, formatNoteSummary(note))
 		}
 	}
+	if *jsonOutput && !*jsonlOutput {
+		emitJSON(res)
+	}
 }
@@ -0,0 +1,46 @@
+/*************************************************************************
+ * Copyright 2017 John Floren. All rights reserved.
+ * Contact: <john@jfloren.net>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/floren/zk/libzk/zk9p"
+	"github.com/floren/zk/libzk/zkdav"
+	"github.com/floren/zk/libzk/zkhttp"
+	"github.com/floren/zk/libzk/zkweb"
+)
+
+func serve(args []string) {
+	// The web interface shares the API's lock, since both use z
+	api := zkhttp.NewHandler(z)
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", api))
+	mux.Handle("/dav/", zkdav.NewHandler(z, api, "/dav"))
+	mux.Handle("/", zkweb.NewHandler(z, api))
+	fmt.Fprintf(os.Stderr, "Serving %v on http://%v/\n", cfg.ZKRoot, listenAddr)
+	fatal(http.ListenAndServe(listenAddr, mux))
+}
+
+func serve9p(args []string) {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Serving %v over 9P on %v\n", cfg.ZKRoot, l.Addr())
+	fatal(zk9p.NewServer(z, nil).Serve(l))
+}
+
+func serveDAV(args []string) {
+	fmt.Fprintf(os.Stderr, "Serving %v over WebDAV on http://%v/\n", cfg.ZKRoot, listenAddr)
+	fatal(http.ListenAndServe(listenAddr, zkdav.NewHandler(z, nil, "")))
+}
@@ -0,0 +1,419 @@
+/*************************************************************************
+ * Copyright 2017 John Floren. All rights reserved.
+ * Contact: <john@jfloren.net>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// inShell is set while zk shell runs a command, so that errors abandon
+// the command rather than exiting.
+var inShell bool
+
+// shellError carries a command's error back to the shell.
+type shellError string
+
+// fatalf reports an error and ends the current command. Normally that
+// means exiting, as with log.Fatalf; within zk shell, only the command
+// is abandoned.
+func fatalf(format string, v ...interface{}) {
+	if inShell {
+		panic(shellError(fmt.Sprintf(format, v...)))
+	}
+	log.Fatalf(format, v...)
+}
+
+func fatal(v ...interface{}) {
+	fatalf("%s", fmt.Sprint(v...))
+}
+
+// inScript is set while zk shell runs commands piped into it, when
+// standard input holds the rest of the script.
+var inScript bool
+
+// stdin returns standard input for a command to read. Within a shell
+// script it refuses, since reading would swallow the rest of the script.
+func stdin() io.Reader {
+	if inScript {
+		fatalf("can't read standard input in a zk shell script; it holds the rest of the script")
+	}
+	return os.Stdin
+}
+
+// shellBuiltins are the commands which only exist in the shell.
+var shellBuiltins = []string{"cd", "exit", "pwd", "quit"}
+
+// A zkShell is the state of an interactive session.
+type zkShell struct {
+	path []int // the notes walked through to reach the current one
+	prev []int // the path before the last cd
+}
+
+func shell(args []string) {
+	if len(args) != 0 {
+		fatalf("usage: zk shell")
+	}
+	sh := &zkShell{path: notePath(cfg.CurrentNoteId)}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		// Run a script, without prompting
+		inScript = true
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			if sh.exec(s.Text()) {
+				break
+			}
+		}
+		return
+	}
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	t.AutoCompleteCallback = sh.complete
+	for {
+		t.SetPrompt(sh.prompt())
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			fatal(err)
+		}
+		if w, h, err := term.GetSize(fd); err == nil && w > 0 {
+			t.SetSize(w, h)
+		}
+		line, err := t.ReadLine()
+		term.Restore(fd, state)
+		if err == io.EOF {
+			fmt.Println()
+			return
+		} else if err != nil {
+			fatal(err)
+		}
+		if sh.exec(line) {
+			return
+		}
+	}
+}
+
+func (sh *zkShell) prompt() string {
+	id := sh.path[len(sh.path)-1]
+	md, _ := z.GetNoteMeta(id)
+	title := []rune(md.Title)
+	if len(title) > 30 {
+		title = append(title[:29], '…')
+	}
+	return fmt.Sprintf("zk %d (%s)> ", id, string(title))
+}
+
+// exec runs one line of input, returning true if it's time to leave.
+func (sh *zkShell) exec(line string) bool {
+	words, err := splitWords(line)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	if len(words) == 0 {
+		return false
+	}
+	// Catch up with anyone else using the zk
+	if err := z.Reload(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	switch words[0] {
+	case "exit", "quit":
+		return true
+	case "help":
+		if len(words) > 1 {
+			runInShell("help", words[1:])
+			break
+		}
+		fmt.Println("Commands:", strings.Join(commandNames(), " "))
+		fmt.Println("Shell commands:", strings.Join(shellBuiltins, " "))
+		fmt.Println("Any note id or alias on its own changes to that note, as does cd, which also takes paths like ../3/todo.")
+		fmt.Println("Run \"help <command>\" for more about a command.")
+	case "pwd":
+		sh.pwd()
+	case "cd":
+		if err := sh.cd(words[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	default:
+		runInShell(words[0], words[1:])
+	}
+
+	// Follow the current note if a command changed it
+	if cfg.CurrentNoteId != sh.path[len(sh.path)-1] {
+		sh.path = notePath(cfg.CurrentNoteId)
+	}
+	// Don't leave anything unsaved between commands
+	z.Sync()
+	writeConfig()
+	return false
+}
+
+// runInShell runs a command, reporting rather than exiting on errors.
+func runInShell(cmd string, args []string) {
+	inShell = true
+	defer func() {
+		inShell = false
+		if r := recover(); r != nil {
+			e, ok := r.(shellError)
+			if !ok {
+				panic(r)
+			}
+			fmt.Fprintln(os.Stderr, string(e))
+		}
+	}()
+	run(cmd, args)
+}
+
+// notePath returns the path from note 0 to a note, following parents.
+func notePath(id int) []int {
+	path := []int{id}
+	for cur := id; cur != 0; {
+		md, err := z.GetNoteMeta(cur)
+		if err != nil || len(path) > len(z.MetadataDump()) {
+			// Broken or circular; just start from the top
+			return []int{0, id}
+		}
+		cur = md.Parent
+		path = append([]int{cur}, path...)
+	}
+	return path
+}
+
+func (sh *zkShell) pwd() {
+	var ids, titles []string
+	for _, id := range sh.path {
+		md, _ := z.GetNoteMeta(id)
+		if id != 0 {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		titles = append(titles, md.Title)
+	}
+	fmt.Printf("/%s (%s)\n", strings.Join(ids, "/"), strings.Join(titles, " / "))
+}
+
+// cd changes the current note. The argument is a path of note ids,
+// aliases or sub-note titles separated by slashes, where .. goes back
+// up the path and a leading slash starts from note 0. With no argument
+// it goes to note 0, and "-" goes back to the previous note.
+func (sh *zkShell) cd(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: cd [path]")
+	}
+	path, err := sh.walk(args)
+	if err != nil {
+		return err
+	}
+	sh.prev, sh.path = sh.path, path
+	changeLevel(path[len(path)-1])
+	return nil
+}
+
+func (sh *zkShell) walk(args []string) ([]int, error) {
+	if len(args) == 0 {
+		return []int{0}, nil
+	}
+	if args[0] == "-" {
+		if sh.prev == nil {
+			return nil, fmt.Errorf("no previous note")
+		}
+		return sh.prev, nil
+	}
+	path := append([]int{}, sh.path...)
+	if strings.HasPrefix(args[0], "/") {
+		path = []int{0}
+	}
+	for _, elem := range strings.Split(args[0], "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if len(path) > 1 {
+				path = path[:len(path)-1]
+			}
+		default:
+			if id, ok := subnoteNamed(path[len(path)-1], elem); ok {
+				path = append(path, id)
+			} else if id, err := z.ResolveNoteId(elem); err == nil && noteExists(id) {
+				// Anywhere else in the zk
+				path = notePath(id)
+			} else {
+				return nil, fmt.Errorf("no note %q", elem)
+			}
+		}
+	}
+	return path, nil
+}
+
+func noteExists(id int) bool {
+	_, err := z.GetNoteMeta(id)
+	return err == nil
+}
+
+// subnoteNamed finds the sub-note of a note which has the given id,
+// alias or (case-insensitively) title.
+func subnoteNamed(parent int, name string) (int, bool) {
+	subnotes, _ := z.GetSubnotes(parent)
+	want, err := z.ResolveNoteId(name)
+	for _, sn := range subnotes {
+		if err == nil && sn == want {
+			return sn, true
+		}
+	}
+	for _, sn := range subnotes {
+		if md, _ := z.GetNoteMeta(sn); strings.EqualFold(md.Title, name) {
+			return sn, true
+		}
+	}
+	return 0, false
+}
+
+// complete is the terminal's tab completion: command names for the
+// first word, and note ids or aliases after that. A word which starts
+// a note's title completes to the note's id.
+func (sh *zkShell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	word := line[start:pos]
+
+	var cands []string
+	if strings.TrimSpace(line[:start]) == "" {
+		for _, c := range append(commandNames(), shellBuiltins...) {
+			if strings.HasPrefix(c, word) {
+				cands = append(cands, c)
+			}
+		}
+	} else {
+		// Only the last element of a cd path is completed
+		prefix := ""
+		parent := -1
+		if i := strings.LastIndexByte(word, '/'); i >= 0 {
+			prefix, word = word[:i+1], word[i+1:]
+			if p, err := sh.walk([]string{prefix}); err == nil {
+				parent = p[len(p)-1]
+			}
+		}
+		for _, c := range noteCompletions(word, parent) {
+			cands = append(cands, prefix+c)
+		}
+		word = prefix + word
+	}
+	if len(cands) == 0 {
+		return "", 0, false
+	}
+	repl := cands[0]
+	for _, c := range cands[1:] {
+		for !strings.HasPrefix(c, repl) {
+			repl = repl[:len(repl)-1]
+		}
+	}
+	if len(cands) == 1 {
+		repl += " "
+	} else if len(repl) <= len(word) {
+		return "", 0, false
+	}
+	return line[:start] + repl + line[pos:], start + len(repl), true
+}
+
+// noteCompletions returns the ids and aliases matching a partial word,
+// limited to the sub-notes of parent if it isn't -1.
+func noteCompletions(word string, parent int) []string {
+	allowed := func(int) bool { return true }
+	if parent >= 0 {
+		subnotes, _ := z.GetSubnotes(parent)
+		ok := map[int]bool{}
+		for _, sn := range subnotes {
+			ok[sn] = true
+		}
+		allowed = func(id int) bool { return ok[id] }
+	}
+	seen := map[string]bool{}
+	var cands []string
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			cands = append(cands, s)
+		}
+	}
+	for name, id := range z.Aliases() {
+		if strings.HasPrefix(name, word) && allowed(id) {
+			add(name)
+		}
+	}
+	lower := strings.ToLower(word)
+	for id, md := range z.MetadataDump() {
+		if !allowed(id) {
+			continue
+		}
+		if s := strconv.Itoa(id); strings.HasPrefix(s, word) {
+			add(s)
+		} else if word != "" && strings.HasPrefix(strings.ToLower(md.Title), lower) {
+			add(s)
+		}
+	}
+	sort.Strings(cands)
+	return cands
+}
+
+// splitWords splits a command line into words like a Unix shell does,
+// handling single and double quotes and backslash escapes.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}